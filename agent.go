@@ -0,0 +1,188 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// The agent caches the vault passphrase in memory, like ssh-agent does for keys.
+// It speaks a line based protocol on a unix socket:
+//  GET         -> OK <passphrase> | ERR
+//  SET <pass>  -> OK
+//  FORGET      -> OK
+//  STOP        -> OK
+
+func agentUsage() {
+	fmt.Println("agent subcommand")
+
+	fmt.Println("\tstart [ttl]")
+	fmt.Println("\t\tRun the passphrase agent in the foreground. The passphrase is forgotten after [ttl] (default 1h)")
+
+	fmt.Println("\tforget")
+	fmt.Println("\t\tForget the cached passphrase")
+
+	fmt.Println("\tstop")
+	fmt.Println("\t\tStop the agent")
+
+	fmt.Println("\tThe socket is $IRRENHAUS_AGENT_SOCK or agent.sock in the config path")
+}
+
+// Get the path of the agent socket
+func agentSocket() string {
+	if socket := os.Getenv("IRRENHAUS_AGENT_SOCK"); socket != "" {
+		return socket
+	}
+
+	return CONFIGPATH + "agent.sock"
+}
+
+// Send a request to the agent
+// It returns the response and any error encountered.
+func agentRequest(request string) (string, error) {
+	if err := checkPermissions(agentSocket()); err != nil {
+		return "", err
+	}
+
+	conn, err := net.DialTimeout("unix", agentSocket(), time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+
+	if _, err := fmt.Fprintln(conn, request); err != nil {
+		return "", err
+	}
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	response = strings.TrimRight(response, "\n")
+
+	if !strings.HasPrefix(response, "OK") {
+		return "", errors.New("agent: " + response)
+	}
+
+	return strings.TrimPrefix(strings.TrimPrefix(response, "OK"), " "), nil
+}
+
+// Get the cached passphrase from the agent
+func agentGet() (string, error) {
+	return agentRequest("GET")
+}
+
+// Hand the passphrase to the agent, if one is running
+func agentSet(passphrase string) {
+	agentRequest("SET " + passphrase)
+}
+
+func agentForget() error {
+	_, err := agentRequest("FORGET")
+
+	return err
+}
+
+func agentStop() error {
+	_, err := agentRequest("STOP")
+
+	return err
+}
+
+// Run the agent until it receives STOP
+//  ttl: Time until a cached passphrase is forgotten
+// It returns any error encountered.
+func agentStart(ttl time.Duration) error {
+	socket := agentSocket()
+	if _, err := agentRequest("GET"); err == nil || strings.HasPrefix(err.Error(), "agent:") {
+		return errors.New("an agent is already listening on " + socket)
+	}
+	os.Remove(socket)
+
+	listener, err := listenAgent(socket)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if err := os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+
+	passphrase := ""
+	expires := time.Time{}
+
+	PrintQuiet("Agent listening on", socket)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+
+		if err := checkAgentPeer(conn); err != nil {
+			PrintVerbose("Rejected agent connection:", err)
+			conn.Close()
+			continue
+		}
+
+		conn.SetDeadline(time.Now().Add(time.Second * 5))
+		request, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		request = strings.TrimRight(request, "\n")
+
+		if passphrase != "" && time.Now().After(expires) {
+			passphrase = ""
+		}
+		stop := false
+		switch {
+		case request == "GET":
+			if passphrase == "" {
+				fmt.Fprintln(conn, "ERR no passphrase cached")
+			} else {
+				fmt.Fprintln(conn, "OK "+passphrase)
+			}
+		case strings.HasPrefix(request, "SET "):
+			passphrase = strings.TrimPrefix(request, "SET ")
+			expires = time.Now().Add(ttl)
+			fmt.Fprintln(conn, "OK")
+		case request == "FORGET":
+			passphrase = ""
+			fmt.Fprintln(conn, "OK")
+		case request == "STOP":
+			stop = true
+			fmt.Fprintln(conn, "OK")
+		default:
+			fmt.Fprintln(conn, "ERR unknown request")
+		}
+		conn.Close()
+
+		if stop {
+			os.Remove(socket)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// Listen on the agent socket
+// The umask is tightened while the socket is created, so it is never accessible by other users.
+// It returns the listener and any error encountered.
+func listenAgent(socket string) (net.Listener, error) {
+	umask := syscall.Umask(0077)
+	defer syscall.Umask(umask)
+
+	return net.Listen("unix", socket)
+}
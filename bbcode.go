@@ -0,0 +1,336 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	markdownHeading    = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	markdownRule       = regexp.MustCompile(`^\s*([-*_])(\s*([-*_])){2,}\s*$`)
+	markdownBullet     = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	markdownNumbered   = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	markdownQuote      = regexp.MustCompile(`^\s*>\s?(.*)$`)
+	markdownFence      = regexp.MustCompile("^\\s*(```|~~~)")
+	markdownImage      = regexp.MustCompile(`!\[([^\]]*)\]\(([^)\s]+)(?:\s+"[^"]*")?\)`)
+	markdownLink       = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)(?:\s+"[^"]*")?\)`)
+	markdownAutolink   = regexp.MustCompile(`<((?:https?|ftp)://[^>\s]+)>`)
+	markdownBold       = regexp.MustCompile(`\*\*(.+?)\*\*|__(.+?)__`)
+	markdownItalicStar = regexp.MustCompile(`\*([^*\s](?:[^*]*[^*\s])?)\*`)
+	// underscores inside words, e.g. in release names, are no emphasis
+	markdownItalicLine = regexp.MustCompile(`(^|[^\pL\pN_])_([^_\s](?:[^_]*[^_\s])?)_($|[^\pL\pN_])`)
+	markdownStrike     = regexp.MustCompile(`~~(.+?)~~`)
+
+	bbcodeTag = regexp.MustCompile(`(?i)\[(/?)(\*|[a-z]+)(?:=([^\]]*))?\]`)
+)
+
+// BBCode sizes of the Markdown headings
+var markdownHeadingSizes = []int{6, 5, 4, 3, 3, 3}
+
+// Convert Markdown to BBCode
+// Supported are headings, emphasis, strike through, links, images, lists, quotes, rules and code.
+func markdownToBBCode(markdown string) string {
+	lines := strings.Split(strings.Replace(markdown, "\r\n", "\n", -1), "\n")
+	output := make([]string, 0, len(lines))
+	// open list or quote, closed by the first line which does not continue it
+	block := ""
+
+	closeBlock := func() {
+		switch block {
+		case "list", "list=1":
+			output = append(output, "[/list]")
+		case "quote":
+			output = append(output, "[/quote]")
+		}
+		block = ""
+	}
+	openBlock := func(kind string, tag string) {
+		if block != kind {
+			closeBlock()
+			output = append(output, tag)
+			block = kind
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+
+		if markdownFence.MatchString(line) {
+			closeBlock()
+			fence := strings.TrimSpace(line)[:3]
+			code := make([]string, 0)
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			output = append(output, "[code]"+strings.Join(code, "\n")+"[/code]")
+			continue
+		}
+
+		switch {
+		case markdownHeading.MatchString(line):
+			closeBlock()
+			match := markdownHeading.FindStringSubmatch(line)
+			size := markdownHeadingSizes[len(match[1])-1]
+			output = append(output, fmt.Sprintf("[size=%d][b]%s[/b][/size]", size, markdownInline(match[2])))
+		case markdownRule.MatchString(line):
+			closeBlock()
+			output = append(output, strings.Repeat("─", 40))
+		case markdownBullet.MatchString(line):
+			openBlock("list", "[list]")
+			output = append(output, "[*]"+markdownInline(markdownBullet.FindStringSubmatch(line)[1]))
+		case markdownNumbered.MatchString(line):
+			openBlock("list=1", "[list=1]")
+			output = append(output, "[*]"+markdownInline(markdownNumbered.FindStringSubmatch(line)[1]))
+		case markdownQuote.MatchString(line):
+			openBlock("quote", "[quote]")
+			output = append(output, markdownInline(markdownQuote.FindStringSubmatch(line)[1]))
+		default:
+			closeBlock()
+			output = append(output, markdownInline(line))
+		}
+	}
+	closeBlock()
+
+	return strings.Join(output, "\n")
+}
+
+// Convert the inline Markdown of a single line, leaving code spans alone
+func markdownInline(line string) string {
+	parts := strings.Split(line, "`")
+	for i := range parts {
+		// odd parts are inside backticks, an unmatched backtick stays as it is
+		if i%2 == 1 && i < len(parts)-1 {
+			parts[i] = "[font=monospace]" + parts[i] + "[/font]"
+			continue
+		}
+		if i%2 == 1 {
+			parts[i] = "`" + parts[i]
+		}
+		text := parts[i]
+		text = markdownImage.ReplaceAllString(text, "[img]$2[/img]")
+		text = markdownLink.ReplaceAllString(text, "[url=$2]$1[/url]")
+		text = markdownAutolink.ReplaceAllString(text, "[url]$1[/url]")
+		text = markdownBold.ReplaceAllString(text, "[b]$1$2[/b]")
+		text = markdownStrike.ReplaceAllString(text, "[s]$1[/s]")
+		text = markdownItalicStar.ReplaceAllString(text, "[i]$1[/i]")
+		text = markdownItalicLine.ReplaceAllString(text, "$1[i]$2[/i]$3")
+		parts[i] = text
+	}
+
+	return strings.Join(parts, "")
+}
+
+// ANSI escape sequences of the BBCode colors
+var bbcodeColors = map[string]string{
+	"black": "30", "red": "31", "green": "32", "yellow": "33", "orange": "33",
+	"blue": "34", "purple": "35", "magenta": "35", "cyan": "36", "white": "37",
+	"gray": "90", "grey": "90", "darkred": "31", "darkgreen": "32", "darkblue": "34",
+}
+
+type bbcodeStyle struct {
+	tag  string
+	ansi string
+	// text written when the tag closes
+	suffix string
+}
+
+// Render BBCode for a terminal
+//  bbcode: BBCode text
+//  color:  Use ANSI escape sequences, otherwise only the text is written
+// Unknown tags are left as they are.
+func bbcodeToANSI(bbcode string, color bool) string {
+	var builder strings.Builder
+	stack := make([]bbcodeStyle, 0)
+	listCounters := make([]int, 0)
+	// inside [code], where tags are text
+	code := false
+
+	apply := func() {
+		if !color {
+			return
+		}
+		builder.WriteString("\x1b[0m")
+		for _, style := range stack {
+			if style.ansi != "" {
+				builder.WriteString("\x1b[" + style.ansi + "m")
+			}
+		}
+	}
+	quoteDepth := func() int {
+		depth := 0
+		for _, style := range stack {
+			if style.tag == "quote" {
+				depth++
+			}
+		}
+		return depth
+	}
+	opened := func(tag string) bool {
+		for _, style := range stack {
+			if style.tag == tag {
+				return true
+			}
+		}
+		return false
+	}
+	write := func(text string) {
+		prefix := strings.Repeat("│ ", quoteDepth())
+		if prefix != "" {
+			text = strings.Replace(text, "\n", "\n"+prefix, -1)
+		}
+		builder.WriteString(text)
+	}
+
+	last := 0
+	for _, match := range bbcodeTag.FindAllStringSubmatchIndex(bbcode, -1) {
+		closing := bbcode[match[2]:match[3]] == "/"
+		tag := strings.ToLower(bbcode[match[4]:match[5]])
+		value := ""
+		if match[6] >= 0 {
+			value = strings.Trim(bbcode[match[6]:match[7]], `"'`)
+		}
+		if code && !(closing && tag == "code") {
+			continue
+		}
+		// closing tags which match no open tag are text, like unknown tags
+		if closing && !opened(tag) {
+			write(bbcode[last:match[1]])
+			last = match[1]
+			continue
+		}
+		// block tags start on a line of their own and swallow the line breaks around them
+		block := tag == "list" || tag == "quote" || tag == "code" || tag == "table" || tag == "tr"
+		segment := bbcode[last:match[0]]
+		if block && closing {
+			segment = strings.TrimSuffix(segment, "\n")
+		}
+		write(segment)
+		last = match[1]
+		if block {
+			if !closing && builder.Len() > 0 && !strings.HasSuffix(builder.String(), "\n") {
+				builder.WriteString("\n")
+			}
+			if last < len(bbcode) && bbcode[last] == '\n' {
+				last++
+			}
+		}
+
+		if closing {
+			// close the innermost matching tag and everything opened inside it
+			for i := len(stack) - 1; i >= 0; i-- {
+				if stack[i].tag != tag {
+					continue
+				}
+				for j := len(stack) - 1; j >= i; j-- {
+					builder.WriteString(stack[j].suffix)
+				}
+				stack = stack[:i]
+				if tag == "list" && len(listCounters) > 0 {
+					listCounters = listCounters[:len(listCounters)-1]
+				}
+				if tag == "code" {
+					code = false
+				}
+				apply()
+				if block {
+					write("\n")
+				}
+				break
+			}
+			continue
+		}
+
+		style := bbcodeStyle{tag: tag}
+		switch tag {
+		case "b":
+			style.ansi = "1"
+		case "i":
+			style.ansi = "3"
+		case "u":
+			style.ansi = "4"
+		case "s":
+			style.ansi = "9"
+		case "size":
+			var size int
+			if _, err := fmt.Sscanf(value, "%d", &size); err == nil && size >= 4 {
+				style.ansi = "1"
+			}
+		case "color":
+			style.ansi = bbcodeColors[strings.ToLower(value)]
+		case "url":
+			style.ansi = "4;34"
+			if value != "" {
+				style.suffix = "\x1b[0m (" + value + ")"
+				if !color {
+					style.suffix = " (" + value + ")"
+				}
+			}
+		case "img":
+			style.ansi = "2"
+			builder.WriteString("[image: ")
+			style.suffix = "]"
+		case "quote":
+			if value != "" {
+				write(value + " wrote:\n")
+			}
+		case "code", "font":
+			style.ansi = "2"
+			code = tag == "code"
+		case "center", "left", "right", "align", "spoiler", "hide", "table", "tr":
+		case "td", "th":
+			style.suffix = "  "
+		case "list":
+			counter := 0
+			if value != "" {
+				counter = 1
+			}
+			listCounters = append(listCounters, counter)
+		case "*":
+			if len(listCounters) == 0 {
+				builder.WriteString(bbcode[match[0]:match[1]])
+				continue
+			}
+			n := &listCounters[len(listCounters)-1]
+			if *n > 0 {
+				write(fmt.Sprintf("  %d. ", *n))
+				*n++
+			} else {
+				write("  • ")
+			}
+			continue
+		default:
+			builder.WriteString(bbcode[match[0]:match[1]])
+			continue
+		}
+		stack = append(stack, style)
+		apply()
+		if tag == "quote" {
+			write(strings.Repeat("│ ", quoteDepth()))
+		}
+	}
+	write(bbcode[last:])
+	if color {
+		builder.WriteString("\x1b[0m")
+	}
+
+	return builder.String()
+}
@@ -0,0 +1,105 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBBCodeToANSI(t *testing.T) {
+	tests := []struct {
+		bbcode string
+		text   string
+	}{
+		{"[b]bold[/b] text", "bold text"},
+		{"[url=http://example.com]link[/url]", "link (http://example.com)"},
+		{"[img]http://example.com/a.png[/img]", "[image: http://example.com/a.png]"},
+		{"[b]a[i]b[/b]c", "abc"},
+		{"[code][b]x[/b][/code]", "[b]x[/b]\n"},
+		// unknown and unmatched tags are text
+		{"a [/foo] b [foo]x[/foo]", "a [/foo] b [foo]x[/foo]"},
+		{"x[/b]y", "x[/b]y"},
+		{"[b]x[/i][/b]", "x[/i]"},
+		{"[*] item", "[*] item"},
+	}
+
+	for _, test := range tests {
+		if text := bbcodeToANSI(test.bbcode, false); text != test.text {
+			t.Errorf("bbcodeToANSI(%q) = %q, want %q", test.bbcode, text, test.text)
+		}
+	}
+}
+
+func TestMarkdownInline(t *testing.T) {
+	tests := []struct {
+		markdown string
+		bbcode   string
+	}{
+		{"**bold** and *italic*", "[b]bold[/b] and [i]italic[/i]"},
+		{"__bold__ and _italic_.", "[b]bold[/b] and [i]italic[/i]."},
+		{"~~gone~~", "[s]gone[/s]"},
+		{"[site](http://example.com)", "[url=http://example.com]site[/url]"},
+		{`[site](http://example.com "Title")`, "[url=http://example.com]site[/url]"},
+		{"![cover](http://example.com/a.png)", "[img]http://example.com/a.png[/img]"},
+		{"<https://example.com/x>", "[url]https://example.com/x[/url]"},
+		// underscores of release names are no emphasis
+		{"Some_Movie_2018_1080p", "Some_Movie_2018_1080p"},
+		{"Some.Movie_x264_GRP and _this_", "Some.Movie_x264_GRP and [i]this[/i]"},
+		{"a * b * c", "a * b * c"},
+		// code spans are left alone
+		{"run `a *b* c` now", "run [font=monospace]a *b* c[/font] now"},
+		{"one ` backtick *x*", "one ` backtick [i]x[/i]"},
+		{"`a` and `b *c*", "[font=monospace]a[/font] and `b [i]c[/i]"},
+	}
+
+	for _, test := range tests {
+		if bbcode := markdownInline(test.markdown); bbcode != test.bbcode {
+			t.Errorf("markdownInline(%q) = %q, want %q", test.markdown, bbcode, test.bbcode)
+		}
+	}
+}
+
+func TestMarkdownToBBCode(t *testing.T) {
+	tests := []struct {
+		markdown string
+		bbcode   string
+	}{
+		{"# Title", "[size=6][b]Title[/b][/size]"},
+		{"### Sub ###", "[size=4][b]Sub[/b][/size]"},
+		{"---", strings.Repeat("─", 40)},
+		{"- a\n* b\n\ntext", "[list]\n[*]a\n[*]b\n[/list]\n\ntext"},
+		{"1. a\n2) b", "[list=1]\n[*]a\n[*]b\n[/list]"},
+		// a numbered list right after a bullet list is a new list
+		{"- a\n1. b", "[list]\n[*]a\n[/list]\n[list=1]\n[*]b\n[/list]"},
+		{"> quoted **bold**\n> more", "[quote]\nquoted [b]bold[/b]\nmore\n[/quote]"},
+		// fenced code is not converted
+		{"```\n# no heading\n**x**\n```\nafter", "[code]# no heading\n**x**[/code]\nafter"},
+		{"- item\n~~~go\nx\n~~~", "[list]\n[*]item\n[/list]\n[code]x[/code]"},
+		// an unclosed fence runs to the end
+		{"```\na\nb", "[code]a\nb[/code]"},
+		{"a\r\nb", "a\nb"},
+	}
+
+	for _, test := range tests {
+		if bbcode := markdownToBBCode(test.markdown); bbcode != test.bbcode {
+			t.Errorf("markdownToBBCode(%q) = %q, want %q", test.markdown, bbcode, test.bbcode)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Decoded bencode values are int64, string, []interface{} and map[string]interface{}.
+
+type bdecoder struct {
+	data []byte
+	pos  int
+	// raw encoding of the values of top level dictionary keys
+	raw map[string][]byte
+}
+
+// Decode a bencoded value
+// It returns the value and any error encountered.
+func bdecode(data []byte) (interface{}, error) {
+	d := bdecoder{data: data}
+	value, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("bencode: trailing data at offset %d", d.pos)
+	}
+
+	return value, nil
+}
+
+// Get the raw encoding of the value of a key in the top level dictionary, e.g. the info dictionary of a torrent
+// It returns the raw value and any error encountered.
+func bdecodeRaw(data []byte, key string) ([]byte, error) {
+	d := bdecoder{data: data, raw: make(map[string][]byte)}
+	if _, err := d.value(0); err != nil {
+		return nil, err
+	}
+
+	raw, ok := d.raw[key]
+	if !ok {
+		return nil, fmt.Errorf("bencode: missing key '%s'", key)
+	}
+
+	return raw, nil
+}
+
+func (d *bdecoder) value(depth int) (interface{}, error) {
+	if d.pos >= len(d.data) {
+		return nil, errors.New("bencode: unexpected end of data")
+	}
+	if depth > 64 {
+		return nil, errors.New("bencode: nested too deeply")
+	}
+
+	switch c := d.data[d.pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(d.data[d.pos:], 'e')
+		if end < 0 {
+			return nil, errors.New("bencode: unterminated integer")
+		}
+		i, err := strconv.ParseInt(string(d.data[d.pos+1:d.pos+end]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bencode: invalid integer at offset %d", d.pos)
+		}
+		d.pos += end + 1
+		return i, nil
+	case c >= '0' && c <= '9':
+		return d.str()
+	case c == 'l':
+		d.pos++
+		list := make([]interface{}, 0)
+		for {
+			if d.pos >= len(d.data) {
+				return nil, errors.New("bencode: unterminated list")
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return list, nil
+			}
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+	case c == 'd':
+		d.pos++
+		dict := make(map[string]interface{})
+		for {
+			if d.pos >= len(d.data) {
+				return nil, errors.New("bencode: unterminated dictionary")
+			}
+			if d.data[d.pos] == 'e' {
+				d.pos++
+				return dict, nil
+			}
+			key, err := d.str()
+			if err != nil {
+				return nil, err
+			}
+			start := d.pos
+			v, err := d.value(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if depth == 0 && d.raw != nil {
+				d.raw[key] = d.data[start:d.pos]
+			}
+			dict[key] = v
+		}
+	}
+
+	return nil, fmt.Errorf("bencode: invalid value at offset %d", d.pos)
+}
+
+func (d *bdecoder) str() (string, error) {
+	colon := bytes.IndexByte(d.data[d.pos:], ':')
+	if colon < 0 {
+		return "", errors.New("bencode: invalid string")
+	}
+	length, err := strconv.Atoi(string(d.data[d.pos : d.pos+colon]))
+	if err != nil || length < 0 {
+		return "", fmt.Errorf("bencode: invalid string length at offset %d", d.pos)
+	}
+	start := d.pos + colon + 1
+	if length > len(d.data)-start {
+		return "", errors.New("bencode: string exceeds data")
+	}
+	d.pos = start + length
+
+	return string(d.data[start:d.pos]), nil
+}
+
+// Encode a value
+// Supported are integers, strings, byte slices, lists and dictionaries with string keys.
+// It returns the encoding and any error encountered.
+func bencode(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := bencodeTo(&buffer, value)
+
+	return buffer.Bytes(), err
+}
+
+func bencodeTo(buffer *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case int:
+		fmt.Fprintf(buffer, "i%de", v)
+	case int64:
+		fmt.Fprintf(buffer, "i%de", v)
+	case bool:
+		if v {
+			buffer.WriteString("i1e")
+		} else {
+			buffer.WriteString("i0e")
+		}
+	case string:
+		fmt.Fprintf(buffer, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buffer, "%d:", len(v))
+		buffer.Write(v)
+	case []string:
+		buffer.WriteByte('l')
+		for _, s := range v {
+			fmt.Fprintf(buffer, "%d:%s", len(s), s)
+		}
+		buffer.WriteByte('e')
+	case []interface{}:
+		buffer.WriteByte('l')
+		for _, item := range v {
+			if err := bencodeTo(buffer, item); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte('e')
+	case map[string]interface{}:
+		// keys must be sorted as raw strings
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		buffer.WriteByte('d')
+		for _, key := range keys {
+			fmt.Fprintf(buffer, "%d:%s", len(key), key)
+			if err := bencodeTo(buffer, v[key]); err != nil {
+				return err
+			}
+		}
+		buffer.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: unsupported type %T", value)
+	}
+
+	return nil
+}
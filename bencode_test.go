@@ -0,0 +1,114 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBdecode(t *testing.T) {
+	tests := []struct {
+		data  string
+		value interface{}
+	}{
+		{"i42e", int64(42)},
+		{"i-7e", int64(-7)},
+		{"4:spam", "spam"},
+		{"0:", ""},
+		{"l4:spami1ee", []interface{}{"spam", int64(1)}},
+		{"d3:bar4:spam3:fooi42ee", map[string]interface{}{"bar": "spam", "foo": int64(42)}},
+	}
+
+	for _, test := range tests {
+		value, err := bdecode([]byte(test.data))
+		if err != nil {
+			t.Errorf("bdecode(%q): %s", test.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, test.value) {
+			t.Errorf("bdecode(%q) = %#v, want %#v", test.data, value, test.value)
+		}
+	}
+}
+
+func TestBdecodeInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"i42",
+		"ie",
+		"i4x2e",
+		"4:spa",
+		"4spam",
+		"-1:a",
+		"l4:spam",
+		"d3:foo",
+		"d3:fooi1e",
+		"di1ei2ee",
+		"4:spamx",
+		"x",
+		// lengths which overflow the offset calculation
+		"9223372036854775807:x",
+		"d4:infod4:name9223372036854775807:xee",
+		"99999999999999999999:x",
+	}
+
+	for _, data := range tests {
+		if value, err := bdecode([]byte(data)); err == nil {
+			t.Errorf("bdecode(%q) = %#v, want an error", data, value)
+		}
+	}
+}
+
+func TestBdecodeNested(t *testing.T) {
+	data := make([]byte, 0, 200)
+	for i := 0; i < 100; i++ {
+		data = append(data, 'l')
+	}
+	for i := 0; i < 100; i++ {
+		data = append(data, 'e')
+	}
+
+	if _, err := bdecode(data); err == nil {
+		t.Error("bdecode of 100 nested lists succeeded, want an error")
+	}
+}
+
+func TestBencodeRoundTrip(t *testing.T) {
+	value := map[string]interface{}{
+		"announce": "http://example.com/announce",
+		"info": map[string]interface{}{
+			"name":         "release",
+			"piece length": int64(16384),
+			"files":        []interface{}{map[string]interface{}{"length": int64(3), "path": []interface{}{"a.txt"}}},
+		},
+	}
+
+	data, err := bencode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := bdecode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, value) {
+		t.Errorf("bdecode(bencode(v)) = %#v, want %#v", decoded, value)
+	}
+}
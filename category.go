@@ -0,0 +1,203 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fuchsi/irrenhaus-api/Category"
+)
+
+// Highest category ID probed when building the category list
+const maxCategoryID = 255
+
+// Aliases for category groups, mapped to the group names used by the site
+var CategoryAliases = map[string][]string{
+	"movies":   {"filme", "movies"},
+	"series":   {"serien", "series", "tv"},
+	"tv":       {"serien", "series", "tv"},
+	"music":    {"musik", "music", "audio"},
+	"games":    {"spiele", "games"},
+	"software": {"software", "programme", "apps"},
+	"books":    {"bücher", "ebooks", "books"},
+	"docs":     {"doku", "dokus", "dokumentation"},
+}
+
+type categoryInfo struct {
+	Id    int    `json:"id"`
+	Name  string `json:"name"`
+	Group string `json:"group"`
+}
+
+var categoryCache []categoryInfo
+
+// Get all known categories, ordered by ID
+func categoryList() []categoryInfo {
+	if categoryCache != nil {
+		return categoryCache
+	}
+
+	categoryCache = make([]categoryInfo, 0)
+	for id := 0; id <= maxCategoryID; id++ {
+		name, err := Category.ToString(id)
+		if err != nil || name == "" {
+			continue
+		}
+		categoryCache = append(categoryCache, categoryInfo{id, name, categoryGroup(name)})
+	}
+
+	return categoryCache
+}
+
+// Get the group of a category name, i.e. the part in front of the first separator
+func categoryGroup(name string) string {
+	for _, sep := range []string{"/", " - ", ":"} {
+		if i := strings.Index(name, sep); i > 0 {
+			return strings.ToLower(strings.TrimSpace(name[:i]))
+		}
+	}
+
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Resolve a list of category IDs, names, name prefixes or group aliases
+// It returns the category IDs and any error encountered.
+func resolveCategories(args []string) ([]int, error) {
+	categories := make([]int, 0)
+	seen := make(map[int]bool)
+
+	for _, arg := range args {
+		ids, err := resolveCategory(arg)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				categories = append(categories, id)
+			}
+		}
+	}
+
+	return categories, nil
+}
+
+// Resolve a single category ID, name, name prefix or group alias
+// It returns the matching category IDs and any error encountered.
+func resolveCategory(arg string) ([]int, error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return []int{}, nil
+	}
+
+	if id, err := strconv.ParseInt(arg, 10, 32); err == nil {
+		return []int{int(id)}, nil
+	}
+
+	needle := strings.ToLower(arg)
+	list := categoryList()
+
+	// exact name
+	for _, c := range list {
+		if strings.ToLower(c.Name) == needle {
+			return []int{c.Id}, nil
+		}
+	}
+
+	// group or group alias
+	groups := []string{needle}
+	if aliases, ok := CategoryAliases[needle]; ok {
+		groups = append(groups, aliases...)
+	}
+	ids := make([]int, 0)
+	for _, c := range list {
+		for _, group := range groups {
+			if c.Group == group {
+				ids = append(ids, c.Id)
+				break
+			}
+		}
+	}
+	if len(ids) > 0 {
+		return ids, nil
+	}
+
+	// unambiguous prefix
+	matches := make([]categoryInfo, 0)
+	for _, c := range list {
+		if strings.HasPrefix(strings.ToLower(c.Name), needle) {
+			matches = append(matches, c)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("unknown category '%s'. See 'categories' for help", arg)
+	case 1:
+		return []int{matches[0].Id}, nil
+	}
+
+	names := make([]string, len(matches))
+	for i, c := range matches {
+		names[i] = c.Name
+	}
+	return nil, fmt.Errorf("category '%s' is ambiguous: %s", arg, strings.Join(names, ", "))
+}
+
+// Resolve exactly one category
+// It returns the category ID and any error encountered.
+func resolveSingleCategory(args []string) (int, error) {
+	categories, err := resolveCategories(args)
+	if err != nil {
+		return 0, err
+	}
+	if len(categories) != 1 {
+		return 0, errors.New("exactly one category is required. See 'categories' for help")
+	}
+
+	return categories[0], nil
+}
+
+func categories() error {
+	list := categoryList()
+
+	rows := make([][]string, 0, len(list))
+	for _, c := range list {
+		rows = append(rows, []string{fmt.Sprintf("%d", c.Id), c.Name, c.Group})
+	}
+
+	aliases := make([]string, 0, len(CategoryAliases))
+	for alias := range CategoryAliases {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	return Render(Output{
+		Data: list,
+		Sections: []Section{{
+			Header:  []string{"ID", "Name", "Group"},
+			Rows:    rows,
+			Records: list,
+			Text:    "Groups can be selected by their name or one of the aliases: " + strings.Join(aliases, ", "),
+		}},
+	})
+}
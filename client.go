@@ -0,0 +1,194 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings of a BitTorrent client, configured in the Clients section of the config file
+type ClientConfig struct {
+	// transmission, qbittorrent, deluge or watch
+	Type     string
+	Url      string `json:",omitempty"`
+	Username string `json:",omitempty"`
+	Password string `json:",omitempty"`
+	// download directory of the client
+	SavePath string `json:",omitempty"`
+	// label, category or tag, depending on the client
+	Label  string `json:",omitempty"`
+	Paused bool   `json:",omitempty"`
+	// directory of the watch client
+	WatchDir string `json:",omitempty"`
+}
+
+// A BitTorrent client which can receive torrents
+type torrentClient interface {
+	// Add a torrent
+	//  torrent:  Content of the .torrent file
+	//  filename: Name of the .torrent file
+	Add(torrent []byte, filename string) error
+}
+
+type clientRecord struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Url      string `json:"url,omitempty"`
+	SavePath string `json:"save_path,omitempty"`
+	Label    string `json:"label,omitempty"`
+	Paused   bool   `json:"paused"`
+}
+
+var clientHTTP = &http.Client{Timeout: time.Second * 30}
+
+func clientUsage() {
+	fmt.Println("client subcommand")
+
+	fmt.Println("\tlist")
+	fmt.Println("\t\tList the configured clients")
+
+	fmt.Println("\tadd <name> <torrent>...")
+	fmt.Println("\t\tSend torrent files to the client <name>")
+
+	fmt.Println("\tClients are configured in the Clients section of the config file, e.g.")
+	fmt.Println(`	"Clients": {"seedbox": {"Type": "transmission", "Url": "http://localhost:9091", "SavePath": "/data", "Paused": true}}`)
+	fmt.Println("\tUse download --client <name> to send downloads to a client")
+}
+
+// Create the client with the name from the config
+// It returns the client and any error encountered.
+func newTorrentClient(name string) (torrentClient, error) {
+	settings, ok := config.Clients[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown client '%s'. See 'client list'", name)
+	}
+
+	switch strings.ToLower(settings.Type) {
+	case "transmission":
+		return &transmissionClient{settings: settings}, nil
+	case "qbittorrent":
+		return &qbittorrentClient{settings: settings}, nil
+	case "deluge":
+		return &delugeClient{settings: settings}, nil
+	case "watch":
+		return &watchClient{settings: settings}, nil
+	}
+
+	return nil, fmt.Errorf("client '%s' has the unknown type '%s'", name, settings.Type)
+}
+
+// A client which can be shared by parallel downloads
+// The backends keep their session between calls, so a batch logs in only once.
+type lockedClient struct {
+	mutex  sync.Mutex
+	client torrentClient
+}
+
+func (l *lockedClient) Add(torrent []byte, filename string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.client.Add(torrent, filename)
+}
+
+// Create the client with the name from the config for a batch of torrents
+// It returns the client, which is safe for concurrent use, and any error encountered.
+func newSharedTorrentClient(name string) (torrentClient, error) {
+	client, err := newTorrentClient(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &lockedClient{client: client}, nil
+}
+
+// Send a torrent file to a client
+//  client: Client created by newTorrentClient, reused for every torrent of a batch
+//  name:   Name of the client in the config
+//  path:   Path of the .torrent file
+// It returns any error encountered.
+func sendToClient(client torrentClient, name string, path string) error {
+	torrent, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := client.Add(torrent, filepath.Base(path)); err != nil {
+		return fmt.Errorf("%s: %s", name, err.Error())
+	}
+	PrintVerbose("Added", path, "to", name)
+
+	return nil
+}
+
+func clientAdd(name string, paths []string) error {
+	client, err := newTorrentClient(name)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err := sendToClient(client, name, path); err != nil {
+			return err
+		}
+		PrintQuiet("Added", path, "to", name)
+	}
+
+	return nil
+}
+
+func clientList() error {
+	names := make([]string, 0, len(config.Clients))
+	for name := range config.Clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	records := make([]clientRecord, 0, len(names))
+	rows := make([][]string, 0, len(names))
+	for _, name := range names {
+		c := config.Clients[name]
+		location := c.Url
+		if c.Type == "watch" {
+			location = c.WatchDir
+		}
+		pausedStr := "No"
+		if c.Paused {
+			pausedStr = "Yes"
+		}
+		records = append(records, clientRecord{name, c.Type, location, c.SavePath, c.Label, c.Paused})
+		rows = append(rows, []string{name, c.Type, location, c.SavePath, c.Label, pausedStr})
+	}
+
+	return Render(Output{
+		Data: records,
+		Sections: []Section{{
+			Header:  []string{"Name", "Type", "Url", "Save Path", "Label", "Paused"},
+			Rows:    rows,
+			Records: records,
+		}},
+	})
+}
@@ -0,0 +1,177 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Deluge WebUI JSON-RPC client
+type delugeClient struct {
+	settings ClientConfig
+	// session cookie of the WebUI
+	session   string
+	requestId int
+}
+
+type delugeRequest struct {
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+	Id     int           `json:"id"`
+}
+
+type delugeResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Message string `json:"message"`
+		Code    int    `json:"code"`
+	} `json:"error"`
+	Id int `json:"id"`
+}
+
+func (d *delugeClient) endpoint() string {
+	url := strings.TrimRight(d.settings.Url, "/")
+	if !strings.HasSuffix(url, "/json") {
+		url += "/json"
+	}
+
+	return url
+}
+
+// Call a method and decode its result into result, which may be nil
+func (d *delugeClient) call(result interface{}, method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	d.requestId++
+	body, err := json.Marshal(delugeRequest{method, params, d.requestId})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", d.endpoint(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.session != "" {
+		req.AddCookie(&http.Cookie{Name: "_session_id", Value: d.session})
+	}
+
+	resp, err := clientHTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "_session_id" {
+			d.session = cookie.Value
+		}
+	}
+
+	var response delugeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return err
+	}
+	if response.Error != nil {
+		return fmt.Errorf("%s: %s", method, response.Error.Message)
+	}
+	if result != nil {
+		return json.Unmarshal(response.Result, result)
+	}
+
+	return nil
+}
+
+// Log in to the WebUI and connect it to the first daemon if necessary
+func (d *delugeClient) connect() error {
+	var ok bool
+	if err := d.call(&ok, "auth.login", d.settings.Password); err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("login failed, check the password")
+	}
+
+	var connected bool
+	if err := d.call(&connected, "web.connected"); err != nil {
+		return err
+	}
+	if connected {
+		return nil
+	}
+
+	// every host is [id, address, port, status]
+	var hosts [][]interface{}
+	if err := d.call(&hosts, "web.get_hosts"); err != nil {
+		return err
+	}
+	if len(hosts) == 0 || len(hosts[0]) == 0 {
+		return errors.New("the WebUI has no daemon configured")
+	}
+
+	return d.call(nil, "web.connect", hosts[0][0])
+}
+
+func (d *delugeClient) Add(torrent []byte, filename string) error {
+	if d.session == "" {
+		if err := d.connect(); err != nil {
+			return err
+		}
+	}
+
+	options := map[string]interface{}{
+		"add_paused": d.settings.Paused,
+	}
+	if d.settings.SavePath != "" {
+		options["download_location"] = d.settings.SavePath
+	}
+
+	var hash *string
+	if err := d.call(&hash, "core.add_torrent_file", filename, base64.StdEncoding.EncodeToString(torrent), options); err != nil {
+		return err
+	}
+	// deluge returns null for torrents it already has
+	if hash == nil {
+		PrintVerbose(filename, "is already in deluge")
+		return nil
+	}
+
+	if d.settings.Label != "" {
+		// needs the Label plugin, labels must be lowercase
+		label := strings.ToLower(d.settings.Label)
+		if err := d.call(nil, "label.add", label); err != nil && !strings.Contains(err.Error(), "already exists") {
+			return err
+		}
+		if err := d.call(nil, "label.set_torrent", *hash, label); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,141 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// qBittorrent WebUI API v2 client
+type qbittorrentClient struct {
+	settings ClientConfig
+	// value of the SID cookie
+	sid string
+}
+
+func (q *qbittorrentClient) endpoint(method string) string {
+	return strings.TrimRight(q.settings.Url, "/") + "/api/v2/" + method
+}
+
+// Read the plain text answer of the WebUI
+func (q *qbittorrentClient) do(req *http.Request) (string, error) {
+	if q.sid != "" {
+		req.AddCookie(&http.Cookie{Name: "SID", Value: q.sid})
+	}
+	// the WebUI rejects requests without a matching referer when CSRF protection is on
+	req.Header.Set("Referer", q.settings.Url)
+
+	resp, err := clientHTTP.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return "", errors.New("access denied, check the username and password")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == "SID" {
+			q.sid = cookie.Value
+		}
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (q *qbittorrentClient) login() error {
+	form := url.Values{}
+	form.Set("username", q.settings.Username)
+	form.Set("password", q.settings.Password)
+	req, err := http.NewRequest("POST", q.endpoint("auth/login"), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	answer, err := q.do(req)
+	if err != nil {
+		return err
+	}
+	if answer != "Ok." {
+		return errors.New("login failed, check the username and password")
+	}
+
+	return nil
+}
+
+func (q *qbittorrentClient) Add(torrent []byte, filename string) error {
+	if q.sid == "" {
+		if err := q.login(); err != nil {
+			return err
+		}
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("torrents", filename)
+	if err != nil {
+		return err
+	}
+	part.Write(torrent)
+	if q.settings.SavePath != "" {
+		form.WriteField("savepath", q.settings.SavePath)
+	}
+	if q.settings.Label != "" {
+		form.WriteField("category", q.settings.Label)
+	}
+	if q.settings.Paused {
+		// qBittorrent 5 renamed paused to stopped
+		form.WriteField("paused", "true")
+		form.WriteField("stopped", "true")
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", q.endpoint("torrents/add"), &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	answer, err := q.do(req)
+	if err != nil {
+		return err
+	}
+	if answer != "Ok." {
+		return errors.New("qbittorrent rejected the torrent")
+	}
+
+	return nil
+}
@@ -0,0 +1,378 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Fake Transmission, qBittorrent and Deluge server
+// It accepts any credentials, but enforces the session handshakes of the real APIs.
+type fakeClientServer struct {
+	mutex    sync.Mutex
+	requests int
+	logins   int
+	// info hashes of the added torrents
+	torrents map[string]bool
+	// options of the last added torrent
+	options map[string]interface{}
+	// answer of the handlers, overridden by the error tests
+	status      int
+	loginAnswer string
+	addAnswer   string
+	result      string
+	hosts       [][]interface{}
+}
+
+const fakeSessionId = "fake-session"
+
+func newFakeClientServer(t *testing.T) (*fakeClientServer, *httptest.Server) {
+	s := &fakeClientServer{
+		torrents:    make(map[string]bool),
+		status:      http.StatusOK,
+		loginAnswer: "Ok.",
+		addAnswer:   "Ok.",
+		result:      "success",
+		hosts:       [][]interface{}{{"fakehost", "127.0.0.1", 58846, "Online"}},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/transmission/rpc", s.transmission)
+	mux.HandleFunc("/api/v2/auth/login", s.qbittorrentLogin)
+	mux.HandleFunc("/api/v2/torrents/add", s.qbittorrentAdd)
+	mux.HandleFunc("/json", s.deluge)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.requests++
+		status := s.status
+		s.mutex.Unlock()
+		if status != http.StatusOK {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return s, server
+}
+
+// Parse and remember a torrent
+// It returns the info hash, true if the torrent is new, and any error encountered.
+func (s *fakeClientServer) add(torrent []byte, options map[string]interface{}) (string, bool, error) {
+	meta, err := parseTorrent(torrent)
+	if err != nil {
+		return "", false, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.options = options
+	if s.torrents[meta.InfoHash] {
+		return meta.InfoHash, false, nil
+	}
+	s.torrents[meta.InfoHash] = true
+
+	return meta.InfoHash, true, nil
+}
+
+func (s *fakeClientServer) transmission(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(transmissionSessionHeader) != fakeSessionId {
+		w.Header().Set(transmissionSessionHeader, fakeSessionId)
+		http.Error(w, "invalid session id", http.StatusConflict)
+		return
+	}
+
+	var request transmissionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	response := map[string]interface{}{"result": s.result, "arguments": map[string]interface{}{}}
+	if request.Method != "torrent-add" {
+		response["result"] = "method name not recognized"
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	metainfo, _ := request.Arguments["metainfo"].(string)
+	torrent, err := base64.StdEncoding.DecodeString(metainfo)
+	if err != nil {
+		response["result"] = "invalid or corrupt torrent file"
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	delete(request.Arguments, "metainfo")
+	hash, added, err := s.add(torrent, request.Arguments)
+	if err != nil {
+		response["result"] = "invalid or corrupt torrent file"
+	} else if added {
+		response["arguments"] = map[string]interface{}{"torrent-added": map[string]interface{}{"hashString": hash}}
+	} else {
+		response["arguments"] = map[string]interface{}{"torrent-duplicate": map[string]interface{}{"hashString": hash}}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *fakeClientServer) qbittorrentLogin(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.logins++
+	s.mutex.Unlock()
+	if s.loginAnswer == "Ok." {
+		http.SetCookie(w, &http.Cookie{Name: "SID", Value: fakeSessionId})
+	}
+	fmt.Fprint(w, s.loginAnswer)
+}
+
+func (s *fakeClientServer) qbittorrentAdd(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie("SID"); err != nil || cookie.Value != fakeSessionId {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	options := make(map[string]interface{})
+	for key, values := range r.MultipartForm.Value {
+		options[key] = strings.Join(values, ",")
+	}
+	for _, header := range r.MultipartForm.File["torrents"] {
+		file, err := header.Open()
+		if err != nil {
+			fmt.Fprint(w, "Fails.")
+			return
+		}
+		torrent, err := ioutil.ReadAll(file)
+		file.Close()
+		if err != nil {
+			fmt.Fprint(w, "Fails.")
+			return
+		}
+		if _, _, err := s.add(torrent, options); err != nil {
+			fmt.Fprint(w, "Fails.")
+			return
+		}
+	}
+	fmt.Fprint(w, s.addAnswer)
+}
+
+func (s *fakeClientServer) deluge(w http.ResponseWriter, r *http.Request) {
+	var request delugeRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var result interface{}
+	var failure string
+	cookie, err := r.Cookie("_session_id")
+	authenticated := err == nil && cookie.Value == fakeSessionId
+
+	switch {
+	case request.Method == "auth.login":
+		s.mutex.Lock()
+		s.logins++
+		s.mutex.Unlock()
+		result = s.loginAnswer == "Ok."
+		if result == true {
+			http.SetCookie(w, &http.Cookie{Name: "_session_id", Value: fakeSessionId})
+		}
+	case !authenticated:
+		failure = "Not authenticated"
+	case request.Method == "web.connected":
+		result = false
+	case request.Method == "web.get_hosts":
+		result = s.hosts
+	case request.Method == "web.connect", request.Method == "label.add", request.Method == "label.set_torrent":
+		result = nil
+	case request.Method == "core.add_torrent_file" && len(request.Params) == 3:
+		encoded, _ := request.Params[1].(string)
+		options, _ := request.Params[2].(map[string]interface{})
+		torrent, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			failure = err.Error()
+			break
+		}
+		hash, added, err := s.add(torrent, options)
+		if err != nil {
+			failure = err.Error()
+		} else if added {
+			result = hash
+		}
+	default:
+		failure = "Unknown method " + request.Method
+	}
+
+	response := map[string]interface{}{"id": request.Id, "result": result, "error": nil}
+	if failure != "" {
+		response["result"] = nil
+		response["error"] = map[string]interface{}{"message": failure, "code": 2}
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// Create a client of a type for the fake server
+func newTestClient(t *testing.T, clientType string, url string) torrentClient {
+	config.Clients = map[string]ClientConfig{
+		"test": {Type: clientType, Url: url, SavePath: "/data", Label: "Movies", Paused: true},
+	}
+	client, err := newTorrentClient("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func TestClientAdd(t *testing.T) {
+	first := testTorrent(t, 16384, 40000, 3)
+	second := testTorrent(t, 16384, 30000, 2)
+
+	tests := []struct {
+		clientType string
+		// option names of the save path and the paused flag
+		savePath string
+		paused   string
+	}{
+		{"transmission", "download-dir", "paused"},
+		{"qbittorrent", "savepath", "paused"},
+		{"deluge", "download_location", "add_paused"},
+	}
+
+	for _, test := range tests {
+		server, ts := newFakeClientServer(t)
+		client := newTestClient(t, test.clientType, ts.URL)
+
+		// the duplicate is not an error
+		for _, torrent := range [][]byte{first, second, first} {
+			if err := client.Add(torrent, "release.torrent"); err != nil {
+				t.Fatalf("%s: Add: %s", test.clientType, err)
+			}
+		}
+		if len(server.torrents) != 2 {
+			t.Errorf("%s: %d torrents added, want 2", test.clientType, len(server.torrents))
+		}
+		if server.logins > 1 {
+			t.Errorf("%s: logged in %d times, want once", test.clientType, server.logins)
+		}
+		if fmt.Sprint(server.options[test.savePath]) != "/data" {
+			t.Errorf("%s: save path %v, want /data", test.clientType, server.options[test.savePath])
+		}
+		if paused := fmt.Sprint(server.options[test.paused]); paused != "true" {
+			t.Errorf("%s: paused %s, want true", test.clientType, paused)
+		}
+	}
+}
+
+func TestClientAddErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		clientType string
+		setup      func(s *fakeClientServer)
+		torrent    []byte
+		err        string
+	}{
+		{"transmission unauthorized", "transmission", func(s *fakeClientServer) { s.status = http.StatusUnauthorized }, nil, "authentication failed"},
+		{"transmission server error", "transmission", func(s *fakeClientServer) { s.status = http.StatusInternalServerError }, nil, "unexpected status"},
+		{"transmission failure result", "transmission", func(s *fakeClientServer) { s.result = "disk full" }, nil, "disk full"},
+		{"transmission corrupt torrent", "transmission", nil, []byte("not a torrent"), "invalid or corrupt torrent file"},
+		{"qbittorrent login failed", "qbittorrent", func(s *fakeClientServer) { s.loginAnswer = "Fails." }, nil, "login failed"},
+		{"qbittorrent forbidden", "qbittorrent", func(s *fakeClientServer) { s.status = http.StatusForbidden }, nil, "access denied"},
+		{"qbittorrent rejected", "qbittorrent", func(s *fakeClientServer) { s.addAnswer = "Fails." }, nil, "rejected the torrent"},
+		{"qbittorrent corrupt torrent", "qbittorrent", nil, []byte("not a torrent"), "rejected the torrent"},
+		{"deluge login failed", "deluge", func(s *fakeClientServer) { s.loginAnswer = "Fails." }, nil, "login failed"},
+		{"deluge no daemon", "deluge", func(s *fakeClientServer) { s.hosts = nil }, nil, "no daemon configured"},
+		{"deluge server error", "deluge", func(s *fakeClientServer) { s.status = http.StatusBadGateway }, nil, "unexpected status"},
+		{"deluge corrupt torrent", "deluge", nil, []byte("not a torrent"), "core.add_torrent_file"},
+	}
+
+	for _, test := range tests {
+		server, ts := newFakeClientServer(t)
+		if test.setup != nil {
+			test.setup(server)
+		}
+		torrent := test.torrent
+		if torrent == nil {
+			torrent = testTorrent(t, 16384, 40000, 3)
+		}
+
+		err := newTestClient(t, test.clientType, ts.URL).Add(torrent, "release.torrent")
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: Add = %v, want an error containing '%s'", test.name, err, test.err)
+		}
+	}
+}
+
+func TestTransmissionSessionHandshake(t *testing.T) {
+	server, ts := newFakeClientServer(t)
+	client := newTestClient(t, "transmission", ts.URL)
+
+	if err := client.Add(testTorrent(t, 16384, 40000, 3), "a.torrent"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Add(testTorrent(t, 16384, 30000, 2), "b.torrent"); err != nil {
+		t.Fatal(err)
+	}
+	// the 409 answer of the first request sets the session id for all later requests
+	if server.requests != 3 {
+		t.Errorf("%d requests, want 3", server.requests)
+	}
+}
+
+func TestSharedClientLogsInOnce(t *testing.T) {
+	server, ts := newFakeClientServer(t)
+	newTestClient(t, "qbittorrent", ts.URL)
+	client, err := newSharedTorrentClient("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrents := make([][]byte, 0, 8)
+	for pieces := 1; pieces <= 8; pieces++ {
+		torrents = append(torrents, testTorrent(t, 16384, int64(pieces)*16384, pieces))
+	}
+
+	var wg sync.WaitGroup
+	for _, torrent := range torrents {
+		wg.Add(1)
+		go func(torrent []byte) {
+			defer wg.Done()
+			if err := client.Add(torrent, "release.torrent"); err != nil {
+				t.Error(err)
+			}
+		}(torrent)
+	}
+	wg.Wait()
+
+	if server.logins != 1 {
+		t.Errorf("logged in %d times, want once", server.logins)
+	}
+	if len(server.torrents) != 8 {
+		t.Errorf("%d torrents added, want 8", len(server.torrents))
+	}
+}
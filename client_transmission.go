@@ -0,0 +1,134 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const transmissionSessionHeader = "X-Transmission-Session-Id"
+
+// Transmission RPC client
+type transmissionClient struct {
+	settings  ClientConfig
+	sessionId string
+}
+
+type transmissionRequest struct {
+	Method    string                 `json:"method"`
+	Arguments map[string]interface{} `json:"arguments"`
+}
+
+type transmissionResponse struct {
+	Result    string                     `json:"result"`
+	Arguments map[string]json.RawMessage `json:"arguments"`
+}
+
+// Get the RPC endpoint, the configured url may omit the path
+func (t *transmissionClient) endpoint() string {
+	url := strings.TrimRight(t.settings.Url, "/")
+	if !strings.HasSuffix(url, "/rpc") {
+		url += "/transmission/rpc"
+	}
+
+	return url
+}
+
+func (t *transmissionClient) call(request transmissionRequest) (*transmissionResponse, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// the first request is answered with 409 and the session id to use
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest("POST", t.endpoint(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if t.sessionId != "" {
+			req.Header.Set(transmissionSessionHeader, t.sessionId)
+		}
+		if t.settings.Username != "" {
+			req.SetBasicAuth(t.settings.Username, t.settings.Password)
+		}
+
+		resp, err := clientHTTP.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusConflict {
+			resp.Body.Close()
+			t.sessionId = resp.Header.Get(transmissionSessionHeader)
+			continue
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			resp.Body.Close()
+			return nil, errors.New("authentication failed")
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+
+		var response transmissionResponse
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if response.Result != "success" {
+			return nil, errors.New(response.Result)
+		}
+
+		return &response, nil
+	}
+
+	return nil, errors.New("no valid session id")
+}
+
+func (t *transmissionClient) Add(torrent []byte, filename string) error {
+	arguments := map[string]interface{}{
+		"metainfo": base64.StdEncoding.EncodeToString(torrent),
+		"paused":   t.settings.Paused,
+	}
+	if t.settings.SavePath != "" {
+		arguments["download-dir"] = t.settings.SavePath
+	}
+	if t.settings.Label != "" {
+		arguments["labels"] = []string{t.settings.Label}
+	}
+
+	response, err := t.call(transmissionRequest{"torrent-add", arguments})
+	if err != nil {
+		return err
+	}
+	if _, ok := response.Arguments["torrent-duplicate"]; ok {
+		PrintVerbose(filename, "is already in transmission")
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Client which watches a directory for new .torrent files
+type watchClient struct {
+	settings ClientConfig
+}
+
+func (w *watchClient) Add(torrent []byte, filename string) error {
+	if w.settings.WatchDir == "" {
+		return errors.New("no WatchDir configured")
+	}
+	if err := os.MkdirAll(w.settings.WatchDir, 0755); err != nil {
+		return err
+	}
+
+	// the atomic write keeps the client from picking up half written files
+	return writeFileAtomic(filepath.Join(w.settings.WatchDir, sanitizeFilename(filename)), torrent, 0644)
+}
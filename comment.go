@@ -27,7 +27,11 @@ import (
 func comment(tid int64, message string) (error) {
 	c := getConnection()
 
-	ok, err := api.CommentWrite(c, tid, message)
+	var ok bool
+	err := withSessionWrite(func() (err error) {
+		ok, err = api.CommentWrite(c, tid, message)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -20,31 +20,69 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
 	api "github.com/fuchsi/irrenhaus-api"
 )
 
 type Configuration struct {
+	DefaultProfile string
+	Profiles       map[string]Profile
+	SessionMaxAge  string `json:",omitempty"`
+	// Go template for the path of downloaded torrents, e.g. {{.Category}}/{{.Id}}-{{.Name}}.torrent
+	NameTemplate string `json:",omitempty"`
+	// BitTorrent clients for download --client, by name
+	Clients map[string]ClientConfig `json:",omitempty"`
+	// limits for uploaded images
+	Images *ImageSettings `json:",omitempty"`
+	// saved searches for the watch command, by name
+	Watches map[string]WatchConfig `json:",omitempty"`
+}
+
+// Account settings of a single profile.
+// Config files written before profiles existed contain exactly these fields on the top level.
+type Profile struct {
 	Username string
-	Password string
-	Pin      string
+	Password string `json:",omitempty"`
+	Pin      string `json:",omitempty"`
 	Url      string
+	// tracker URL for new torrents, defaults to the announce.php of Url
+	Announce string `json:",omitempty"`
 }
 
+// Name of the profile used for config files without profiles
+const legacyProfileName = "default"
+
 // Load the configuration file
+// A config file without profiles is converted into one with a single "default" profile.
 // It returns the parsed configration and any error encountered
 func loadConfig(configFile string) (Configuration, error) {
-	file, err := os.Open(configFile)
-	defer file.Close()
+	content, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		return Configuration{}, err
+		return Configuration{Profiles: make(map[string]Profile)}, err
 	}
-	decoder := json.NewDecoder(file)
 	configuration := Configuration{}
-	err = decoder.Decode(&configuration)
+	err = json.Unmarshal(content, &configuration)
 	if err != nil {
-		return configuration, err
+		return Configuration{Profiles: make(map[string]Profile)}, err
+	}
+	if configuration.Profiles == nil {
+		configuration.Profiles = make(map[string]Profile)
+	}
+
+	if len(configuration.Profiles) == 0 {
+		legacy := Profile{}
+		err = json.Unmarshal(content, &legacy)
+		if err != nil {
+			return configuration, err
+		}
+		if legacy.Username != "" {
+			configuration.Profiles[legacyProfileName] = legacy
+			configuration.DefaultProfile = legacyProfileName
+		}
 	}
 
 	return configuration, nil
@@ -53,51 +91,96 @@ func loadConfig(configFile string) (Configuration, error) {
 // Write the configuration file
 // It returns any error encountered.
 func dumpConfig(config Configuration, configFile string) (error) {
-	file, err := os.Create(configFile)
-	defer file.Close()
+	content, err := json.Marshal(config)
 	if err != nil {
 		return err
 	}
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(config)
+
+	return writeFileAtomic(configFile, append(content, '\n'), 0600)
+}
+
+// Write a file by writing a temporary file next to it and renaming it
+// Readers never see a partially written file.
+// It returns any error encountered.
+func writeFileAtomic(filename string, content []byte, perm os.FileMode) error {
+	file, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(file.Name())
 
-	return nil
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
+}
+
+// Get the path of the cookie jar of the active profile
+// The "default" profile keeps using the cookie jar from before profiles existed.
+func cookieFile() string {
+	if profileName == legacyProfileName {
+		return CONFIGPATH + "cookies.json"
+	}
+
+	return CONFIGPATH + "cookies." + profileName + ".json"
+}
+
+// Cookies of a session and the time they were issued
+type cookieJar struct {
+	Cookies api.Cookies
+	Created time.Time
 }
 
 // Dump the cookies for later reuse
 // It returns any error encountered.
-func dumpCookies(cookies api.Cookies) (error) {
-	file, err := os.Create(CONFIGPATH + "cookies.json")
-	defer file.Close()
-	if err != nil {
-		return err
-	}
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(cookies)
+func dumpCookies(jar cookieJar) (error) {
+	content, err := json.Marshal(jar)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return writeFileAtomic(cookieFile(), append(content, '\n'), 0600)
 }
 
 // Load the cookies
-// It returns the parsed configration and any error encountered
-func loadCookies() (api.Cookies, error) {
-	file, err := os.Open(CONFIGPATH + "cookies.json")
-	defer file.Close()
+// Cookie files without a creation time are dated by their modification time.
+// It returns the cookie jar and any error encountered
+func loadCookies() (cookieJar, error) {
+	content, err := ioutil.ReadFile(cookieFile())
 	if err != nil {
-		return api.Cookies{}, err
+		return cookieJar{}, err
+	}
+
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return cookieJar{}, err
 	}
-	decoder := json.NewDecoder(file)
-	cookies := api.Cookies{}
-	err = decoder.Decode(&cookies)
+
+	jar := cookieJar{}
+	if _, ok := fields["Cookies"]; ok {
+		err = json.Unmarshal(content, &jar)
+		return jar, err
+	}
+
+	err = json.Unmarshal(content, &jar.Cookies)
 	if err != nil {
-		return cookies, err
+		return jar, err
+	}
+	if info, err := os.Stat(cookieFile()); err == nil {
+		jar.Created = info.ModTime()
 	}
 
-	return cookies, nil
+	return jar, nil
 }
@@ -24,17 +24,40 @@ import (
 
 var connection api.Connection
 
+// Cookies the session was started with, to detect if the site issued new ones
+var sessionJar cookieJar
+var sessionStarted bool
+
 func getConnection() (*api.Connection) {
 	return &connection
 }
 
 func newConnection() (*api.Connection) {
-	connection = api.NewConnection(config.Url, config.Username, config.Password, config.Pin)
-	connection.SetUserAgent("irrenhaus-cli " + VERSION)
-	cookies, err := loadCookies()
+	openConnection()
+
+	jar, err := loadCookies()
 	if err == nil {
-		connection.SetCookies(cookies)
+		if sessionStale(jar) {
+			PrintVerbose("Ignoring the stale session from", jar.Created.Format("02.01.2006 15:04:05"))
+		} else {
+			connection.SetCookies(jar.Cookies)
+			sessionJar = jar
+		}
 	}
 
 	return &connection
 }
+
+// Replace the connection with one without cookies, so the next request logs in again
+func relogin() (*api.Connection) {
+	openConnection()
+
+	return &connection
+}
+
+func openConnection() {
+	connection = api.NewConnection(profile.Url, profile.Username, profile.Password, profile.Pin)
+	connection.SetUserAgent("irrenhaus-cli " + VERSION)
+	sessionJar = cookieJar{}
+	sessionStarted = true
+}
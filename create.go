@@ -0,0 +1,375 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// Bounds of the automatic piece size
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	// number of pieces the automatic piece size aims for
+	targetPieceCount = 1500
+)
+
+// A file which goes into a new torrent
+type createFile struct {
+	// path on disk
+	Source string
+	// path elements inside the torrent, empty for single file torrents
+	Path   []string
+	Length int64
+}
+
+// A piece waiting to be hashed
+type pieceJob struct {
+	Index int
+	Data  []byte
+}
+
+// Choose a power of two piece length for the total size
+func autoPieceLength(total int64) int64 {
+	length := int64(minPieceLength)
+	for length < maxPieceLength && total/length > targetPieceCount {
+		length *= 2
+	}
+
+	return length
+}
+
+// Parse a piece size like 512KB or 4MB
+// It returns the piece length and any error encountered.
+func parsePieceLength(size string) (int64, error) {
+	var parsed datasize.ByteSize
+	if err := parsed.UnmarshalText([]byte(size)); err != nil {
+		return 0, fmt.Errorf("invalid piece size '%s'", size)
+	}
+	length := int64(parsed.Bytes())
+	if length < minPieceLength || length > maxPieceLength || length&(length-1) != 0 {
+		return 0, fmt.Errorf("piece size must be a power of two between %s and %s",
+			datasize.ByteSize(minPieceLength).HumanReadable(), datasize.ByteSize(maxPieceLength).HumanReadable())
+	}
+
+	return length, nil
+}
+
+// Get the announce URL of the selected profile, or an empty string without a profile
+func announceURL() string {
+	if *announceOpt != "" {
+		return *announceOpt
+	}
+	if profile.Announce != "" {
+		return profile.Announce
+	}
+	if profile.Url == "" {
+		return ""
+	}
+
+	return strings.TrimRight(profile.Url, "/") + "/announce.php"
+}
+
+// Collect the files of a file or directory in a stable order
+// It returns the files and any error encountered.
+func collectFiles(root string) ([]createFile, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s is not a regular file", root)
+		}
+		return []createFile{{Source: root, Length: info.Size()}}, nil
+	}
+
+	files := make([]createFile, 0)
+	// Walk visits the entries in lexical order, so the same directory always gives the same torrent
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			if !info.IsDir() {
+				PrintVerbose("Skipping", path+", it is not a regular file")
+			}
+			return nil
+		}
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, createFile{
+			Source: path,
+			Path:   strings.Split(filepath.ToSlash(relative), "/"),
+			Length: info.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s contains no files", root)
+	}
+
+	return files, nil
+}
+
+// Hash the files as one continuous stream of pieces, using all CPU cores
+// It returns the concatenated piece hashes and any error encountered.
+func hashPieces(files []createFile, pieceLength int64) ([]byte, error) {
+	var total int64
+	for _, file := range files {
+		total += file.Length
+	}
+	count := int((total + pieceLength - 1) / pieceLength)
+	pieces := make([]byte, count*sha1.Size)
+
+	workers := runtime.NumCPU()
+	jobs := make(chan pieceJob, workers)
+	// recycled piece buffers, which also limit the memory in use
+	buffers := make(chan []byte, workers*2)
+	for i := 0; i < workers*2; i++ {
+		buffers <- make([]byte, pieceLength)
+	}
+
+	var wait sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for job := range jobs {
+				hash := sha1.Sum(job.Data)
+				copy(pieces[job.Index*sha1.Size:], hash[:])
+				buffers <- job.Data[:cap(job.Data)]
+			}
+		}()
+	}
+
+	err := readPieces(files, pieceLength, total, buffers, jobs)
+	close(jobs)
+	wait.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	return pieces, nil
+}
+
+// Read the files into piece buffers and queue them for hashing
+func readPieces(files []createFile, pieceLength int64, total int64, buffers chan []byte, jobs chan<- pieceJob) error {
+	index := 0
+	buffer := <-buffers
+	filled := 0
+	var done int64
+	lastReport := time.Now()
+
+	for _, file := range files {
+		fd, err := os.Open(file.Source)
+		if err != nil {
+			return err
+		}
+		var read int64
+		for {
+			n, err := io.ReadFull(fd, buffer[filled:])
+			filled += n
+			read += int64(n)
+			if filled == len(buffer) {
+				jobs <- pieceJob{index, buffer}
+				index++
+				done += int64(filled)
+				buffer = <-buffers
+				filled = 0
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				fd.Close()
+				return err
+			}
+			if *verboseFlag && time.Since(lastReport) > time.Second {
+				PrintVerbose(fmt.Sprintf("Hashed %d%%", done*100/total))
+				lastReport = time.Now()
+			}
+		}
+		fd.Close()
+		if read != file.Length {
+			return fmt.Errorf("%s changed while hashing", file.Source)
+		}
+	}
+	if filled > 0 {
+		jobs <- pieceJob{index, buffer[:filled]}
+	}
+
+	return nil
+}
+
+// Build a private v1 torrent from a file or directory
+//  path:        File or directory
+//  pieceLength: Piece length, 0 to choose it from the total size
+// It returns the bencoded torrent, its metainfo and any error encountered.
+func makeTorrent(path string, pieceLength int64) ([]byte, *metaInfo, error) {
+	path = filepath.Clean(path)
+	files, err := collectFiles(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var total int64
+	for _, file := range files {
+		total += file.Length
+	}
+	if total == 0 {
+		return nil, nil, errors.New("cannot create a torrent without content")
+	}
+	if pieceLength == 0 {
+		pieceLength = autoPieceLength(total)
+	}
+	announce := announceURL()
+	if announce == "" {
+		return nil, nil, errors.New("no announce URL. Use --announce or set up a profile")
+	}
+
+	name := filepath.Base(path)
+	PrintVerbose(fmt.Sprintf("Hashing %d files, %s in pieces of %s", len(files),
+		datasize.ByteSize(total).HumanReadable(), datasize.ByteSize(pieceLength).HumanReadable()))
+	pieces, err := hashPieces(files, pieceLength)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": pieceLength,
+		"pieces":       pieces,
+		"private":      1,
+	}
+	if len(files) == 1 && files[0].Path == nil {
+		info["length"] = files[0].Length
+	} else {
+		list := make([]interface{}, 0, len(files))
+		for _, file := range files {
+			list = append(list, map[string]interface{}{
+				"length": file.Length,
+				"path":   file.Path,
+			})
+		}
+		info["files"] = list
+	}
+
+	torrent, err := bencode(map[string]interface{}{
+		"announce":      announce,
+		"created by":    "irrenhaus-cli " + VERSION,
+		"creation date": time.Now().Unix(),
+		"info":          info,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// parse the result again, this validates it and gives the info hash
+	meta, err := parseTorrent(torrent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return torrent, meta, nil
+}
+
+// Pick the piece length from --piece-size
+func pieceLengthOption() (int64, error) {
+	if *pieceSizeOpt == "" {
+		return 0, nil
+	}
+
+	return parsePieceLength(*pieceSizeOpt)
+}
+
+// Create a .torrent file
+//  path:        File or directory
+//  destination: Path of the .torrent file, defaults to the name of path with .torrent in the working directory
+// It returns any error encountered.
+func create(path string, destination string) error {
+	pieceLength, err := pieceLengthOption()
+	if err != nil {
+		return err
+	}
+	if destination == "" {
+		destination = sanitizeFilename(filepath.Base(filepath.Clean(path))) + ".torrent"
+	}
+	if _, err := os.Stat(destination); err == nil && !*forceFlag {
+		return fmt.Errorf("%s already exists. Use --force to overwrite it", destination)
+	}
+
+	torrent, meta, err := makeTorrent(path, pieceLength)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(destination, torrent, 0644); err != nil {
+		return err
+	}
+
+	PrintQuiet(fmt.Sprintf("Created %s: %d files, %s, %d pieces of %s, info hash %s", destination, len(meta.Files),
+		datasize.ByteSize(meta.TotalLength()).HumanReadable(), len(meta.Pieces)/sha1.Size,
+		datasize.ByteSize(meta.PieceLength).HumanReadable(), meta.InfoHash))
+
+	return nil
+}
+
+// Create a temporary .torrent file for an upload
+// The caller removes the file after the upload.
+// It returns the path of the .torrent file and any error encountered.
+func createForUpload(path string) (string, error) {
+	pieceLength, err := pieceLengthOption()
+	if err != nil {
+		return "", err
+	}
+	torrent, meta, err := makeTorrent(path, pieceLength)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := ioutil.TempFile("", "irrenhaus-*.torrent")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.Write(torrent); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	PrintVerbose("Created torrent", meta.InfoHash, "for", path)
+
+	return file.Name(), nil
+}
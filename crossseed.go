@@ -0,0 +1,350 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	api "github.com/fuchsi/irrenhaus-api"
+)
+
+// Thresholds of the cross-seed finder
+const (
+	// share of files with equal name and size of a partial match
+	crossseedPartial = 0.5
+	// most candidates per release whose file lists are fetched
+	maxCrossseedCandidates = 5
+)
+
+// Matches of the cross-seed finder
+const (
+	// every file of the torrent is on disk with the same path and size, under the same name
+	CrossseedExact = "exact"
+	// the same files, but the local file or directory has another name than the torrent
+	CrossseedRename  = "rename"
+	CrossseedPartial = "partial"
+)
+
+// Order of the matches in the results
+var crossseedMatchRank = map[string]int{CrossseedExact: 0, CrossseedRename: 1, CrossseedPartial: 2}
+
+type crossseedRecord struct {
+	Path    string  `json:"path"`
+	Id      int64   `json:"id"`
+	Name    string  `json:"name"`
+	Size    uint64  `json:"size"`
+	FileSim float64 `json:"file_similarity"`
+	Match   string  `json:"match"`
+	// name of the file or directory in the torrent, if it differs from the local one
+	Rename string `json:"rename,omitempty"`
+
+	// search result of the torrent, for downloads
+	entry api.Entry
+}
+
+// Find the releases in a directory, every file or directory in it is one release
+// Hidden files and torrent files are skipped.
+// It returns the paths of the releases and any error encountered.
+func crossseedReleases(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	releases := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || strings.HasSuffix(strings.ToLower(name), ".torrent") {
+			continue
+		}
+		if !entry.IsDir() && !entry.Mode().IsRegular() {
+			continue
+		}
+		releases = append(releases, filepath.Join(dir, name))
+	}
+
+	return releases, nil
+}
+
+// Split a slash separated torrent path into the root name and the rest
+func splitTorrentRoot(p string) (string, string) {
+	if i := strings.Index(p, "/"); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+
+	return p, ""
+}
+
+// Compare the local files with the files of a torrent by their full path and size
+// It returns CrossseedExact if the paths and the root name match, CrossseedRename if only
+// the root name differs, and CrossseedPartial otherwise.
+func crossseedMatch(local []metaFile, meta *metaInfo) string {
+	if len(local) != len(meta.Files) {
+		return CrossseedPartial
+	}
+
+	type key struct {
+		path string
+		size int64
+	}
+	files := make(map[key]int, len(local))
+	root := ""
+	for _, file := range local {
+		var rest string
+		root, rest = splitTorrentRoot(file.Path)
+		files[key{rest, file.Length}]++
+	}
+	for _, file := range meta.Files {
+		_, rest := splitTorrentRoot(file.Path)
+		k := key{rest, file.Length}
+		if files[k] == 0 {
+			return CrossseedPartial
+		}
+		files[k]--
+	}
+
+	if root != meta.Name {
+		return CrossseedRename
+	}
+
+	return CrossseedExact
+}
+
+// Compare the local files with the file list of a torrent on the site
+// A single file is compared by its size only, because a renamed file is still the same data.
+// It returns the share of equal files between 0 and 1.
+func crossseedFileSimilarity(local []metaFile, remote []api.File) float64 {
+	if len(local) == 1 && len(remote) == 1 && local[0].Length == int64(remote[0].Size) {
+		return 1
+	}
+
+	return fileSimilarity(local, remote)
+}
+
+// Rate a candidate by its file list, the torrent is only fetched if all files match
+//  record: Candidate, FileSim, Match and Rename are set
+//  files:  File list of the candidate on the site
+//  fetch:  Downloads the torrent of the candidate
+// It returns whether the candidate is at least a partial match and any error encountered.
+func rateCrossseedCandidate(release *localRelease, record *crossseedRecord, files []api.File, fetch func() (*metaInfo, error)) (bool, error) {
+	record.FileSim = crossseedFileSimilarity(release.Files, files)
+	if record.FileSim < crossseedPartial {
+		return false, nil
+	}
+	record.Match = CrossseedPartial
+	// the file list of the site has no directories, only the torrent has the full paths
+	if record.FileSim == 1 {
+		meta, err := fetch()
+		if err != nil {
+			return false, err
+		}
+		record.Match = crossseedMatch(release.Files, meta)
+		if record.Match == CrossseedRename {
+			record.Rename = meta.Name
+		}
+	}
+
+	return true, nil
+}
+
+// Find the torrents on the site which contain a local release
+//  path:       Release file or directory
+//  categories: Categories to search, all of them if empty
+//  wait:       Rate limiter of the requests
+// It returns the matches, the exact ones first, and any error encountered.
+func crossseedRelease(path string, categories []int, wait func()) ([]crossseedRecord, error) {
+	release, err := scanLocalRelease(path, "")
+	if err != nil {
+		return nil, err
+	}
+
+	candidates, err := searchDupes(release, categories, wait)
+	if err != nil {
+		return nil, err
+	}
+
+	// torrents of the same size are the most promising, then the most similar names
+	normalized := normalizeReleaseName(release.Name)
+	type candidate struct {
+		entry    api.Entry
+		nameSim  float64
+		sameSize bool
+	}
+	ranked := make([]candidate, 0, len(candidates))
+	for _, entry := range candidates {
+		c := candidate{entry, nameSimilarity(normalized, normalizeReleaseName(entry.Name)), similarSize(release.Size, int64(entry.Size))}
+		if c.sameSize || c.nameSim >= dupeNamePossible {
+			ranked = append(ranked, c)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if ranked[i].sameSize != ranked[j].sameSize {
+			return ranked[i].sameSize
+		}
+		return ranked[i].nameSim > ranked[j].nameSim
+	})
+	if len(ranked) > maxCrossseedCandidates {
+		ranked = ranked[:maxCrossseedCandidates]
+	}
+
+	c := getConnection()
+	records := make([]crossseedRecord, 0)
+	for _, candidate := range ranked {
+		wait()
+		var details api.Entry
+		err := withSession(func() (err error) {
+			details, err = api.Details(c, candidate.entry.Id, true, false, false)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		record := crossseedRecord{
+			Path:  path,
+			Id:    candidate.entry.Id,
+			Name:  candidate.entry.Name,
+			Size:  candidate.entry.Size,
+			entry: candidate.entry,
+		}
+		id := candidate.entry.Id
+		ok, err := rateCrossseedCandidate(release, &record, details.Files, func() (*metaInfo, error) {
+			body, _, err := fetchTorrentData(id, wait)
+			if err != nil {
+				return nil, err
+			}
+			meta, err := parseTorrent(body)
+			if err != nil {
+				return nil, fmt.Errorf("torrent %d: %s", id, err.Error())
+			}
+			return meta, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			records = append(records, record)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Match != records[j].Match {
+			return crossseedMatchRank[records[i].Match] < crossseedMatchRank[records[j].Match]
+		}
+		return records[i].FileSim > records[j].FileSim
+	})
+
+	return records, nil
+}
+
+// Find torrents on the site for the releases in a directory and download the selected ones with --download
+//  dir:        Directory of releases
+//  categories: Categories to search, all of them if empty
+// It returns any error encountered.
+func crossseed(dir string, categories []int) error {
+	releases, err := crossseedReleases(dir)
+	if err != nil {
+		return err
+	}
+	if len(releases) == 0 {
+		return fmt.Errorf("%s contains no releases", dir)
+	}
+
+	wait, stop := newRequestLimiter()
+	defer stop()
+
+	records := make([]crossseedRecord, 0)
+	failed := 0
+	for i, release := range releases {
+		PrintVerbose(fmt.Sprintf("[%d/%d] %s", i+1, len(releases), filepath.Base(release)))
+		found, err := crossseedRelease(release, categories, wait)
+		if err != nil {
+			// unreadable releases must not stop the scan
+			fmt.Fprintf(os.Stderr, "%s: %s\n", release, err.Error())
+			failed++
+			continue
+		}
+		records = append(records, found...)
+	}
+
+	exact, renamed := 0, 0
+	header := []string{"Local", "ID", "Name", "Size", "Files", "Match"}
+	// row numbers are needed to pick the torrents to download
+	if *downloadFlag {
+		header = append([]string{"#"}, header...)
+	}
+	rows := make([][]string, 0, len(records))
+	for i, record := range records {
+		match := record.Match
+		switch record.Match {
+		case CrossseedExact:
+			exact++
+		case CrossseedRename:
+			renamed++
+			match = "rename to " + record.Rename
+		}
+		row := []string{
+			filepath.Base(record.Path),
+			fmt.Sprintf("%d", record.Id),
+			record.Name,
+			datasize.ByteSize(record.Size).HumanReadable(),
+			fmt.Sprintf("%.0f%%", record.FileSim*100),
+			match,
+		}
+		if *downloadFlag {
+			row = append([]string{fmt.Sprintf("%d", i+1)}, row...)
+		}
+		rows = append(rows, row)
+	}
+
+	err = Render(Output{
+		Data: records,
+		Sections: []Section{{
+			Title: fmt.Sprintf("Found %d exact, %d renamed and %d partial matches for %d releases",
+				exact, renamed, len(records)-exact-renamed, len(releases)-failed),
+			Header:  header,
+			Rows:    rows,
+			Records: records,
+			Text: "Renamed matches need the local file or directory renamed to the name in the torrent.\n" +
+				"Partial matches miss some files or contain other files, the client has to download the difference",
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if *downloadFlag && len(records) > 0 {
+		entries := make([]api.Entry, 0, len(records))
+		for _, record := range records {
+			entries = append(entries, record.entry)
+		}
+		if err := searchDownload(entries, *selectOpt, *destOpt); err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d releases could not be searched", failed, len(releases))
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"testing"
+
+	api "github.com/fuchsi/irrenhaus-api"
+)
+
+func TestCrossseedMatch(t *testing.T) {
+	local := []metaFile{{"Movie.2018/movie.mkv", 1000}, {"Movie.2018/Subs/eng.srt", 10}}
+
+	tests := []struct {
+		name  string
+		local []metaFile
+		meta  metaInfo
+		match string
+	}{
+		{"same paths", local,
+			metaInfo{Name: "Movie.2018", Files: []metaFile{{"Movie.2018/Subs/eng.srt", 10}, {"Movie.2018/movie.mkv", 1000}}}, CrossseedExact},
+		{"other root name", local,
+			metaInfo{Name: "Movie.2018.GRP", Files: []metaFile{{"Movie.2018.GRP/movie.mkv", 1000}, {"Movie.2018.GRP/Subs/eng.srt", 10}}}, CrossseedRename},
+		{"other directory", local,
+			metaInfo{Name: "Movie.2018", Files: []metaFile{{"Movie.2018/movie.mkv", 1000}, {"Movie.2018/eng.srt", 10}}}, CrossseedPartial},
+		{"other size", local,
+			metaInfo{Name: "Movie.2018", Files: []metaFile{{"Movie.2018/movie.mkv", 1001}, {"Movie.2018/Subs/eng.srt", 10}}}, CrossseedPartial},
+		{"missing file", local,
+			metaInfo{Name: "Movie.2018", Files: []metaFile{{"Movie.2018/movie.mkv", 1000}}}, CrossseedPartial},
+		{"single file", []metaFile{{"movie.mkv", 1000}},
+			metaInfo{Name: "movie.mkv", Files: []metaFile{{"movie.mkv", 1000}}}, CrossseedExact},
+		{"renamed single file", []metaFile{{"movie.mkv", 1000}},
+			metaInfo{Name: "Movie.2018.mkv", Files: []metaFile{{"Movie.2018.mkv", 1000}}}, CrossseedRename},
+		{"single file in a directory", []metaFile{{"movie.mkv", 1000}},
+			metaInfo{Name: "Movie", MultiFile: true, Files: []metaFile{{"Movie/movie.mkv", 1000}}}, CrossseedPartial},
+	}
+
+	for _, test := range tests {
+		if match := crossseedMatch(test.local, &test.meta); match != test.match {
+			t.Errorf("%s: crossseedMatch = %s, want %s", test.name, match, test.match)
+		}
+	}
+}
+
+func TestRateCrossseedCandidate(t *testing.T) {
+	movie := &localRelease{Name: "movie.mkv", Size: 1000, Files: []metaFile{{"movie.mkv", 1000}}}
+	dir := &localRelease{Name: "Movie.2018", Size: 1010,
+		Files: []metaFile{{"Movie.2018/movie.mkv", 1000}, {"Movie.2018/Subs/eng.srt", 10}}}
+
+	tests := []struct {
+		name    string
+		release *localRelease
+		files   []api.File
+		meta    *metaInfo
+		ok      bool
+		match   string
+		rename  string
+	}{
+		// the site lists the file under another name, it is the same data
+		{"renamed single file", movie, []api.File{{Name: "Movie.2018.mkv", Size: 1000}},
+			&metaInfo{Name: "Movie.2018.mkv", Files: []metaFile{{"Movie.2018.mkv", 1000}}}, true, CrossseedRename, "Movie.2018.mkv"},
+		{"single file", movie, []api.File{{Name: "movie.mkv", Size: 1000}},
+			&metaInfo{Name: "movie.mkv", Files: []metaFile{{"movie.mkv", 1000}}}, true, CrossseedExact, ""},
+		{"single file of another size", movie, []api.File{{Name: "movie.mkv", Size: 999}}, nil, false, "", ""},
+		{"renamed directory", dir, []api.File{{Name: "movie.mkv", Size: 1000}, {Name: "eng.srt", Size: 10}},
+			&metaInfo{Name: "Movie.2018.GRP", MultiFile: true,
+				Files: []metaFile{{"Movie.2018.GRP/movie.mkv", 1000}, {"Movie.2018.GRP/Subs/eng.srt", 10}}}, true, CrossseedRename, "Movie.2018.GRP"},
+		// partial matches are decided by the file list, without the torrent
+		{"partial", dir, []api.File{{Name: "movie.mkv", Size: 1000}}, nil, true, CrossseedPartial, ""},
+		{"renamed files in a directory", dir, []api.File{{Name: "a.mkv", Size: 1000}, {Name: "b.srt", Size: 10}}, nil, false, "", ""},
+	}
+
+	for _, test := range tests {
+		record := crossseedRecord{Name: test.name}
+		fetch := func() (*metaInfo, error) {
+			if test.meta == nil {
+				t.Fatalf("%s: the torrent was fetched", test.name)
+			}
+			return test.meta, nil
+		}
+		ok, err := rateCrossseedCandidate(test.release, &record, test.files, fetch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.ok || record.Match != test.match || record.Rename != test.rename {
+			t.Errorf("%s: rateCrossseedCandidate = %v, %q, %q, want %v, %q, %q",
+				test.name, ok, record.Match, record.Rename, test.ok, test.match, test.rename)
+		}
+	}
+}
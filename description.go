@@ -0,0 +1,231 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/fuchsi/irrenhaus-api/Category"
+	"github.com/pborman/getopt/v2"
+	"golang.org/x/term"
+)
+
+// Values available in description templates, e.g. {{.Name}}, {{.Size | human}} or {{.Vars.source}}
+type descriptionData struct {
+	Name      string
+	Size      int64
+	FileCount int
+	Files     []metaFile
+	Category  string
+	// key/value pairs from --var and the vars of manifests
+	Vars map[string]string
+
+	// file or directory the torrent is created from
+	source string
+}
+
+// Get BBCode tables of the media files in the upload path, e.g. {{.MediaInfo}}
+// It returns the BBCode and any error encountered.
+func (d *descriptionData) MediaInfo() (string, error) {
+	if d.source == "" {
+		return "", errors.New(`.MediaInfo needs an upload from a path, use {{mediainfo "file"}} for torrent files`)
+	}
+	infos, err := collectMediaInfo(d.source)
+	if err != nil {
+		return "", err
+	}
+
+	return mediaInfoBBCode(infos), nil
+}
+
+// Key/value pairs from repeated --var key=value options
+type templateVars map[string]string
+
+func (v templateVars) Set(value string, opt getopt.Option) error {
+	if value == "" {
+		return nil
+	}
+	i := strings.Index(value, "=")
+	if i < 1 {
+		return fmt.Errorf("--var needs key=value, not '%s'", value)
+	}
+	v[value[:i]] = value[i+1:]
+
+	return nil
+}
+
+func (v templateVars) String() string {
+	pairs := make([]string, 0, len(v))
+	for key, value := range v {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+var descriptionVars = templateVars{}
+
+func descriptionUsage() {
+	fmt.Println("description subcommand")
+
+	fmt.Println("\trender [-n name] [-c category] [--var key=value]... <description> [torrent|path]")
+	fmt.Println("\t\tPrint the BBCode which is uploaded for a description")
+
+	fmt.Println("\tpreview [-n name] [-c category] [--var key=value]... <description> [torrent|path]")
+	fmt.Println("\t\tShow the description formatted for the terminal")
+
+	fmt.Println("\tDescriptions ending in .tmpl are Go templates with the fields")
+	fmt.Println("\t.Name, .Size, .FileCount, .Files (.Path, .Length), .Category, .Vars.<key> and .MediaInfo,")
+	fmt.Println("\tthe variables come from the torrent or path and from --var.")
+	fmt.Println("\t{{mediainfo \"file\"}} inserts the media info of a file or directory.")
+	fmt.Println("\tDescriptions ending in .md or .md.tmpl are converted from Markdown to BBCode.")
+}
+
+// Render a description file to BBCode
+// Files ending in .tmpl are executed as templates first, files ending in .md are converted from Markdown.
+//  path: Description file
+//  m:    Upload the description belongs to, for the template variables
+// It returns the BBCode and any error encountered.
+func renderDescription(path string, m *uploadManifest) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	text := string(content)
+	name := strings.ToLower(path)
+
+	if strings.HasSuffix(name, ".tmpl") {
+		name = strings.TrimSuffix(name, ".tmpl")
+		// paths given to mediainfo are relative to the description, like the paths in manifests
+		mediainfoFunc := func(media string) (string, error) {
+			if !filepath.IsAbs(media) {
+				media = filepath.Join(filepath.Dir(path), media)
+			}
+			infos, err := collectMediaInfo(media)
+			if err != nil {
+				return "", err
+			}
+			return mediaInfoBBCode(infos), nil
+		}
+		tmpl, err := template.New(filepath.Base(path)).Funcs(TemplateFuncs).
+			Funcs(template.FuncMap{"mediainfo": mediainfoFunc}).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return "", err
+		}
+		data, err := newDescriptionData(m)
+		if err != nil {
+			return "", err
+		}
+		var buffer bytes.Buffer
+		if err := tmpl.Execute(&buffer, data); err != nil {
+			return "", err
+		}
+		text = buffer.String()
+	}
+
+	if ext := filepath.Ext(name); ext == ".md" || ext == ".markdown" {
+		text = markdownToBBCode(text)
+	}
+
+	return text, nil
+}
+
+// Collect the template variables of an upload
+// It returns the variables and any error encountered.
+func newDescriptionData(m *uploadManifest) (*descriptionData, error) {
+	data := &descriptionData{Name: m.Name, Vars: make(map[string]string), source: m.From}
+	for key, value := range m.Vars {
+		data.Vars[key] = value
+	}
+	for key, value := range descriptionVars {
+		data.Vars[key] = value
+	}
+	if name, err := Category.ToString(m.categoryId); err == nil && m.categoryId != 0 {
+		data.Category = name
+	}
+
+	if m.Torrent != "" || m.From != "" {
+		release, err := loadLocalRelease(m)
+		if err != nil {
+			return nil, err
+		}
+		data.Size = release.Size
+		data.Files = release.Files
+		data.FileCount = len(release.Files)
+	}
+
+	return data, nil
+}
+
+// Render or preview a description
+//  preview: Format the BBCode for the terminal instead of printing it
+//  args:    Description file and an optional torrent or path for the variables
+// It returns any error encountered.
+func descriptionShow(preview bool, args []string) error {
+	if len(args) < 1 {
+		return errors.New("missing description")
+	}
+
+	m := &uploadManifest{Name: *nameOpt}
+	if len(args) > 1 {
+		if strings.HasSuffix(strings.ToLower(args[1]), ".torrent") {
+			m.Torrent = args[1]
+		} else {
+			m.From = args[1]
+		}
+	}
+	if m.Name == "" {
+		if m.From != "" {
+			m.Name = filepath.Base(filepath.Clean(m.From))
+		} else if m.Torrent != "" {
+			meta, err := loadTorrent(m.Torrent)
+			if err != nil {
+				return err
+			}
+			m.Name = meta.Name
+		}
+	}
+	if len(*categoryOpt) > 0 {
+		category, err := resolveSingleCategory(*categoryOpt)
+		if err != nil {
+			return err
+		}
+		m.categoryId = category
+	}
+
+	text, err := renderDescription(args[0], m)
+	if err != nil {
+		return err
+	}
+	if preview {
+		text = bbcodeToANSI(text, term.IsTerminal(int(os.Stdout.Fd())))
+	}
+	fmt.Println(strings.TrimRight(text, "\n"))
+
+	return nil
+}
@@ -0,0 +1,318 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/fuchsi/irrenhaus-api"
+)
+
+// Largest ID range accepted on the command line, to catch typos like 1200-12500
+const maxDownloadRange = 1000
+
+var tidPattern = regexp.MustCompile(`^(\d+)(?:-(\d+))?$`)
+
+type downloadResult struct {
+	Id     int64  `json:"id"`
+	Path   string `json:"path,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Check if an argument is a Torrent-ID or a range of Torrent-IDs
+func isTidArg(arg string) bool {
+	return tidPattern.MatchString(arg)
+}
+
+// Parse a Torrent-ID or a range of Torrent-IDs like 1200-1250
+// It returns the Torrent-IDs and any error encountered.
+func parseTidArg(arg string) ([]int64, error) {
+	match := tidPattern.FindStringSubmatch(strings.TrimSpace(arg))
+	if match == nil {
+		return nil, fmt.Errorf("'%s' is not a valid ID or range", arg)
+	}
+
+	first, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if match[2] == "" {
+		return []int64{first}, nil
+	}
+
+	last, err := strconv.ParseInt(match[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if last < first {
+		return nil, fmt.Errorf("invalid range '%s'", arg)
+	}
+	if last-first >= maxDownloadRange {
+		return nil, fmt.Errorf("range '%s' is larger than %d IDs", arg, maxDownloadRange)
+	}
+
+	tids := make([]int64, 0, last-first+1)
+	for tid := first; tid <= last; tid++ {
+		tids = append(tids, tid)
+	}
+
+	return tids, nil
+}
+
+// Parse a selection of row numbers like 1,3,5-8 or all
+//  selection: Selection from the user
+//  max:       Number of rows
+// It returns the selected row numbers, starting at 1, and any error encountered.
+func parseSelection(selection string, max int) ([]int, error) {
+	rows := make([]int, 0)
+	selection = strings.TrimSpace(selection)
+	if strings.ToLower(selection) == "all" {
+		for i := 1; i <= max; i++ {
+			rows = append(rows, i)
+		}
+		return rows, nil
+	}
+
+	for _, part := range strings.Split(selection, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		match := tidPattern.FindStringSubmatch(part)
+		if match == nil {
+			return nil, fmt.Errorf("'%s' is not a row number or range", part)
+		}
+		first, _ := strconv.Atoi(match[1])
+		last := first
+		if match[2] != "" {
+			last, _ = strconv.Atoi(match[2])
+		}
+		if first < 1 || last > max || last < first {
+			return nil, fmt.Errorf("'%s' is out of range 1-%d", part, max)
+		}
+		for i := first; i <= last; i++ {
+			rows = append(rows, i)
+		}
+	}
+
+	return rows, nil
+}
+
+// Download a selection of search results
+// Without a selection, the user is asked for one.
+//  entries:     Search results, in the order shown to the user
+//  selection:   Row numbers like 1,3,5-8 or all
+//  destination: Directory for the torrent files
+// It returns any error encountered.
+func searchDownload(entries []api.Entry, selection string, destination string) error {
+	if selection == "" {
+		if machineOutput() {
+			return errors.New("--select is required with a machine readable output format")
+		}
+		if err := Ask("Download (e.g. 1,3,5-8 or all, empty to cancel)", &selection); err != nil {
+			return err
+		}
+		if strings.TrimSpace(selection) == "" {
+			return nil
+		}
+	}
+
+	rows, err := parseSelection(selection, len(entries))
+	if err != nil {
+		return err
+	}
+
+	tids := make([]int64, 0, len(rows))
+	for _, row := range rows {
+		tids = append(tids, entries[row-1].Id)
+	}
+
+	if len(tids) == 1 {
+		return download(tids[0], destination)
+	}
+
+	return downloadBatch(tids, destination)
+}
+
+// Read Torrent-IDs and ranges, one per line. Empty lines and lines starting with # are ignored.
+//  filename: File to read, - for stdin
+// It returns the Torrent-IDs and any error encountered.
+func readTidFile(filename string) ([]int64, error) {
+	var reader io.Reader = os.Stdin
+	if filename != "-" {
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	tids := make([]int64, 0)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// allow pasting the first column of other tools, e.g. "1234 Some.Name"
+		line = strings.Fields(line)[0]
+		parsed, err := parseTidArg(line)
+		if err != nil {
+			return nil, err
+		}
+		tids = append(tids, parsed...)
+	}
+
+	return tids, scanner.Err()
+}
+
+// Limit the requests to --rate per second
+// It returns a function which blocks until the next request may be sent, safe for concurrent use,
+// and a function which releases the limiter.
+func newRequestLimiter() (func(), func()) {
+	if *rateOpt <= 0 {
+		return func() {}, func() {}
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(*rateOpt))
+	wait := func() {
+		<-ticker.C
+	}
+
+	return wait, ticker.Stop
+}
+
+// Download many torrents with a bounded number of workers
+//  tids:        Torrent-IDs, duplicates are downloaded once
+//  destination: Directory for the torrent files
+// It returns an error listing the failed IDs.
+func downloadBatch(tids []int64, destination string) error {
+	seen := make(map[int64]bool)
+	unique := make([]int64, 0, len(tids))
+	for _, tid := range tids {
+		if !seen[tid] {
+			seen[tid] = true
+			unique = append(unique, tid)
+		}
+	}
+
+	jobs := *jobsOpt
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	// one client for the whole batch, so it logs in only once
+	var client torrentClient
+	if *clientOpt != "" {
+		var err error
+		client, err = newSharedTorrentClient(*clientOpt)
+		if err != nil {
+			return err
+		}
+	}
+
+	// one token per request to the site, shared by all workers
+	wait, stop := newRequestLimiter()
+	defer stop()
+
+	queue := make(chan int64)
+	results := make(chan downloadResult)
+	var workers sync.WaitGroup
+	for i := 0; i < jobs; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for tid := range queue {
+				result := downloadResult{Id: tid, Status: "ok"}
+				path, err := fetchTorrent(tid, destination, *forceFlag, wait)
+				result.Path = path
+				if err == ErrExists {
+					result.Status = "skipped"
+				} else if err != nil {
+					result.Status = "failed"
+					result.Error = err.Error()
+				} else if *clientOpt != "" {
+					if err := sendToClient(client, *clientOpt, path); err != nil {
+						result.Status = "failed"
+						result.Error = err.Error()
+					}
+				}
+				results <- result
+			}
+		}()
+	}
+	go func() {
+		for _, tid := range unique {
+			queue <- tid
+		}
+		close(queue)
+		workers.Wait()
+		close(results)
+	}()
+
+	all := make([]downloadResult, 0, len(unique))
+	skipped := 0
+	for result := range results {
+		all = append(all, result)
+		progress := fmt.Sprintf("[%d/%d]", len(all), len(unique))
+		switch result.Status {
+		case "ok":
+			PrintQuiet(progress, result.Id, "->", result.Path)
+		case "skipped":
+			skipped++
+			PrintQuiet(progress, result.Id, "skipped,", result.Path, "exists")
+		default:
+			fmt.Fprintln(os.Stderr, progress, result.Id, "failed:", result.Error)
+		}
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Id < all[j].Id
+	})
+	failed := make([]string, 0)
+	for _, result := range all {
+		if result.Status == "failed" {
+			failed = append(failed, strconv.FormatInt(result.Id, 10))
+		}
+	}
+	if *outputOpt != OutputTable {
+		if err := Render(Output{Data: all}); err != nil {
+			return err
+		}
+	}
+
+	PrintQuiet(fmt.Sprintf("%d downloaded, %d skipped, %d failed", len(all)-skipped-len(failed), skipped, len(failed)))
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to download: %s", strings.Join(failed, ","))
+	}
+
+	return nil
+}
@@ -0,0 +1,336 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	api "github.com/fuchsi/irrenhaus-api"
+)
+
+// Thresholds of the duplicate detection
+const (
+	// share of equal name tokens
+	dupeNameLikely   = 0.8
+	dupeNamePossible = 0.5
+	// relative size difference
+	dupeSizeTolerance = 0.01
+	// share of files with equal name and size
+	dupeFilesLikely = 0.9
+	// most candidates whose file lists are fetched
+	maxDupeCandidates = 10
+)
+
+// Verdicts of the duplicate detection
+const (
+	DupeLikely   = "likely"
+	DupePossible = "possible"
+)
+
+var releaseSeparatorPattern = regexp.MustCompile(`[\s._\-()\[\]]+`)
+
+// Name, size and files of a release which is about to be uploaded
+type localRelease struct {
+	Name  string
+	Size  int64
+	Files []metaFile
+}
+
+type dupeRecord struct {
+	Id      int64   `json:"id"`
+	Name    string  `json:"name"`
+	Size    uint64  `json:"size"`
+	NameSim float64 `json:"name_similarity"`
+	FileSim float64 `json:"file_similarity"`
+	Verdict string  `json:"verdict"`
+}
+
+// Normalize a release name for searching and comparing, e.g. "Some.Movie.2018-GRP" becomes "some movie 2018 grp"
+func normalizeReleaseName(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".torrent")
+
+	return strings.TrimSpace(releaseSeparatorPattern.ReplaceAllString(name, " "))
+}
+
+// Compare the tokens of two normalized names
+// It returns the share of equal tokens between 0 and 1.
+func nameSimilarity(a string, b string) float64 {
+	tokensA := strings.Fields(a)
+	tokensB := strings.Fields(b)
+	if len(tokensA) == 0 || len(tokensB) == 0 {
+		return 0
+	}
+
+	set := make(map[string]bool, len(tokensA))
+	for _, token := range tokensA {
+		set[token] = true
+	}
+	union := len(set)
+	common := 0
+	seen := make(map[string]bool, len(tokensB))
+	for _, token := range tokensB {
+		if seen[token] {
+			continue
+		}
+		seen[token] = true
+		if set[token] {
+			common++
+		} else {
+			union++
+		}
+	}
+
+	return float64(common) / float64(union)
+}
+
+// Check if two sizes differ by less than the tolerance
+func similarSize(a int64, b int64) bool {
+	if a <= 0 || b <= 0 {
+		return false
+	}
+	diff := a - b
+	if diff < 0 {
+		diff = -diff
+	}
+	larger := a
+	if b > a {
+		larger = b
+	}
+
+	return float64(diff)/float64(larger) <= dupeSizeTolerance
+}
+
+// Compare the local files with the files of a torrent on the site by base name and size
+// It returns the share of equal files between 0 and 1.
+func fileSimilarity(local []metaFile, remote []api.File) float64 {
+	if len(local) == 0 || len(remote) == 0 {
+		return 0
+	}
+
+	type key struct {
+		name string
+		size int64
+	}
+	files := make(map[key]int, len(local))
+	for _, file := range local {
+		files[key{strings.ToLower(path.Base(file.Path)), file.Length}]++
+	}
+	common := 0
+	for _, file := range remote {
+		k := key{strings.ToLower(path.Base(file.Name)), int64(file.Size)}
+		if files[k] > 0 {
+			files[k]--
+			common++
+		}
+	}
+
+	larger := len(local)
+	if len(remote) > larger {
+		larger = len(remote)
+	}
+
+	return float64(common) / float64(larger)
+}
+
+// Get the name, size and files of a file or directory without hashing anything
+//  root: Release file or directory
+//  name: Name of the release, defaults to the base name of root
+// It returns the release and any error encountered.
+func scanLocalRelease(root string, name string) (*localRelease, error) {
+	base := path.Base(strings.TrimSuffix(filepath.ToSlash(root), "/"))
+	if name == "" {
+		name = base
+	}
+	release := &localRelease{Name: name}
+	files, err := collectFiles(root)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		release.Files = append(release.Files, metaFile{path.Join(append([]string{base}, file.Path...)...), file.Length})
+		release.Size += file.Length
+	}
+
+	return release, nil
+}
+
+// Get the name, size and files of an upload without hashing anything
+// It returns the release and any error encountered.
+func loadLocalRelease(m *uploadManifest) (*localRelease, error) {
+	if m.From != "" {
+		return scanLocalRelease(m.From, m.Name)
+	}
+
+	meta, err := loadTorrent(m.Torrent)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localRelease{Name: m.Name, Files: meta.Files, Size: meta.TotalLength()}, nil
+}
+
+// Search the categories for the release
+//  wait: Called before every request to the site, see newRequestLimiter
+// It returns the candidates, ordered by the search results, and any error encountered.
+func searchDupes(release *localRelease, categories []int, wait func()) ([]api.Entry, error) {
+	normalized := normalizeReleaseName(release.Name)
+	needles := []string{normalized}
+	// the title and year usually survive different tags and groups
+	if tokens := strings.Fields(normalized); len(tokens) > 3 {
+		needles = append(needles, strings.Join(tokens[:3], " "))
+	}
+
+	c := getConnection()
+	seen := make(map[int64]bool)
+	candidates := make([]api.Entry, 0)
+	for _, needle := range needles {
+		PrintVerbose("Searching for duplicates of", needle)
+		var entries []api.Entry
+		err := withSession(func() (err error) {
+			wait()
+			entries, err = api.Search(c, needle, categories, true)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !seen[entry.Id] {
+				seen[entry.Id] = true
+				candidates = append(candidates, entry)
+			}
+		}
+	}
+
+	return candidates, nil
+}
+
+// Rate the candidates, fetching the file lists of the closest ones
+// It returns the likely and possible duplicates and any error encountered.
+func findDupes(release *localRelease, candidates []api.Entry) ([]dupeRecord, error) {
+	normalized := normalizeReleaseName(release.Name)
+	dupes := make([]dupeRecord, 0)
+	fetched := 0
+	c := getConnection()
+
+	for _, entry := range candidates {
+		record := dupeRecord{
+			Id:      entry.Id,
+			Name:    entry.Name,
+			Size:    entry.Size,
+			NameSim: nameSimilarity(normalized, normalizeReleaseName(entry.Name)),
+		}
+		sameSize := similarSize(release.Size, int64(entry.Size))
+		if record.NameSim < dupeNamePossible && !sameSize {
+			continue
+		}
+
+		if fetched < maxDupeCandidates {
+			fetched++
+			var details api.Entry
+			err := withSession(func() (err error) {
+				details, err = api.Details(c, entry.Id, true, false, false)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			record.FileSim = fileSimilarity(release.Files, details.Files)
+		}
+
+		switch {
+		case record.FileSim >= dupeFilesLikely, record.NameSim >= dupeNameLikely && sameSize, record.NameSim == 1:
+			record.Verdict = DupeLikely
+		case record.NameSim >= dupeNamePossible, sameSize:
+			record.Verdict = DupePossible
+		default:
+			continue
+		}
+		dupes = append(dupes, record)
+	}
+
+	return dupes, nil
+}
+
+// Look for the release on the site before uploading it
+// Likely duplicates abort the upload unless --allow-dupe is set, possible ones only print a warning.
+// It returns any error encountered.
+func checkDupes(m *uploadManifest) error {
+	release, err := loadLocalRelease(m)
+	if err != nil {
+		return err
+	}
+	candidates, err := searchDupes(release, []int{m.categoryId}, func() {})
+	if err != nil {
+		return fmt.Errorf("duplicate search failed: %s", err.Error())
+	}
+	dupes, err := findDupes(release, candidates)
+	if err != nil {
+		return fmt.Errorf("duplicate search failed: %s", err.Error())
+	}
+	if len(dupes) == 0 {
+		PrintVerbose("No duplicates of", m.Name, "found")
+		return nil
+	}
+
+	likely := 0
+	rows := make([][]string, 0, len(dupes))
+	for _, dupe := range dupes {
+		if dupe.Verdict == DupeLikely {
+			likely++
+		}
+		rows = append(rows, []string{
+			fmt.Sprintf("%d", dupe.Id),
+			dupe.Name,
+			datasize.ByteSize(dupe.Size).HumanReadable(),
+			fmt.Sprintf("%.0f%%", dupe.NameSim*100),
+			fmt.Sprintf("%.0f%%", dupe.FileSim*100),
+			dupe.Verdict,
+		})
+	}
+
+	// the report goes to stderr, stdout belongs to the upload result
+	fmt.Fprintln(os.Stderr, "Possible duplicates of", m.Name+":")
+	err = renderTo(os.Stderr, Output{
+		Data: dupes,
+		Sections: []Section{{
+			Header:  []string{"ID", "Name", "Size", "Name Match", "File Match", "Verdict"},
+			Rows:    rows,
+			Records: dupes,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	if likely > 0 && !*allowDupeFlag {
+		return fmt.Errorf("%s is probably a dupe of %d torrents on the site. Use --allow-dupe to upload it anyway", m.Name, likely)
+	}
+	if likely > 0 {
+		PrintQuiet("Uploading", m.Name, "despite the duplicates, --allow-dupe is set")
+	}
+
+	return nil
+}
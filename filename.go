@@ -0,0 +1,160 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	api "github.com/fuchsi/irrenhaus-api"
+	"github.com/fuchsi/irrenhaus-api/Category"
+)
+
+// Longest file name most filesystems accept, in bytes
+const maxFilenameLength = 255
+
+// Values available in name templates, all strings are safe to use as a single path component
+type nameTemplateData struct {
+	Id         int64
+	Name       string
+	Category   string
+	CategoryId int
+	InfoHash   string
+	Size       uint64
+	Added      time.Time
+	// file name sent by the server, without the .torrent extension
+	Filename string
+}
+
+// Characters which are not allowed in file names on at least one common filesystem
+var filenameReplacer = strings.NewReplacer(
+	"/", "_", "\\", "_", ":", "_", "*", "_", "?", "_",
+	"\"", "_", "<", "_", ">", "_", "|", "_",
+)
+
+// Make a string safe to use as a single path component
+func sanitizeFilename(name string) string {
+	name = filenameReplacer.Replace(name)
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return -1
+		}
+		return r
+	}, name)
+	// Windows does not allow trailing dots and spaces
+	name = strings.TrimRight(strings.TrimSpace(name), ".")
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+
+	if len(name) > maxFilenameLength {
+		ext := filepath.Ext(name)
+		if len(ext) > 16 {
+			ext = ""
+		}
+		name = truncateBytes(name[:len(name)-len(ext)], maxFilenameLength-len(ext)) + ext
+	}
+
+	return name
+}
+
+// Cut a string to at most n bytes without splitting a UTF-8 sequence
+func truncateBytes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && (s[n]&0xC0) == 0x80 {
+		n--
+	}
+
+	return s[:n]
+}
+
+// Render a name template for a downloaded torrent
+// Slashes in the template create directories, slashes in the values do not.
+//  nameTemplate: Go template, e.g. {{.Category}}/{{.Id}}-{{.Name}}.torrent
+//  entry:        Details of the torrent
+//  filename:     File name sent by the server
+// It returns the relative path and any error encountered.
+func renderNameTemplate(nameTemplate string, entry api.Entry, filename string) (string, error) {
+	tmpl, err := template.New("name").Funcs(TemplateFuncs).Parse(nameTemplate)
+	if err != nil {
+		return "", err
+	}
+
+	categoryName, err := Category.ToString(entry.Category)
+	if err != nil {
+		categoryName = fmt.Sprintf("%d", entry.Category)
+	}
+	data := nameTemplateData{
+		Id:         entry.Id,
+		Name:       sanitizeFilename(entry.Name),
+		Category:   sanitizeFilename(categoryName),
+		CategoryId: entry.Category,
+		InfoHash:   entry.InfoHash,
+		Size:       entry.Size,
+		Added:      entry.Added,
+		Filename:   sanitizeFilename(strings.TrimSuffix(filename, ".torrent")),
+	}
+
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, data); err != nil {
+		return "", err
+	}
+
+	components := make([]string, 0)
+	for _, component := range strings.Split(buffer.String(), "/") {
+		if strings.TrimSpace(component) == "" {
+			continue
+		}
+		components = append(components, sanitizeFilename(component))
+	}
+	if len(components) == 0 {
+		return "", fmt.Errorf("name template '%s' produced an empty file name", nameTemplate)
+	}
+
+	name := filepath.Join(components...)
+	if !strings.HasSuffix(name, ".torrent") {
+		name += ".torrent"
+	}
+
+	return name, nil
+}
+
+// Held while a download picks its path and writes the file, so parallel downloads never pick the same name
+var downloadPathMutex sync.Mutex
+
+// Find a free file name by appending a counter, e.g. "Name (2).torrent"
+// The caller has to hold downloadPathMutex until the file is written.
+func uniquePath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
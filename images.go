@@ -0,0 +1,435 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// Defaults of the image limits
+const (
+	defaultImageMaxWidth  = 1920
+	defaultImageMaxHeight = 2160
+	defaultImageMaxSize   = 4 << 20
+	defaultImageQuality   = 90
+	// lowest JPEG quality tried before an image is scaled down further
+	minImageQuality = 60
+	// largest source image decoded in pixels, against decompression bombs
+	maxImagePixels = 100 * 1000 * 1000
+	// gap between the tiles of a contact sheet
+	contactSheetGap = 4
+	// highest tile of a contact sheet relative to the width of a column, taller images get narrower
+	contactSheetMaxAspect = 4
+)
+
+// Limits for uploaded images, configured in the Images section of the config file
+// Larger images are scaled down, other formats than JPEG, PNG and GIF are converted.
+type ImageSettings struct {
+	MaxWidth  int `json:",omitempty"`
+	MaxHeight int `json:",omitempty"`
+	// e.g. 2MB
+	MaxSize string `json:",omitempty"`
+	// JPEG quality, 1 to 100
+	Quality int `json:",omitempty"`
+}
+
+// Image ready for upload
+type preparedImage struct {
+	Data   []byte
+	Format string
+	Width  int
+	Height int
+	// what was changed, empty if the file is sent as it is
+	Changes []string
+}
+
+// Formats the site accepts
+var uploadImageFormats = map[string]bool{"jpeg": true, "png": true, "gif": true}
+
+// Get the configured image limits, with defaults for the missing ones
+func imageLimits() ImageSettings {
+	limits := ImageSettings{}
+	if config.Images != nil {
+		limits = *config.Images
+	}
+	if limits.MaxWidth <= 0 {
+		limits.MaxWidth = defaultImageMaxWidth
+	}
+	if limits.MaxHeight <= 0 {
+		limits.MaxHeight = defaultImageMaxHeight
+	}
+	if limits.Quality <= 0 || limits.Quality > 100 {
+		limits.Quality = defaultImageQuality
+	}
+	if limits.MaxSize == "" {
+		limits.MaxSize = datasize.ByteSize(defaultImageMaxSize).String()
+	}
+
+	return limits
+}
+
+// Get the byte limit of images
+func (limits ImageSettings) maxBytes() (int, error) {
+	var size datasize.ByteSize
+	if err := size.UnmarshalText([]byte(limits.MaxSize)); err != nil {
+		return 0, fmt.Errorf("invalid Images.MaxSize '%s' in the config", limits.MaxSize)
+	}
+
+	return int(size.Bytes()), nil
+}
+
+// Decode an image, checking its size first
+// It returns the image, its format and any error encountered.
+func decodeImage(data []byte) (image.Image, string, error) {
+	// the decoders check the magic bytes and the header, not only the extension
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errors.New("not a JPEG, PNG, GIF, BMP, TIFF or WebP image")
+	}
+	if cfg.Width < 1 || cfg.Height < 1 || int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return nil, "", fmt.Errorf("%dx%d pixels is out of range", cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("broken %s image: %s", strings.ToUpper(format), err.Error())
+	}
+
+	return img, format, nil
+}
+
+// Get the size which fits into the limits, keeping the aspect ratio
+func fitSize(width int, height int, maxWidth int, maxHeight int) (int, int) {
+	if width <= maxWidth && height <= maxHeight {
+		return width, height
+	}
+	scale := float64(maxWidth) / float64(width)
+	if s := float64(maxHeight) / float64(height); s < scale {
+		scale = s
+	}
+	w, h := int(float64(width)*scale+0.5), int(float64(height)*scale+0.5)
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	return w, h
+}
+
+func scaleImage(img image.Image, width int, height int) image.Image {
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	return scaled
+}
+
+// Check if an image has transparent pixels
+func hasAlpha(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return !opaque.Opaque()
+	}
+
+	return true
+}
+
+// Encode an image as JPEG, on a white background for transparent images
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	if hasAlpha(img) {
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), &image.Uniform{color.White}, image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		img = flat
+	}
+	var buffer bytes.Buffer
+	err := jpeg.Encode(&buffer, img, &jpeg.Options{Quality: quality})
+
+	return buffer.Bytes(), err
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	err := encoder.Encode(&buffer, img)
+
+	return buffer.Bytes(), err
+}
+
+// Encode an image within the byte limit
+// Lossless sources stay PNG if they fit, otherwise the JPEG quality is lowered and then the image is scaled down.
+// It returns the prepared image and any error encountered.
+func encodeWithinLimit(img image.Image, lossless bool, limits ImageSettings, maxBytes int) (*preparedImage, error) {
+	result := &preparedImage{}
+	for {
+		bounds := img.Bounds()
+		result.Width, result.Height = bounds.Dx(), bounds.Dy()
+
+		if lossless {
+			data, err := encodePNG(img)
+			if err != nil {
+				return nil, err
+			}
+			if len(data) <= maxBytes {
+				result.Data, result.Format = data, "png"
+				return result, nil
+			}
+		}
+		for quality := limits.Quality; quality >= minImageQuality; quality -= 10 {
+			data, err := encodeJPEG(img, quality)
+			if err != nil {
+				return nil, err
+			}
+			if len(data) <= maxBytes {
+				result.Data, result.Format = data, "jpeg"
+				return result, nil
+			}
+		}
+
+		if result.Width < 64 || result.Height < 64 {
+			return nil, fmt.Errorf("the image does not fit into %s", datasize.ByteSize(maxBytes).HumanReadable())
+		}
+		img = scaleImage(img, result.Width*3/4, result.Height*3/4)
+	}
+}
+
+// Bring an image into a format and size the site accepts
+// It returns the image data and any error encountered.
+func prepareImageData(data []byte) (*preparedImage, error) {
+	limits := imageLimits()
+	maxBytes, err := limits.maxBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	img, format, err := decodeImage(data)
+	if err != nil {
+		return nil, err
+	}
+	bounds := img.Bounds()
+	width, height := fitSize(bounds.Dx(), bounds.Dy(), limits.MaxWidth, limits.MaxHeight)
+	if uploadImageFormats[format] && width == bounds.Dx() && len(data) <= maxBytes {
+		return &preparedImage{Data: data, Format: format, Width: width, Height: height}, nil
+	}
+
+	changes := make([]string, 0)
+	if width != bounds.Dx() || height != bounds.Dy() {
+		img = scaleImage(img, width, height)
+		changes = append(changes, fmt.Sprintf("scaled from %dx%d", bounds.Dx(), bounds.Dy()))
+	}
+	// animations lose all but the first frame, so they are only touched if they have to
+	lossless := format != "jpeg" && format != "webp"
+	result, err := encodeWithinLimit(img, lossless, limits, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	if result.Width != width {
+		changes = append(changes, fmt.Sprintf("scaled to fit %s", datasize.ByteSize(maxBytes).HumanReadable()))
+	}
+	if result.Format != format {
+		changes = append(changes, "converted from "+strings.ToUpper(format))
+	} else if len(changes) == 0 {
+		changes = append(changes, "re-encoded from "+datasize.ByteSize(len(data)).HumanReadable())
+	}
+	result.Changes = changes
+
+	return result, nil
+}
+
+// Read an image file and bring it into a format and size the site accepts
+// It returns the image data and any error encountered.
+func prepareImage(path string) (*preparedImage, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return prepareImageData(data)
+}
+
+// Describe a prepared image, e.g. "JPEG, 1920x1080, 512 KB, converted from WEBP"
+func (p *preparedImage) String() string {
+	text := fmt.Sprintf("%s, %dx%d, %s", strings.ToUpper(p.Format), p.Width, p.Height,
+		datasize.ByteSize(len(p.Data)).HumanReadable())
+	if len(p.Changes) > 0 {
+		text += ", " + strings.Join(p.Changes, ", ")
+	}
+
+	return text
+}
+
+// Arrange images in a grid
+//  paths:   Images, in reading order
+//  columns: Number of columns
+//  width:   Width of the sheet in pixels
+// It returns the sheet and any error encountered.
+func makeContactSheet(paths []string, columns int, width int) (image.Image, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("a contact sheet needs at least one image")
+	}
+	if columns < 1 {
+		columns = 1
+	}
+	if columns > len(paths) {
+		columns = len(paths)
+	}
+	tileWidth := (width - contactSheetGap*(columns+1)) / columns
+	if tileWidth < 16 {
+		return nil, errors.New("too many columns for the width of the contact sheet")
+	}
+
+	tiles := make([]image.Image, 0, len(paths))
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		img, _, err := decodeImage(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		bounds := img.Bounds()
+		// int64, a tall image times the tile width overflows 32 bit
+		width, height := int64(tileWidth), int64(bounds.Dy())*int64(tileWidth)/int64(bounds.Dx())
+		if maxHeight := int64(contactSheetMaxAspect * tileWidth); height > maxHeight {
+			height = maxHeight
+			width = int64(bounds.Dx()) * height / int64(bounds.Dy())
+		}
+		if width < 1 {
+			width = 1
+		}
+		if height < 1 {
+			height = 1
+		}
+		tiles = append(tiles, scaleImage(img, int(width), int(height)))
+	}
+
+	// every row is as high as its highest tile
+	rowHeights := make([]int, (len(tiles)+columns-1)/columns)
+	for i, tile := range tiles {
+		if h := tile.Bounds().Dy(); h > rowHeights[i/columns] {
+			rowHeights[i/columns] = h
+		}
+	}
+	height := contactSheetGap
+	for _, h := range rowHeights {
+		height += h + contactSheetGap
+	}
+
+	sheet := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(sheet, sheet.Bounds(), &image.Uniform{color.RGBA{0x20, 0x20, 0x20, 0xFF}}, image.Point{}, draw.Src)
+	y := contactSheetGap
+	for row, rowHeight := range rowHeights {
+		for column := 0; column < columns && row*columns+column < len(tiles); column++ {
+			tile := tiles[row*columns+column]
+			// narrow tiles are centered in their column
+			x := contactSheetGap + column*(tileWidth+contactSheetGap) + (tileWidth-tile.Bounds().Dx())/2
+			offset := (rowHeight - tile.Bounds().Dy()) / 2
+			rect := image.Rect(x, y+offset, x+tile.Bounds().Dx(), y+offset+tile.Bounds().Dy())
+			draw.Draw(sheet, rect, tile, image.Point{}, draw.Src)
+		}
+		y += rowHeight + contactSheetGap
+	}
+
+	return sheet, nil
+}
+
+// Create a contact sheet for an upload
+// It returns the encoded sheet and any error encountered.
+func prepareContactSheet(paths []string) (*preparedImage, error) {
+	limits := imageLimits()
+	maxBytes, err := limits.maxBytes()
+	if err != nil {
+		return nil, err
+	}
+	sheet, err := makeContactSheet(paths, *sheetColumnsOpt, limits.MaxWidth)
+	if err != nil {
+		return nil, err
+	}
+	bounds := sheet.Bounds()
+	if w, h := fitSize(bounds.Dx(), bounds.Dy(), limits.MaxWidth, limits.MaxHeight); h != bounds.Dy() {
+		sheet = scaleImage(sheet, w, h)
+	}
+
+	result, err := encodeWithinLimit(sheet, false, limits, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	result.Changes = []string{fmt.Sprintf("contact sheet of %d images", len(paths))}
+
+	return result, nil
+}
+
+// Write a contact sheet to a file, the extension selects JPEG, PNG, GIF or BMP
+//  output: File name of the sheet
+//  paths:  Images for the sheet
+// It returns any error encountered.
+func contactSheet(output string, paths []string) error {
+	limits := imageLimits()
+	sheet, err := makeContactSheet(paths, *sheetColumnsOpt, limits.MaxWidth)
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	switch strings.ToLower(filepath.Ext(output)) {
+	case ".jpg", ".jpeg":
+		err = jpeg.Encode(&buffer, sheet, &jpeg.Options{Quality: limits.Quality})
+	case ".png":
+		err = png.Encode(&buffer, sheet)
+	case ".gif":
+		err = gif.Encode(&buffer, sheet, nil)
+	case ".bmp":
+		err = bmp.Encode(&buffer, sheet)
+	default:
+		return fmt.Errorf("unknown image format of %s, use .jpg, .png, .gif or .bmp", output)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(output); err == nil && !*forceFlag {
+		return fmt.Errorf("%s already exists. Use --force to overwrite it", output)
+	}
+	if err := writeFileAtomic(output, buffer.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	bounds := sheet.Bounds()
+	PrintQuiet(fmt.Sprintf("Created %s: %dx%d, %s", output, bounds.Dx(), bounds.Dy(),
+		datasize.ByteSize(buffer.Len()).HumanReadable()))
+
+	return nil
+}
@@ -0,0 +1,96 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Encode a PNG and patch the size in its header, the pixel data is only read by the full decoder
+func testPNG(t *testing.T, width uint32, height uint32) []byte {
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+	// signature, chunk length and type, then width and height, followed by the CRC of the chunk
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+
+	return data
+}
+
+func TestDecodeImage(t *testing.T) {
+	if _, format, err := decodeImage(testPNG(t, 1, 1)); err != nil || format != "png" {
+		t.Errorf("decodeImage(1x1 PNG) = %s, %v", format, err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"not an image", []byte("GIF89 is not enough")},
+		{"empty image", testPNG(t, 0, 1)},
+		// within the old limit of 20000 pixels per side, but 400 megapixels
+		{"too many pixels", testPNG(t, 20000, 20000)},
+		{"too wide", testPNG(t, 1000000, 1000)},
+	}
+	for _, test := range tests {
+		if _, _, err := decodeImage(test.data); err == nil {
+			t.Errorf("%s: decodeImage succeeded, want an error", test.name)
+		}
+	}
+}
+
+func TestContactSheetTallImage(t *testing.T) {
+	dir := t.TempDir()
+	paths := make([]string, 0, 2)
+	for _, size := range []image.Point{{100, 100}, {10, 2000}} {
+		var buffer bytes.Buffer
+		if err := png.Encode(&buffer, image.NewGray(image.Rect(0, 0, size.X, size.Y))); err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%dx%d.png", size.X, size.Y))
+		if err := ioutil.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	width := 400
+	sheet, err := makeContactSheet(paths, 2, width)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tall image is not scaled to the width of its column, but limited in height
+	tileWidth := (width - 3*contactSheetGap) / 2
+	want := image.Rect(0, 0, width, contactSheetMaxAspect*tileWidth+2*contactSheetGap)
+	if sheet.Bounds() != want {
+		t.Errorf("sheet bounds = %v, want %v", sheet.Bounds(), want)
+	}
+}
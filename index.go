@@ -0,0 +1,600 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/c2h5oh/datasize"
+	api "github.com/fuchsi/irrenhaus-api"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Age after which the index search warns that the results may be outdated
+const indexStaleAfter = 24 * time.Hour
+
+// Buckets of the index database
+var (
+	// Torrent-ID -> indexEntry
+	indexTorrents = []byte("torrents")
+	// term, 0, Torrent-ID -> nothing
+	indexTerms = []byte("terms")
+	// name -> JSON of the sync state
+	indexMeta = []byte("meta")
+)
+
+var indexSyncKey = []byte("sync")
+
+// Torrent in the index
+type indexEntry struct {
+	Entry api.Entry
+	// time of the last search result or details of the torrent
+	Synced time.Time
+	// time the file list was fetched, zero until the details were fetched
+	FilesSynced time.Time `json:",omitempty"`
+}
+
+// Progress of the sync, so an interrupted sync continues where it stopped
+type indexSyncState struct {
+	// start of the current or last sync
+	Started time.Time
+	// end of the last complete sync
+	Finished time.Time
+	// categories whose search results are in the index since Started
+	Categories []int `json:",omitempty"`
+}
+
+// Check whether the last sync did not finish
+func (s indexSyncState) interrupted() bool {
+	return s.Started.After(s.Finished)
+}
+
+type indexStatusRecord struct {
+	Path        string    `json:"path"`
+	Size        uint64    `json:"size"`
+	Torrents    int       `json:"torrents"`
+	WithFiles   int       `json:"with_files"`
+	LastSync    time.Time `json:"last_sync"`
+	Interrupted bool      `json:"interrupted"`
+}
+
+func indexUsage() {
+	fmt.Println("index subcommand")
+
+	fmt.Println("\tsync [-c category] [--limit n] [--rate n]")
+	fmt.Println("\t\tAdd the search results of all categories to the local index and fetch their file lists")
+	fmt.Println("\t\tAn interrupted sync continues where it stopped, --limit caps the file lists fetched per run")
+
+	fmt.Println("\tsearch [-c category] [search options] [query]")
+	fmt.Println("\t\tSearch the local index without contacting the site. All words of the query have to match")
+	fmt.Println("\t\tthe name or a file path, word* matches a prefix and -word excludes torrents")
+
+	fmt.Println("\tstatus")
+	fmt.Println("\t\tShow the size and age of the local index")
+}
+
+// Get the path of the index database of the active profile
+func indexPath() string {
+	if profileName == legacyProfileName {
+		return CONFIGPATH + "index.db"
+	}
+
+	return CONFIGPATH + "index." + profileName + ".db"
+}
+
+// Open the index database and create its buckets
+//  readOnly: Open the database for reading, it has to exist
+// It returns the database and any error encountered.
+func openIndex(readOnly bool) (*bolt.DB, error) {
+	if readOnly {
+		if _, err := os.Stat(indexPath()); os.IsNotExist(err) {
+			return nil, errors.New("there is no index yet. Run 'index sync' first")
+		}
+	}
+
+	db, err := bolt.Open(indexPath(), 0600, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, errors.New("the index is in use by another sync")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if readOnly {
+		return db, nil
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{indexTorrents, indexTerms, indexMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func indexKey(tid int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(tid))
+	return key
+}
+
+func indexTermKey(term string, tid int64) []byte {
+	return append(append([]byte(term), 0), indexKey(tid)...)
+}
+
+// Split a text into lower case words for the index
+// Dots, dashes and underscores separate words, like the spaces in release names.
+func indexTokens(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Get the words of the name and file paths of a torrent
+func indexEntryTerms(entry api.Entry) map[string]bool {
+	terms := make(map[string]bool)
+	for _, term := range indexTokens(entry.Name) {
+		terms[term] = true
+	}
+	for _, file := range entry.Files {
+		for _, term := range indexTokens(file.Name) {
+			terms[term] = true
+		}
+	}
+
+	return terms
+}
+
+func getIndexEntry(tx *bolt.Tx, tid int64) (*indexEntry, error) {
+	value := tx.Bucket(indexTorrents).Get(indexKey(tid))
+	if value == nil {
+		return nil, nil
+	}
+	var stored indexEntry
+	if err := json.Unmarshal(value, &stored); err != nil {
+		return nil, fmt.Errorf("index entry %d: %s", tid, err.Error())
+	}
+
+	return &stored, nil
+}
+
+// Add or update a torrent and its words
+// Search results have no file lists, the stored file list is kept for them.
+//  withFiles: entry comes from the details with the file list
+// It returns any error encountered.
+func putIndexEntry(tx *bolt.Tx, entry api.Entry, withFiles bool) error {
+	old, err := getIndexEntry(tx, entry.Id)
+	if err != nil {
+		return err
+	}
+
+	stored := indexEntry{Entry: entry, Synced: time.Now()}
+	// peers and snatches change too often to be worth storing
+	stored.Entry.Peers, stored.Entry.Snatches = nil, nil
+	if withFiles {
+		stored.FilesSynced = stored.Synced
+	} else if old != nil {
+		stored.Entry.Files = old.Entry.Files
+		stored.FilesSynced = old.FilesSynced
+		// the details are fetched again when the torrent changed
+		if old.Entry.FileCount != entry.FileCount || old.Entry.Size != entry.Size {
+			stored.FilesSynced = time.Time{}
+		}
+	}
+
+	terms := tx.Bucket(indexTerms)
+	newTerms := indexEntryTerms(stored.Entry)
+	if old != nil {
+		for term := range indexEntryTerms(old.Entry) {
+			if !newTerms[term] {
+				if err := terms.Delete(indexTermKey(term, entry.Id)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for term := range newTerms {
+		if err := terms.Put(indexTermKey(term, entry.Id), []byte{}); err != nil {
+			return err
+		}
+	}
+
+	value, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(indexTorrents).Put(indexKey(entry.Id), value)
+}
+
+func loadIndexSyncState(tx *bolt.Tx) (indexSyncState, error) {
+	var state indexSyncState
+	value := tx.Bucket(indexMeta).Get(indexSyncKey)
+	if value == nil {
+		return state, nil
+	}
+	err := json.Unmarshal(value, &state)
+
+	return state, err
+}
+
+func dumpIndexSyncState(tx *bolt.Tx, state indexSyncState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(indexMeta).Put(indexSyncKey, value)
+}
+
+// Fetch the search results of all categories and the file lists into the index
+//  categories: Categories to sync, all of them if empty
+//  limit:      Maximum number of file lists to fetch, 0 for all
+// It returns any error encountered.
+func indexSync(categories []int, limit int) error {
+	db, err := openIndex(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if len(categories) == 0 {
+		for _, c := range categoryList() {
+			categories = append(categories, c.Id)
+		}
+	}
+
+	wait, stop := newRequestLimiter()
+	defer stop()
+
+	var state indexSyncState
+	err = db.Update(func(tx *bolt.Tx) (err error) {
+		state, err = loadIndexSyncState(tx)
+		if err != nil {
+			return err
+		}
+		if state.interrupted() {
+			PrintQuiet("Continuing the sync from", state.Started.Format("02.01.2006 15:04:05"))
+		} else {
+			state.Started = time.Now()
+			state.Categories = nil
+		}
+		return dumpIndexSyncState(tx, state)
+	})
+	if err != nil {
+		return err
+	}
+
+	done := make(map[int]bool)
+	for _, id := range state.Categories {
+		done[id] = true
+	}
+
+	c := getConnection()
+	added := 0
+	for _, category := range categories {
+		if done[category] {
+			continue
+		}
+		wait()
+		var entries []api.Entry
+		err := withSession(func() (err error) {
+			entries, err = api.Search(c, "", []int{category}, true)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("category %d: %s", category, err.Error())
+		}
+
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, entry := range entries {
+				old, err := getIndexEntry(tx, entry.Id)
+				if err != nil {
+					return err
+				}
+				if old == nil {
+					added++
+				}
+				if err := putIndexEntry(tx, entry, false); err != nil {
+					return err
+				}
+			}
+			state.Categories = append(state.Categories, category)
+			return dumpIndexSyncState(tx, state)
+		})
+		if err != nil {
+			return err
+		}
+		PrintVerbose(fmt.Sprintf("Category %d: %d torrents", category, len(entries)))
+	}
+	PrintQuiet(fmt.Sprintf("Found %d new torrents", added))
+
+	// the file lists need one request per torrent, the newest come first
+	missing := make([]int64, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(indexTorrents).ForEach(func(key []byte, value []byte) error {
+			var stored indexEntry
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return err
+			}
+			if stored.FilesSynced.IsZero() {
+				missing = append(missing, stored.Entry.Id)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(missing, func(i, j int) bool { return missing[i] > missing[j] })
+	if limit > 0 && len(missing) > limit {
+		PrintQuiet(fmt.Sprintf("Fetching %d of %d missing file lists, run 'index sync' again for the rest", limit, len(missing)))
+		missing = missing[:limit]
+	}
+
+	for i, tid := range missing {
+		wait()
+		var entry api.Entry
+		err := withSession(func() (err error) {
+			entry, err = api.Details(c, tid, true, false, false)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("details of %d: %s", tid, err.Error())
+		}
+		if entry.Id == 0 {
+			entry.Id = tid
+		}
+		err = db.Update(func(tx *bolt.Tx) error {
+			return putIndexEntry(tx, entry, true)
+		})
+		if err != nil {
+			return err
+		}
+		if (i+1)%100 == 0 {
+			PrintVerbose(fmt.Sprintf("Fetched %d of %d file lists", i+1, len(missing)))
+		}
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		state.Finished = time.Now()
+		if len(missing) > 0 {
+			PrintQuiet(fmt.Sprintf("Fetched %d file lists", len(missing)))
+		}
+		return dumpIndexSyncState(tx, state)
+	})
+}
+
+// Find the torrents with words starting with a prefix, or exactly matching a word
+func indexMatchTerm(tx *bolt.Tx, term string, prefix bool) map[int64]bool {
+	ids := make(map[int64]bool)
+	seek := []byte(term)
+	if !prefix {
+		seek = append(seek, 0)
+	}
+
+	cursor := tx.Bucket(indexTerms).Cursor()
+	for key, _ := cursor.Seek(seek); key != nil && bytes.HasPrefix(key, seek); key, _ = cursor.Next() {
+		if len(key) < 9 {
+			continue
+		}
+		ids[int64(binary.BigEndian.Uint64(key[len(key)-8:]))] = true
+	}
+
+	return ids
+}
+
+// Find the torrents matching a query
+// All words have to match, word* matches a prefix and -word excludes torrents.
+// An empty query matches all torrents.
+// It returns the matching Torrent-IDs and any error encountered.
+func indexQuery(tx *bolt.Tx, query string) (map[int64]bool, error) {
+	var matches map[int64]bool
+	excluded := make(map[int64]bool)
+
+	for _, word := range strings.Fields(query) {
+		exclude := strings.HasPrefix(word, "-")
+		word = strings.TrimPrefix(word, "-")
+		prefix := strings.HasSuffix(word, "*")
+		tokens := indexTokens(strings.TrimSuffix(word, "*"))
+		for i, token := range tokens {
+			// only the last part of word* is a prefix, e.g. x264-gro*
+			ids := indexMatchTerm(tx, token, prefix && i == len(tokens)-1)
+			if exclude {
+				for id := range ids {
+					excluded[id] = true
+				}
+				continue
+			}
+			if matches == nil {
+				matches = ids
+				continue
+			}
+			for id := range matches {
+				if !ids[id] {
+					delete(matches, id)
+				}
+			}
+		}
+	}
+
+	if matches == nil {
+		matches = make(map[int64]bool)
+		err := tx.Bucket(indexTorrents).ForEach(func(key []byte, value []byte) error {
+			matches[int64(binary.BigEndian.Uint64(key))] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for id := range excluded {
+		delete(matches, id)
+	}
+
+	return matches, nil
+}
+
+// Search the local index and print the results like search
+//  query:      Words of names and file paths
+//  categories: Categories of the results, all of them if empty
+// It returns any error encountered.
+func indexSearch(query string, categories []int) error {
+	options, err := newSearchOptions()
+	if err != nil {
+		return err
+	}
+
+	db, err := openIndex(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	inCategory := make(map[int]bool)
+	for _, id := range categories {
+		inCategory[id] = true
+	}
+
+	var state indexSyncState
+	entries := make([]api.Entry, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		if state, err = loadIndexSyncState(tx); err != nil {
+			return err
+		}
+		ids, err := indexQuery(tx, query)
+		if err != nil {
+			return err
+		}
+		for id := range ids {
+			stored, err := getIndexEntry(tx, id)
+			if err != nil {
+				return err
+			}
+			if stored == nil || (len(inCategory) > 0 && !inCategory[stored.Entry.Category]) {
+				continue
+			}
+			entries = append(entries, stored.Entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the seeders and leechers are as old as the index
+	lastSync := state.Finished
+	switch {
+	case lastSync.IsZero():
+		fmt.Fprintln(os.Stderr, "warning: the index was never synced completely. Run 'index sync'")
+	case time.Since(lastSync) > indexStaleAfter:
+		fmt.Fprintf(os.Stderr, "warning: the index was synced %s ago. Run 'index sync' for new torrents and current seeders\n",
+			time.Since(lastSync).Truncate(time.Hour))
+	}
+	if !lastSync.IsZero() && state.interrupted() {
+		fmt.Fprintln(os.Stderr, "warning: the last sync was interrupted. Run 'index sync' to finish it")
+	}
+
+	title := "Found %d Torrents in the local index"
+	if !lastSync.IsZero() {
+		title += ", synced " + lastSync.Format("02.01.2006 15:04")
+	}
+
+	return showSearchResults(entries, options, title)
+}
+
+func indexStatus() error {
+	db, err := openIndex(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	record := indexStatusRecord{Path: indexPath()}
+	if stat, err := os.Stat(indexPath()); err == nil {
+		record.Size = uint64(stat.Size())
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		state, err := loadIndexSyncState(tx)
+		if err != nil {
+			return err
+		}
+		record.LastSync = state.Finished
+		record.Interrupted = state.interrupted()
+
+		return tx.Bucket(indexTorrents).ForEach(func(key []byte, value []byte) error {
+			var stored indexEntry
+			if err := json.Unmarshal(value, &stored); err != nil {
+				return err
+			}
+			record.Torrents++
+			if !stored.FilesSynced.IsZero() {
+				record.WithFiles++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	lastSync := "never"
+	if !record.LastSync.IsZero() {
+		lastSync = fmt.Sprintf("%s (%s ago)", record.LastSync.Format("02.01.2006 15:04:05"),
+			time.Since(record.LastSync).Truncate(time.Minute))
+	}
+	syncState := "complete"
+	if record.LastSync.IsZero() && !record.Interrupted {
+		syncState = "never synced"
+	}
+	if record.Interrupted {
+		syncState = "interrupted, run 'index sync' to finish it"
+	}
+
+	return Render(Output{
+		Data: record,
+		Sections: []Section{{
+			Rows: [][]string{
+				{"Path", record.Path},
+				{"Size", datasize.ByteSize(record.Size).HumanReadable()},
+				{"Torrents", fmt.Sprintf("%d", record.Torrents)},
+				{"Files", fmt.Sprintf("file lists of %d torrents", record.WithFiles)},
+				{"Last sync", lastSync},
+				{"State", syncState},
+			},
+			Records: record,
+		}},
+	})
+}
@@ -23,9 +23,13 @@ import (
 	"os"
 
 	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pborman/getopt/v2"
 )
@@ -36,14 +40,72 @@ var CONFIGPATH = ".irrenhaus-cli/"
 var config Configuration
 var configFile string
 
+// Commands which work without a connection to the site
+var offlineCommands = map[string]bool{
+	"init":         true,
+	"commands":     true,
+	"categories":   true,
+	"profile":      true,
+	"config":       true,
+	"agent":        true,
+	"client":       true,
+	"create":       true,
+	"validate":     true,
+	"description":  true,
+	"mediainfo":    true,
+	"contactsheet": true,
+}
+
+// Subcommands which need a connection, the other subcommands of these commands work offline
+var onlineSubcommands = map[string][]string{
+	"watch":   {"run", "daemon"},
+	"index":   {"sync"},
+	"session": {"status"},
+}
+
 var helpFlag = getopt.BoolLong("help", 'h', "Show this help message and exit")
 var versionFlag = getopt.BoolLong("version", 'V', "Print version and quit")
 var verboseFlag = getopt.BoolLong("verbose", 'v', "verbose output")
 var quietFlag = getopt.BoolLong("quiet", 'q', "no output")
 var configOpt = getopt.StringLong("config", 'C', "", "Path to the config file")
+var profileOpt = getopt.StringLong("profile", 'P', "", "Account profile, defaults to $IRRENHAUS_PROFILE or the default profile")
 var categoryOpt = getopt.ListLong("category", 'c', "", "Torrent category. See 'categories' for help.")
 var nameOpt = getopt.StringLong("name", 'n', "", "Torrent name. See 'upload' for details.")
 var deadFlag = getopt.BoolLong("dead", 'd', "Include dead torrents")
+var outputOpt = getopt.StringLong("output", 'o', OutputTable, "Output format: table, json, ndjson or template")
+var forceFlag = getopt.BoolLong("force", 0, "Overwrite existing files")
+var noVerifyFlag = getopt.BoolLong("no-verify", 0, "Do not compare the info hash of downloads with the site")
+var nameTemplateOpt = getopt.StringLong("name-template", 0, "", "Go template for the path of downloads, e.g. '{{.Category}}/{{.Id}}-{{.Name}}.torrent'")
+var jobsOpt = getopt.IntLong("jobs", 'j', 4, "Number of parallel downloads")
+var rateOpt = getopt.IntLong("rate", 0, 2, "Maximum requests per second, 0 for no limit")
+var clientOpt = getopt.StringLong("client", 0, "", "Send downloads to a BitTorrent client from the config. See 'client' for help.")
+var fromFileOpt = getopt.StringLong("from-file", 0, "", "Read Torrent-IDs from a file, - for stdin")
+var downloadFlag = getopt.BoolLong("download", 0, "Download torrents from the search results")
+var selectOpt = getopt.StringLong("select", 0, "", "Search results to download, e.g. 1,3,5-8 or all")
+var destOpt = getopt.StringLong("dest", 0, "", "Destination directory for downloads from the search results")
+var sortOpt = getopt.StringLong("sort", 0, "added", "Order of the search results: name, size, added, seeders or leechers")
+var reverseFlag = getopt.BoolLong("reverse", 0, "Reverse the order of the search results")
+var minSizeOpt = getopt.StringLong("min-size", 0, "", "Only show search results of at least this size, e.g. 4GB")
+var maxSizeOpt = getopt.StringLong("max-size", 0, "", "Only show search results of at most this size")
+var sinceOpt = getopt.StringLong("since", 0, "", "Only show search results added since an age or date, e.g. 7d, 12h or 2018-06-01")
+var minSeedersOpt = getopt.IntLong("min-seeders", 0, 0, "Only show search results with at least this many seeders")
+var regexOpt = getopt.StringLong("regex", 0, "", "Only show search results whose name matches the regular expression")
+var limitOpt = getopt.IntLong("limit", 0, 0, "Maximum number of search results, 0 for all")
+var searchColumnsOpt = getopt.ListLong("columns", 0, "", "Columns of the search results: id, name, size, added, seeders, leechers, snatches, files, category, hash")
+var fromOpt = getopt.StringLong("from", 0, "", "Create the torrent for the upload from a file or directory")
+var announceOpt = getopt.StringLong("announce", 0, "", "Announce URL for new torrents, defaults to the one of the profile")
+var pieceSizeOpt = getopt.StringLong("piece-size", 0, "", "Piece size for new torrents, e.g. 4MB, chosen from the total size by default")
+var dryRunFlag = getopt.BoolLong("dry-run", 0, "Validate uploads and print a report without contacting the site")
+var allowDupeFlag = getopt.BoolLong("allow-dupe", 0, "Upload even if the release looks like a duplicate of a torrent on the site")
+var varOpt = getopt.FlagLong(descriptionVars, "var", 0, "Variable for description templates, key=value, repeatable")
+var bbcodeFlag = getopt.BoolLong("bbcode", 0, "Print the media info as BBCode for descriptions")
+var contactSheetOpt = getopt.ListLong("contact-sheet", 0, "", "Images to combine into a contact sheet, used as the second image of an upload")
+var sheetColumnsOpt = getopt.IntLong("sheet-columns", 0, 3, "Number of columns of contact sheets")
+var interactiveFlag = getopt.BoolLong("interactive", 'i', "Ask for the fields of an upload step by step")
+var manifestOpt = getopt.StringLong("manifest", 0, "", "Upload the releases of a manifest file or a directory of manifests")
+var resultsOpt = getopt.StringLong("results", 0, "", "Results file of manifest uploads, defaults to <manifest>.results.yaml")
+var intervalOpt = getopt.StringLong("interval", 0, "15m", "Time between two runs of watch daemon")
+var formatOpt = getopt.StringLong("format", 'f', "", "Go template for every output record, or the name of a template in the config path")
 
 func main() {
 	getopt.SetParameters("command args")
@@ -65,98 +127,196 @@ func main() {
 	if *configOpt == "" {
 		CONFIGPATH = os.Getenv("HOME") + CONFIGPATH
 		if _, err := os.Stat(CONFIGPATH); err != nil {
-			os.Mkdir(CONFIGPATH, 0772)
+			os.Mkdir(CONFIGPATH, 0700)
 		}
 		configFile = CONFIGPATH + "config.json"
 	} else {
 		configFile = *configOpt
 	}
+	for _, path := range []string{CONFIGPATH, configFile} {
+		if err := checkPermissions(path); err != nil {
+			PrintError(err.Error())
+		}
+	}
+	// named templates are in the config path
+	if err := checkOutput(); err != nil {
+		*outputOpt = OutputTable
+		PrintError(err.Error())
+	}
+
 	var err error
 	config, err = loadConfig(configFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to read config file: %s\n", err.Error())
-		if command != "init" {
+		if command != "init" && command != "profile" && command != "agent" {
 			command = "commands"
 		}
 	}
+	if err := selectProfile(); err != nil {
+		PrintError(err.Error())
+	}
 
-	if command != "init" && command != "commands" {
+	if needsConnection(command, getopt.Arg(1)) {
+		if _, ok := config.Profiles[profileName]; !ok {
+			PrintError("unknown profile", profileName)
+		}
+		if err := checkPermissions(cookieFile()); err != nil {
+			PrintError(err.Error())
+		}
+		if err := loadProfileSecrets(); err != nil {
+			PrintError("failed to unlock the vault:", err.Error())
+		}
 		newConnection()
 	}
 
 	switch command {
 	case "init":
-		var username, password, pin, url string
-		url = "https://irrenhaus.dyndns.dk"
-		switch getopt.NArgs() {
-		case 1:
-			AskFor("Username", &username)
-			AskFor("Password", &password)
-			AskFor("Pin", &pin)
-		case 2:
-			username = getopt.Arg(1)
-			AskFor("Password", &password)
-			AskFor("Pin", &pin)
-		case 3:
-			username = getopt.Arg(1)
-			password = getopt.Arg(2)
-			AskFor("Pin", &pin)
-		case 4:
-			username = getopt.Arg(1)
-			password = getopt.Arg(2)
-			pin = getopt.Arg(3)
-		default:
-			username = getopt.Arg(1)
-			password = getopt.Arg(2)
-			pin = getopt.Arg(3)
-			url = getopt.Arg(4)
+		p, err := askProfile(getopt.Args()[1:])
+		if err != nil {
+			PrintError(err.Error())
 		}
 
-		err := initConfig(username, password, pin, url)
+		err = profileAdd(profileName, p)
 		if err != nil {
 			PrintError("failed to write config file:", err.Error())
 		}
-	case "download":
+	case "profile":
 		if getopt.NArgs() < 2 {
-			PrintError("Missing Torrent-ID")
+			profileUsage()
+			break
+		}
+
+		subcommand := getopt.Arg(1)
+		if subcommand != "list" && getopt.NArgs() < 3 {
+			profileUsage()
+			PrintError("Missing profile name")
+		}
+
+		switch subcommand {
+		case "list":
+			err = profileList()
+		case "add":
+			var p Profile
+			p, err = askProfile(getopt.Args()[3:])
+			if err != nil {
+				PrintError(err.Error())
+			}
+			err = profileAdd(getopt.Arg(2), p)
+		case "remove":
+			err = profileRemove(getopt.Arg(2))
+		case "default":
+			err = profileDefault(getopt.Arg(2))
+		default:
+			profileUsage()
 		}
-		tid, err := strconv.ParseInt(getopt.Arg(1), 10, 64)
 		if err != nil {
-			PrintError("TID is not a valid ID")
+			PrintError(err.Error())
 		}
+	case "download":
+		tids := make([]int64, 0)
 		dest := ""
-		if getopt.NArgs() > 2 {
-			dest = getopt.Arg(2)
+		for _, arg := range getopt.Args()[1:] {
+			if !isTidArg(arg) {
+				if dest != "" {
+					PrintError("TID is not a valid ID:", dest)
+				}
+				dest = arg
+				continue
+			}
+			parsed, err := parseTidArg(arg)
+			if err != nil {
+				PrintError(err.Error())
+			}
+			tids = append(tids, parsed...)
+		}
+		if *fromFileOpt != "" {
+			parsed, err := readTidFile(*fromFileOpt)
+			if err != nil {
+				PrintError(err.Error())
+			}
+			tids = append(tids, parsed...)
+		}
+		if len(tids) == 0 {
+			PrintError("Missing Torrent-ID")
+		}
+		if *clientOpt != "" {
+			if _, err := newTorrentClient(*clientOpt); err != nil {
+				PrintError(err.Error())
+			}
+		}
+
+		if len(tids) == 1 && *fromFileOpt == "" {
+			err = download(tids[0], dest)
+		} else {
+			if dest != "" && strings.HasSuffix(dest, ".torrent") {
+				PrintError("destination must be a directory when downloading several torrents")
+			}
+			err = downloadBatch(tids, dest)
+		}
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "create":
+		if getopt.NArgs() < 2 {
+			PrintError("Missing path")
 		}
-		err = download(tid, dest)
+		err = create(getopt.Arg(1), getopt.Arg(2))
 		if err != nil {
 			PrintError(err.Error())
 		}
+	case "validate":
+		*dryRunFlag = true
+		fallthrough
 	case "upload":
-		if getopt.NArgs() < 5 {
-			PrintError("Missing parameters")
+		if *manifestOpt != "" {
+			err = uploadManifests(*manifestOpt, *resultsOpt)
+			if err != nil {
+				PrintError(err.Error())
+			}
+			break
 		}
 
-		meta := getopt.Arg(1)
-		nfo := getopt.Arg(2)
-		description := getopt.Arg(3)
-		image1 := getopt.Arg(4)
-		image2 := ""
-		if getopt.NArgs() > 5 {
-			image2 = getopt.Arg(5)
+		// with --from the torrent is created and not passed as the first argument
+		args := getopt.Args()[1:]
+		if *fromOpt != "" {
+			args = append([]string{""}, args...)
 		}
-		name := ""
-		if *nameOpt != "" {
-			name = *nameOpt
-		} else {
-			name = filepath.Base(meta)
+
+		m := &uploadManifest{
+			From:         *fromOpt,
+			ContactSheet: *contactSheetOpt,
+			Name:         *nameOpt,
+			Category:     strings.Join(*categoryOpt, ","),
 		}
-		category, err := strconv.ParseInt((*categoryOpt)[0], 10, 32)
-		if err != nil {
-			PrintError(err.Error())
+		fields := []*string{&m.Torrent, &m.Nfo, &m.Description}
+		for i, arg := range args {
+			if i < len(fields) {
+				*fields[i] = arg
+			} else {
+				m.Images = append(m.Images, arg)
+			}
 		}
 
-		err = upload(meta, nfo, image1, image2, name, description, int(category))
+		if *interactiveFlag {
+			err = uploadWizard(m)
+			if err != nil {
+				PrintError(err.Error())
+			}
+			break
+		}
+
+		if len(args) < 4 {
+			PrintError("Missing parameters")
+		}
+		if m.Name == "" {
+			if m.From != "" {
+				m.Name = filepath.Base(filepath.Clean(m.From))
+			} else {
+				m.Name = filepath.Base(m.Torrent)
+			}
+		}
+
+		err = upload(m)
 		if err != nil {
 			PrintError(err.Error())
 		}
@@ -165,13 +325,9 @@ func main() {
 			PrintError("Missing Search string")
 		}
 		needle := strings.Join(getopt.Args()[1:], " ")
-		categories := make([]int, 0)
-		for _, c := range *categoryOpt {
-			ci, err := strconv.ParseInt(c, 10, 32)
-			if err != nil {
-				continue
-			}
-			categories = append(categories, int(ci))
+		categories, err := resolveCategories(*categoryOpt)
+		if err != nil {
+			PrintError(err.Error())
 		}
 
 		err = search(needle, categories, *deadFlag)
@@ -196,6 +352,7 @@ func main() {
 
 			fmt.Println("\tall")
 			fmt.Println("\t\tShow all informations")
+			fmt.Println("\t\tWith --format, files, peers and snatches use the templates {{define \"files\"}}, {{define \"peers\"}} and {{define \"snatches\"}}")
 			break
 		}
 
@@ -286,21 +443,270 @@ func main() {
 				PrintError(err.Error())
 			}
 		}
+	case "message":
+		if getopt.NArgs() < 2 {
+			messageUsage()
+			break
+		}
+
+		subcommand := getopt.Arg(1)
+		id := int64(0)
+		if subcommand == "read" || subcommand == "reply" || subcommand == "delete" {
+			if getopt.NArgs() < 3 {
+				messageUsage()
+				PrintError("Missing Message-ID")
+			}
+			id, err = strconv.ParseInt(getopt.Arg(2), 10, 64)
+			if err != nil {
+				PrintError("Message-ID is not a valid ID")
+			}
+		}
+
+		switch subcommand {
+		case "list":
+			err = messageList()
+		case "read":
+			err = messageRead(id)
+		case "send":
+			if getopt.NArgs() < 4 {
+				messageUsage()
+				PrintError("Too few parameters")
+			}
+			err = messageSend(getopt.Arg(2), strings.Join(getopt.Args()[3:], " "))
+		case "reply":
+			err = messageReply(id)
+		case "delete":
+			err = messageDelete(id)
+		default:
+			messageUsage()
+		}
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "config":
+		switch getopt.Arg(1) {
+		case "migrate-secrets":
+			err = migrateSecrets()
+		default:
+			fmt.Println("config subcommand")
+			fmt.Println("\tmigrate-secrets")
+			fmt.Println("\t\tMove the passwords and pins from the config file into the encrypted vault")
+		}
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "agent":
+		switch getopt.Arg(1) {
+		case "start":
+			ttl := time.Hour
+			if getopt.NArgs() > 2 {
+				ttl, err = time.ParseDuration(getopt.Arg(2))
+				if err != nil {
+					PrintError("ttl is not a valid duration")
+				}
+			}
+			err = agentStart(ttl)
+		case "forget":
+			err = agentForget()
+		case "stop":
+			err = agentStop()
+		default:
+			agentUsage()
+		}
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "session":
+		switch getopt.Arg(1) {
+		case "status":
+			err = sessionStatus()
+		default:
+			fmt.Println("session subcommand")
+			fmt.Println("\tstatus")
+			fmt.Println("\t\tShow the user, Uid and age of the current session and whether the site still accepts it")
+		}
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "contactsheet":
+		if getopt.NArgs() < 3 {
+			PrintError("Missing parameters")
+		}
+		err = contactSheet(getopt.Arg(1), getopt.Args()[2:])
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "mediainfo":
+		if getopt.NArgs() < 2 {
+			PrintError("Missing path")
+		}
+		err = mediainfo(getopt.Arg(1), *bbcodeFlag)
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "description":
+		switch getopt.Arg(1) {
+		case "render":
+			err = descriptionShow(false, getopt.Args()[2:])
+		case "preview":
+			err = descriptionShow(true, getopt.Args()[2:])
+		default:
+			descriptionUsage()
+		}
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "client":
+		switch getopt.Arg(1) {
+		case "list":
+			err = clientList()
+		case "add":
+			if getopt.NArgs() < 4 {
+				PrintError("Missing parameters")
+			}
+			err = clientAdd(getopt.Arg(2), getopt.Args()[3:])
+		default:
+			clientUsage()
+		}
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "index":
+		switch getopt.Arg(1) {
+		case "sync":
+			var categories []int
+			categories, err = resolveCategories(*categoryOpt)
+			if err == nil {
+				err = indexSync(categories, *limitOpt)
+			}
+		case "search":
+			var categories []int
+			categories, err = resolveCategories(*categoryOpt)
+			if err == nil {
+				err = indexSearch(strings.Join(getopt.Args()[2:], " "), categories)
+			}
+		case "status":
+			err = indexStatus()
+		default:
+			indexUsage()
+		}
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "verify":
+		if getopt.NArgs() < 3 {
+			PrintError("Missing parameters")
+		}
+		err = verify(getopt.Arg(1), getopt.Arg(2))
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "crossseed":
+		if getopt.NArgs() < 2 {
+			PrintError("Missing directory")
+		}
+		categories, err := resolveCategories(*categoryOpt)
+		if err != nil {
+			PrintError(err.Error())
+		}
+
+		err = crossseed(getopt.Arg(1), categories)
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "watch":
+		switch getopt.Arg(1) {
+		case "add":
+			if getopt.NArgs() < 4 {
+				PrintError("Missing parameters")
+			}
+			err = watchAdd(getopt.Arg(2), WatchConfig{
+				Query:      strings.Join(getopt.Args()[3:], " "),
+				Category:   *categoryOpt,
+				Dead:       *deadFlag,
+				Download:   *downloadFlag,
+				Dest:       *destOpt,
+				MinSize:    *minSizeOpt,
+				MaxSize:    *maxSizeOpt,
+				MinSeeders: *minSeedersOpt,
+				Regex:      *regexOpt,
+			})
+		case "remove":
+			if getopt.NArgs() < 3 {
+				PrintError("Missing watch name")
+			}
+			err = watchRemove(getopt.Arg(2))
+		case "list":
+			err = watchList()
+		case "run":
+			err = watchRun(getopt.Args()[2:])
+		case "daemon":
+			err = watchDaemon(*intervalOpt, getopt.Args()[2:])
+		default:
+			watchUsage()
+		}
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "logout":
+		err = logout()
+		if err != nil {
+			PrintError(err.Error())
+		}
+	case "categories":
+		err = categories()
+		if err != nil {
+			PrintError(err.Error())
+		}
 	case "commands":
 		fallthrough
 	default:
 		fmt.Println("commands:")
 		fmt.Println("\tinit [username] [password] [pin] [url]")
-		fmt.Println("\t\tInitialize the config file")
+		fmt.Println("\t\tInitialize the config file or update the selected profile")
+
+		fmt.Println("\tprofile <subcommand>")
+		fmt.Println("\t\tManage account profiles")
+
+		fmt.Println("\tdownload [-j jobs] [--force] [--from-file file] [--name-template template] [--client name] <tid|from-to>... [destination]")
+		fmt.Println("\t\tDownload torrent files")
+
+		fmt.Println("\tupload [--dry-run] [--allow-dupe] [--contact-sheet images] -c category [-n name] <torrent> <nfo> <description> <image1> [image2]")
+		fmt.Println("\tupload -c category [-n name] --from <path> [--piece-size size] <nfo> <description> <image1> [image2]")
+		fmt.Println("\tupload [--dry-run] --manifest <file|directory> [--results file] [--force]")
+		fmt.Println("\tupload --interactive [--dry-run] [upload arguments]")
+		fmt.Println("\t\tUpload a torrent file, create it from a file or directory, upload the releases of manifests, or be asked for every field")
+
+		fmt.Println("\tvalidate <upload arguments>")
+		fmt.Println("\t\tCheck an upload without contacting the site, same as upload --dry-run")
+
+		fmt.Println("\tdescription <subcommand>")
+		fmt.Println("\t\tRender description templates and Markdown to BBCode")
+
+		fmt.Println("\tcontactsheet [--sheet-columns n] [--force] <output> <image>...")
+		fmt.Println("\t\tCombine images into a contact sheet")
+
+		fmt.Println("\tmediainfo [--bbcode] <file|directory>")
+		fmt.Println("\t\tShow the format, duration, codecs and tracks of MKV, MP4, FLAC and MP3 files")
+
+		fmt.Println("\tcreate [--announce url] [--piece-size size] [--force] <path> [torrent]")
+		fmt.Println("\t\tCreate a private torrent from a file or directory")
 
-		fmt.Println("\tdownload <tid> [destination]")
-		fmt.Println("\t\tDownload a torrent file")
+		fmt.Println("\tsearch [-c category] [-d] [--download [--select rows] [--dest dir]] <search>")
+		fmt.Println("\tsearch [--sort order] [--reverse] [--min-size size] [--max-size size] [--since age] [--min-seeders n] [--regex re] [--limit n] [--columns list] <search>")
+		fmt.Println("\t\tSearch for torrents, and optionally download some of the results")
 
-		fmt.Println("\tupload -c category [-n name] <torrent> <nfo> <description> <image1> [image2]")
-		fmt.Println("\t\tUpload a torrent file")
+		fmt.Println("\tverify <tid|torrent> <path>")
+		fmt.Println("\t\tCheck that the data of a torrent is complete and intact, <path> is the data or the directory containing it")
 
-		fmt.Println("\tsearch [-c category] [-d] <search>")
-		fmt.Println("\t\tSearch for torrents")
+		fmt.Println("\tcrossseed [-c category] [--download [--select rows] [--dest dir] [--client name]] <directory>")
+		fmt.Println("\t\tFind torrents on the site for the release files and directories in <directory>, to seed them")
+
+		fmt.Println("\tindex <subcommand>")
+		fmt.Println("\t\tLocal index of the torrents for fast offline searches")
+
+		fmt.Println("\twatch <subcommand>")
+		fmt.Println("\t\tSaved searches which report and download new torrents")
 
 		fmt.Println("\tdetails <tid> <subcommand>")
 		fmt.Println("\t\tShow the details of a torrent")
@@ -317,64 +723,109 @@ func main() {
 		fmt.Println("\tmessage <subcommand>")
 		fmt.Println("\t\tMessage commands")
 
+		fmt.Println("\tsession status")
+		fmt.Println("\t\tShow the current session")
+
+		fmt.Println("\tlogout")
+		fmt.Println("\t\tLog out on the site and forget the current session")
+
+		fmt.Println("\tcategories")
+		fmt.Println("\t\tList the torrent categories. -c accepts IDs, names, prefixes and groups")
+
+		fmt.Println("\tconfig migrate-secrets")
+		fmt.Println("\t\tMove the secrets into the encrypted vault")
+
+		fmt.Println("\tclient <subcommand>")
+		fmt.Println("\t\tBitTorrent clients which receive downloads")
+
+		fmt.Println("\tagent <subcommand>")
+		fmt.Println("\t\tPassphrase cache for the vault")
+
 		fmt.Println("\tcommands")
 		fmt.Println("\t\tPrint this command list")
 	}
 
-	if connection.GetCookies().Uid > 0 {
-		dumpCookies(connection.GetCookies())
+	if err := saveSession(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save the session: %s\n", err.Error())
 	}
 }
 
-// Initialize and write the config
-func initConfig(username, password, pin, url string) error {
-	config.Username = username
-	config.Password = password
-	config.Pin = pin
-	config.Url = url
-
-	return dumpConfig(config, configFile)
-}
-
 // Print a line to stdout if the verbose flag is set.
 // It returns the number of bytes written and any write error encountered.
 func PrintVerbose(a ...interface{}) (n int, err error) {
 	if *verboseFlag {
-		return fmt.Println(a)
+		if machineOutput() {
+			return fmt.Fprintln(os.Stderr, a...)
+		}
+		return fmt.Println(a...)
 	}
 
 	return 0, nil
 }
 
 // Print a line to stdout if the quiet flag is not set.
+// With a machine readable output format the line goes to stderr, to keep stdout parseable.
 // It returns the number of bytes written and any write error encountered.
 func PrintQuiet(a ...interface{}) (n int, err error) {
-	if !*quietFlag {
-		fmt.Println(a)
+	if *quietFlag {
+		return 0, nil
+	}
+	if machineOutput() {
+		return fmt.Fprintln(os.Stderr, a...)
 	}
 
-	return 0, nil
+	return fmt.Println(a...)
 }
 
 // Print a line to stderr and exit with status 1
+// With a machine readable output format the error is written as a JSON object.
 func PrintError(a ...interface{}) {
-	fmt.Fprintln(os.Stderr, a)
+	if machineOutput() {
+		message := strings.TrimSuffix(fmt.Sprintln(a...), "\n")
+		json.NewEncoder(os.Stderr).Encode(map[string]string{"error": message})
+	} else {
+		fmt.Fprintln(os.Stderr, a...)
+	}
 	os.Exit(1)
 }
 
+// Check whether a command talks to the site
+func needsConnection(command string, subcommand string) bool {
+	if offlineCommands[command] || (command == "upload" && *dryRunFlag) {
+		return false
+	}
+	// torrent files are verified offline, Torrent-IDs are downloaded
+	if command == "verify" {
+		return verifyNeedsConnection(subcommand)
+	}
+	if online, ok := onlineSubcommands[command]; ok {
+		for _, name := range online {
+			if name == subcommand {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
 // Ask the user for some input
 //  prompt: Prompt/Question for the user
 //  result: Input from the user
-// It returns any error encountered.
+// It returns an error if stdin ends before a line is read, e.g. on Ctrl-D, and any other error encountered.
 func Ask(prompt string, result *string) error {
 	fmt.Printf("%s: ", prompt)
 	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Scan()
-	*result = scanner.Text()
-
-	if scanner.Err() != nil {
-		return scanner.Err()
+	if !scanner.Scan() {
+		*result = ""
+		if scanner.Err() != nil {
+			return scanner.Err()
+		}
+		fmt.Println()
+		return fmt.Errorf("aborted")
 	}
+	*result = scanner.Text()
 
 	return nil
 }
@@ -393,3 +844,46 @@ func AskFor(prompt string, result *string) error {
 
 	return nil
 }
+
+// Read a longer text from the user
+// If stdin is not a terminal, the text is read from stdin. Otherwise $EDITOR is
+// opened with initial as the content.
+//  initial: Initial content of the editor
+// It returns the text and any error encountered.
+func ReadText(initial string) (string, error) {
+	stat, err := os.Stdin.Stat()
+	if err != nil {
+		return "", err
+	}
+	if stat.Mode()&os.ModeCharDevice == 0 {
+		text, err := ioutil.ReadAll(os.Stdin)
+		return string(text), err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+
+	file, err := ioutil.TempFile("", "irrenhaus-cli")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(initial); err != nil {
+		file.Close()
+		return "", err
+	}
+	file.Close()
+
+	cmd := exec.Command(editor, file.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	text, err := ioutil.ReadFile(file.Name())
+	return string(text), err
+}
@@ -0,0 +1,394 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Suffix of results files, which are skipped when reading a directory of manifests
+const manifestResultsSuffix = ".results.yaml"
+
+// Upload manifest, one release per file
+// Relative paths are relative to the directory of the manifest.
+//  torrent: Release.torrent    # or from: Release/ to create the torrent
+//  nfo: Release.nfo
+//  description: description.txt
+//  images: [cover.jpg, screen.jpg]    # or images: [cover.jpg] and contact_sheet: [s1.png, s2.png]
+//  name: Release
+//  category: filme
+//  vars: {source: BluRay}
+type uploadManifest struct {
+	Torrent     string   `yaml:"torrent"`
+	From        string   `yaml:"from"`
+	Nfo         string   `yaml:"nfo"`
+	Description string   `yaml:"description"`
+	Images      []string `yaml:"images"`
+	// images combined into a contact sheet, which becomes the second image
+	ContactSheet []string `yaml:"contact_sheet"`
+	Name         string   `yaml:"name"`
+	Category     string   `yaml:"category"`
+	// variables of description templates
+	Vars map[string]string `yaml:"vars"`
+
+	// path of the manifest file
+	file       string
+	categoryId int
+}
+
+// Outcome of a manifest upload, written to the results file
+type manifestResult struct {
+	// path of the manifest relative to the results file
+	Manifest string `yaml:"manifest" json:"manifest"`
+	Name     string `yaml:"name" json:"name"`
+	Status   string `yaml:"status" json:"status"`
+	Id       int64  `yaml:"id,omitempty" json:"id,omitempty"`
+	Url      string `yaml:"url,omitempty" json:"url,omitempty"`
+	Error    string `yaml:"error,omitempty" json:"error,omitempty"`
+	Time     string `yaml:"time,omitempty" json:"time,omitempty"`
+}
+
+// Find the manifests of a file or directory
+// It returns the manifest paths and any error encountered.
+func manifestFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, manifestResultsSuffix) {
+			continue
+		}
+		if ext := strings.ToLower(filepath.Ext(name)); ext == ".yaml" || ext == ".yml" {
+			files = append(files, filepath.Join(path, name))
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no manifests (*.yaml, *.yml) in %s", path)
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// Get the default results file for a manifest file or directory
+func manifestResultsPath(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return filepath.Join(path, "upload"+manifestResultsSuffix)
+	}
+
+	return strings.TrimSuffix(path, filepath.Ext(path)) + manifestResultsSuffix
+}
+
+// Get the key of a manifest in a results file
+// The key is the path of the manifest relative to the results file, so it does not depend on the
+// working directory or the spelling of the path on the command line.
+func manifestResultKey(resultsPath string, file string) string {
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return filepath.ToSlash(filepath.Clean(file))
+	}
+	absResults, err := filepath.Abs(resultsPath)
+	if err != nil {
+		return filepath.ToSlash(absFile)
+	}
+	rel, err := filepath.Rel(filepath.Dir(absResults), absFile)
+	if err != nil {
+		return filepath.ToSlash(absFile)
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+// Read a manifest and make its paths absolute
+// It returns the manifest and any error encountered.
+func loadManifest(file string) (*uploadManifest, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &uploadManifest{file: file}
+	if err := yaml.UnmarshalStrict(content, m); err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(file)
+	resolve := func(path string) string {
+		if path == "" || filepath.IsAbs(path) {
+			return path
+		}
+		return filepath.Join(dir, path)
+	}
+	m.Torrent = resolve(m.Torrent)
+	m.From = resolve(m.From)
+	m.Nfo = resolve(m.Nfo)
+	m.Description = resolve(m.Description)
+	for i := range m.Images {
+		m.Images[i] = resolve(m.Images[i])
+	}
+	for i := range m.ContactSheet {
+		m.ContactSheet[i] = resolve(m.ContactSheet[i])
+	}
+
+	if m.Name == "" {
+		if m.From != "" {
+			m.Name = filepath.Base(filepath.Clean(m.From))
+		} else if meta, err := loadTorrent(m.Torrent); err == nil {
+			m.Name = meta.Name
+		}
+	}
+
+	return m, nil
+}
+
+// Read previous results, so manifests which were uploaded already are skipped
+func loadManifestResults(path string) ([]manifestResult, error) {
+	results := make([]manifestResult, 0)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return results, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(content, &results); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	return results, nil
+}
+
+// Merge the results of a run into the previous results
+// Results of the same manifest are replaced in place, new ones are appended.
+func mergeManifestResults(previous []manifestResult, current []manifestResult) []manifestResult {
+	merged := make([]manifestResult, len(previous), len(previous)+len(current))
+	copy(merged, previous)
+	index := make(map[string]int, len(previous))
+	for i, result := range previous {
+		index[result.Manifest] = i
+	}
+
+	for _, result := range current {
+		if i, ok := index[result.Manifest]; ok {
+			merged[i] = result
+			continue
+		}
+		index[result.Manifest] = len(merged)
+		merged = append(merged, result)
+	}
+
+	return merged
+}
+
+// Write the results of a run, keeping the results of manifests which were not part of it
+func dumpManifestResults(path string, previous []manifestResult, results []manifestResult) error {
+	content, err := yaml.Marshal(mergeManifestResults(previous, results))
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, content, 0644)
+}
+
+// Upload a single manifest
+// It returns the Torrent-ID and any error encountered.
+func uploadRelease(m *uploadManifest) (int64, error) {
+	if err := checkDupes(m); err != nil {
+		return 0, err
+	}
+
+	meta := m.Torrent
+	if m.From != "" {
+		created, err := createForUpload(m.From)
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(created)
+		meta = created
+	}
+
+	images, err := prepareUploadImages(m)
+	if err != nil {
+		return 0, err
+	}
+
+	description, err := renderDescription(m.Description, m)
+	if err != nil {
+		return 0, err
+	}
+
+	return uploadTorrent(meta, m.Nfo, images, m.Name, description, m.categoryId)
+}
+
+// Prepare the images of an upload, including the contact sheet
+// It returns one or two images and any error encountered.
+func prepareUploadImages(m *uploadManifest) ([]*preparedImage, error) {
+	images := make([]*preparedImage, 0, 2)
+	for _, path := range m.Images {
+		image, err := prepareImage(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err.Error())
+		}
+		images = append(images, image)
+	}
+	if len(m.ContactSheet) > 0 {
+		sheet, err := prepareContactSheet(m.ContactSheet)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, sheet)
+	}
+	for i, image := range images {
+		if len(image.Changes) > 0 {
+			PrintVerbose(fmt.Sprintf("Image %d: %s", i+1, image))
+		}
+	}
+
+	return images, nil
+}
+
+// Validate and upload manifests
+//  path:        Manifest file or directory of manifests
+//  resultsPath: File for the results, defaults to a .results.yaml next to the manifests
+// It returns any error encountered.
+func uploadManifests(path string, resultsPath string) error {
+	files, err := manifestFiles(path)
+	if err != nil {
+		return err
+	}
+	if resultsPath == "" {
+		resultsPath = manifestResultsPath(path)
+	}
+
+	// every manifest has to be valid before the first upload
+	manifests := make([]*uploadManifest, 0, len(files))
+	reports := make([][]validationCheck, 0, len(files))
+	invalid := 0
+	for _, file := range files {
+		var checks []validationCheck
+		m, err := loadManifest(file)
+		if err != nil {
+			checks = []validationCheck{{Check: "manifest", Detail: err.Error()}}
+		} else {
+			checks = validateUpload(m)
+			manifests = append(manifests, m)
+		}
+		reports = append(reports, checks)
+		if failedChecks(checks) > 0 {
+			invalid++
+		}
+		if !*dryRunFlag {
+			for _, check := range checks {
+				if !check.Ok {
+					fmt.Fprintf(os.Stderr, "%s: %s: %s\n", file, check.Check, check.Detail)
+				}
+			}
+		}
+	}
+	if *dryRunFlag {
+		if err := printValidation(files, reports); err != nil {
+			return err
+		}
+		if invalid > 0 {
+			return fmt.Errorf("%d of %d manifests are invalid", invalid, len(files))
+		}
+		PrintQuiet(len(files), "manifests are valid. Dry run, nothing was uploaded")
+		return nil
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d manifests are invalid, nothing was uploaded", invalid, len(files))
+	}
+
+	previousList, err := loadManifestResults(resultsPath)
+	if err != nil {
+		return err
+	}
+	previous := make(map[string]manifestResult, len(previousList))
+	for _, result := range previousList {
+		previous[result.Manifest] = result
+	}
+
+	results := make([]manifestResult, 0, len(manifests))
+	skipped := 0
+	failed := make([]string, 0)
+	for i, m := range manifests {
+		progress := fmt.Sprintf("[%d/%d]", i+1, len(manifests))
+		key := manifestResultKey(resultsPath, m.file)
+		if result, ok := previous[key]; ok && result.Status == "ok" && !*forceFlag {
+			skipped++
+			PrintQuiet(progress, m.Name, "skipped, uploaded already as", result.Url)
+			results = append(results, result)
+			continue
+		}
+
+		PrintVerbose(progress, "Uploading", m.Name)
+		result := manifestResult{Manifest: key, Name: m.Name, Status: "ok", Time: time.Now().Format(time.RFC3339)}
+		id, err := uploadRelease(m)
+		if err != nil {
+			result.Status = "failed"
+			result.Error = err.Error()
+			failed = append(failed, m.file)
+			fmt.Fprintln(os.Stderr, progress, m.Name, "failed:", err.Error())
+		} else {
+			result.Id = id
+			result.Url = detailsURL(id)
+			PrintQuiet(progress, m.Name, "->", result.Url)
+		}
+		results = append(results, result)
+
+		// written after every upload, so an interrupted run keeps its progress
+		if err := dumpManifestResults(resultsPath, previousList, results); err != nil {
+			return err
+		}
+	}
+
+	if *outputOpt != OutputTable {
+		if err := Render(Output{Data: results}); err != nil {
+			return err
+		}
+	}
+
+	PrintQuiet(fmt.Sprintf("%d uploaded, %d skipped, %d failed. Results in %s",
+		len(results)-skipped-len(failed), skipped, len(failed), resultsPath))
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to upload: %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
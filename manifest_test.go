@@ -0,0 +1,96 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifestResultsMerge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uploads"+manifestResultsSuffix)
+	first := []manifestResult{
+		{Manifest: "a.yaml", Name: "A", Status: "ok", Id: 1},
+		{Manifest: "b.yaml", Name: "B", Status: "failed", Error: "timeout"},
+	}
+	if err := dumpManifestResults(path, nil, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// a second run with a subset of the manifests keeps the results of the others
+	previous, err := loadManifestResults(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := []manifestResult{
+		{Manifest: "b.yaml", Name: "B", Status: "ok", Id: 2},
+		{Manifest: "c.yaml", Name: "C", Status: "ok", Id: 3},
+	}
+	if err := dumpManifestResults(path, previous, second); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := loadManifestResults(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []manifestResult{first[0], second[0], second[1]}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("results = %+v, want %+v", results, want)
+	}
+}
+
+func TestManifestResultKeyRerun(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// the first run is started in the directory of the manifests
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	resultsPath := manifestResultsPath("a.yaml")
+	first := []manifestResult{{Manifest: manifestResultKey(resultsPath, "./a.yaml"), Name: "A", Status: "ok", Id: 1}}
+	if err := dumpManifestResults(resultsPath, nil, first); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rerun spells the same manifest differently, from another directory
+	if err := os.Chdir(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"../a.yaml", "./../sub/../a.yaml", filepath.Join(dir, "a.yaml")} {
+		resultsPath := manifestResultsPath(file)
+		previous, err := loadManifestResults(resultsPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(previous) != 1 || previous[0].Manifest != manifestResultKey(resultsPath, file) {
+			t.Errorf("%s: key %q does not match the previous results %+v", file, manifestResultKey(resultsPath, file), previous)
+		}
+	}
+}
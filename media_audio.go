@@ -0,0 +1,218 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+// MP3 bitrates in kbit/s by version (MPEG-1, MPEG-2 and 2.5), layer and index
+var mp3Bitrates = [2][3][16]int{
+	{
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+	},
+	{
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+	},
+}
+
+// MP3 sample rates by version bits and index
+var mp3SampleRates = map[byte][3]int{
+	3: {44100, 48000, 32000},
+	2: {22050, 24000, 16000},
+	0: {11025, 12000, 8000},
+}
+
+// How far to look for the first MP3 frame after the ID3 tag
+const mp3SyncWindow = 64 << 10
+
+// Get the size of an ID3v2 tag at the start of data, including its header
+func id3v2Size(data []byte) int64 {
+	if len(data) < 10 || string(data[:3]) != "ID3" {
+		return 0
+	}
+	// the size is a syncsafe integer, 7 bits per byte
+	size := int64(data[6])<<21 | int64(data[7])<<14 | int64(data[8])<<7 | int64(data[9])
+	if data[5]&0x10 != 0 {
+		size += 10
+	}
+
+	return size + 10
+}
+
+// Read the STREAMINFO block of a FLAC file
+func parseFLAC(file *os.File, fileSize int64, info *mediaInfo) error {
+	header := make([]byte, 10)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return errNotMedia
+	}
+	offset := id3v2Size(header)
+	magic := make([]byte, 4+4+34)
+	if _, err := file.ReadAt(magic, offset); err != nil || string(magic[:4]) != "fLaC" {
+		return errNotMedia
+	}
+	if magic[4]&0x7F != 0 {
+		return errors.New("flac: STREAMINFO is not the first metadata block")
+	}
+	block := magic[8:]
+
+	sampleRate := int(block[10])<<12 | int(block[11])<<4 | int(block[12])>>4
+	channels := int(block[12]>>1&0x07) + 1
+	bitDepth := int(block[12]&0x01)<<4 | int(block[13]>>4) + 1
+	samples := int64(block[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(block[14:]))
+
+	info.Format = "FLAC"
+	track := mediaTrack{Type: TrackAudio, Codec: "FLAC", Channels: channels, SampleRate: sampleRate, BitDepth: bitDepth}
+	if sampleRate > 0 && samples > 0 {
+		info.Duration = secondsToDuration(float64(samples) / float64(sampleRate))
+		track.Bitrate = int64(float64(fileSize-offset) * 8 / info.Duration.Seconds())
+	}
+	info.Tracks = []mediaTrack{track}
+
+	return nil
+}
+
+type mp3Frame struct {
+	// version bits: 3 MPEG-1, 2 MPEG-2, 0 MPEG-2.5
+	version    byte
+	layer      int
+	bitrate    int
+	sampleRate int
+	channels   int
+	// samples per frame
+	samples int
+}
+
+// Parse an MP3 frame header
+func parseMP3Header(header []byte) (mp3Frame, bool) {
+	var frame mp3Frame
+	if len(header) < 4 || header[0] != 0xFF || header[1]&0xE0 != 0xE0 {
+		return frame, false
+	}
+	frame.version = header[1] >> 3 & 0x03
+	layerBits := header[1] >> 1 & 0x03
+	bitrateIndex := header[2] >> 4
+	rateIndex := header[2] >> 2 & 0x03
+	if frame.version == 1 || layerBits == 0 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return frame, false
+	}
+
+	frame.layer = 4 - int(layerBits)
+	table := 0
+	if frame.version != 3 {
+		table = 1
+	}
+	frame.bitrate = mp3Bitrates[table][frame.layer-1][bitrateIndex] * 1000
+	frame.sampleRate = mp3SampleRates[frame.version][rateIndex]
+	frame.channels = 2
+	if header[3]>>6 == 3 {
+		frame.channels = 1
+	}
+	switch {
+	case frame.layer == 1:
+		frame.samples = 384
+	case frame.layer == 3 && frame.version != 3:
+		frame.samples = 576
+	default:
+		frame.samples = 1152
+	}
+
+	return frame, true
+}
+
+// Find the first frame of an MP3 file and read the Xing or VBRI header for variable bitrates
+func parseMP3(file *os.File, fileSize int64, info *mediaInfo) error {
+	header := make([]byte, 10)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return errNotMedia
+	}
+	offset := id3v2Size(header)
+
+	window := make([]byte, mp3SyncWindow)
+	n, err := file.ReadAt(window, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	window = window[:n]
+
+	var frame mp3Frame
+	position := -1
+	for i := 0; i+4 <= len(window); i++ {
+		if f, ok := parseMP3Header(window[i:]); ok {
+			frame = f
+			position = i
+			break
+		}
+	}
+	if position < 0 {
+		return errNotMedia
+	}
+	start := offset + int64(position)
+	end := fileSize
+	tag := make([]byte, 3)
+	if _, err := file.ReadAt(tag, fileSize-128); err == nil && string(tag) == "TAG" {
+		end -= 128
+	}
+
+	// the Xing header follows the side information, VBRI always starts at 32
+	sideInfo := 32
+	if frame.version == 3 && frame.channels == 1 || frame.version != 3 && frame.channels == 2 {
+		sideInfo = 17
+	} else if frame.version != 3 {
+		sideInfo = 9
+	}
+	frames := uint32(0)
+	data := window[position:]
+	if xing := 4 + sideInfo; len(data) >= xing+12 {
+		if magic := data[xing : xing+4]; bytes.Equal(magic, []byte("Xing")) || bytes.Equal(magic, []byte("Info")) {
+			if binary.BigEndian.Uint32(data[xing+4:])&0x01 != 0 {
+				frames = binary.BigEndian.Uint32(data[xing+8:])
+			}
+		}
+	}
+	if vbri := 4 + 32; frames == 0 && len(data) >= vbri+18 && bytes.Equal(data[vbri:vbri+4], []byte("VBRI")) {
+		frames = binary.BigEndian.Uint32(data[vbri+14:])
+	}
+
+	codec := "MP3"
+	if frame.layer != 3 {
+		codec = []string{"", "MP1", "MP2"}[frame.layer]
+	}
+	track := mediaTrack{Type: TrackAudio, Codec: codec, Channels: frame.channels, SampleRate: frame.sampleRate}
+	if frames > 0 {
+		seconds := float64(frames) * float64(frame.samples) / float64(frame.sampleRate)
+		info.Duration = secondsToDuration(seconds)
+		track.Bitrate = int64(float64(end-start) * 8 / seconds)
+	} else {
+		track.Bitrate = int64(frame.bitrate)
+		info.Duration = secondsToDuration(float64(end-start) * 8 / float64(frame.bitrate))
+	}
+	info.Format = "MPEG Audio"
+	info.Tracks = []mediaTrack{track}
+
+	return nil
+}
@@ -0,0 +1,145 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Build an ID3v2 tag with size bytes of padding
+func testID3(size int) []byte {
+	tag := []byte{'I', 'D', '3', 3, 0, 0, byte(size >> 21 & 0x7F), byte(size >> 14 & 0x7F), byte(size >> 7 & 0x7F), byte(size & 0x7F)}
+
+	return append(tag, make([]byte, size)...)
+}
+
+// Build a FLAC file of 10 seconds of 44.1 kHz 16 bit stereo
+func testFLAC() []byte {
+	data := []byte{'f', 'L', 'a', 'C', 0x80, 0, 0, 34}
+	streamInfo := make([]byte, 34)
+	binary.BigEndian.PutUint64(streamInfo[10:], 44100<<44|(2-1)<<41|(16-1)<<36|441000)
+	data = append(data, streamInfo...)
+
+	return append(data, make([]byte, 1000)...)
+}
+
+// Build an MP3 file of 125 frames of 128 kbit/s 44.1 kHz stereo with ID3 tags
+//  xing: Number of frames in a Xing header, 0 for none
+func testMP3WithXing(xing uint32) []byte {
+	frame := make([]byte, 417)
+	copy(frame, []byte{0xFF, 0xFB, 0x90, 0x00})
+	first := append([]byte(nil), frame...)
+	if xing > 0 {
+		copy(first[36:], "Xing")
+		binary.BigEndian.PutUint32(first[40:], 1)
+		binary.BigEndian.PutUint32(first[44:], xing)
+	}
+
+	data := append(testID3(0), first...)
+	data = append(data, bytes.Repeat(frame, 124)...)
+	tag := make([]byte, 128)
+	copy(tag, "TAG")
+
+	return append(data, tag...)
+}
+
+func testMP3() []byte {
+	return testMP3WithXing(0)
+}
+
+func TestParseAudio(t *testing.T) {
+	flac := testFLAC()
+	tests := []struct {
+		name     string
+		data     []byte
+		format   string
+		duration time.Duration
+		track    mediaTrack
+	}{
+		{"a.flac", flac, "FLAC", 10 * time.Second,
+			mediaTrack{Type: TrackAudio, Codec: "FLAC", Channels: 2, SampleRate: 44100, BitDepth: 16, Bitrate: int64(len(flac)) * 8 / 10}},
+		{"a.flac", append(testID3(20), flac...), "FLAC", 10 * time.Second,
+			mediaTrack{Type: TrackAudio, Codec: "FLAC", Channels: 2, SampleRate: 44100, BitDepth: 16, Bitrate: int64(len(flac)) * 8 / 10}},
+		{"a.mp3", testMP3(), "MPEG Audio", 3257812500,
+			mediaTrack{Type: TrackAudio, Codec: "MP3", Channels: 2, SampleRate: 44100, Bitrate: 128000}},
+		// 1764 frames of 1152 samples are 46.08 seconds
+		{"a.mp3", testMP3WithXing(1764), "MPEG Audio", 46080 * time.Millisecond,
+			mediaTrack{Type: TrackAudio, Codec: "MP3", Channels: 2, SampleRate: 44100, Bitrate: 9049}},
+	}
+
+	for _, test := range tests {
+		info, err := testMediaInfo(t, test.name, test.data)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if info.Format != test.format || info.Duration != test.duration {
+			t.Errorf("%s: format %s, duration %s, want %s, %s", test.name, info.Format, info.Duration, test.format, test.duration)
+		}
+		if !reflect.DeepEqual(info.Tracks, []mediaTrack{test.track}) {
+			t.Errorf("%s: tracks = %+v, want %+v", test.name, info.Tracks, test.track)
+		}
+	}
+}
+
+func TestParseAudioInvalid(t *testing.T) {
+	streamInfoSecond := testFLAC()
+	streamInfoSecond[4] = 0x01
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"a.flac", nil},
+		{"a.flac", []byte("OggS")},
+		{"a.flac", streamInfoSecond},
+		{"a.flac", append(testID3(100), 'f', 'L', 'a', 'C')},
+		{"a.mp3", nil},
+		{"a.mp3", make([]byte, 4096)},
+		{"a.mp3", testID3(1 << 20)[:64]},
+		// reserved version, free and invalid bitrates, reserved sample rate
+		{"a.mp3", []byte{0xFF, 0xEB, 0x90, 0x00, 0, 0, 0, 0}},
+		{"a.mp3", []byte{0xFF, 0xFB, 0x00, 0x00, 0, 0, 0, 0}},
+		{"a.mp3", []byte{0xFF, 0xFB, 0xF0, 0x00, 0, 0, 0, 0}},
+		{"a.mp3", []byte{0xFF, 0xFB, 0x9C, 0x00, 0, 0, 0, 0}},
+	}
+
+	for i, test := range tests {
+		if info, err := testMediaInfo(t, test.name, test.data); err == nil {
+			t.Errorf("%d %s: parsed as %+v, want an error", i, test.name, info)
+		}
+	}
+}
+
+func TestParseAudioTruncated(t *testing.T) {
+	// the STREAMINFO block and the first frame header are needed
+	fixtures := map[string][]byte{"a.flac": testFLAC()[:42], "a.mp3": testMP3()[:14]}
+
+	for name, data := range fixtures {
+		for i := 0; i < len(data); i++ {
+			if info, err := testMediaInfo(t, name, data[:i]); err == nil {
+				t.Errorf("%s truncated to %d bytes: parsed as %+v, want an error", name, i, info)
+			}
+		}
+	}
+}
@@ -0,0 +1,328 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+)
+
+// Matroska element IDs, see https://www.matroska.org/technical/elements.html
+const (
+	ebmlHeaderID          = 0x1A45DFA3
+	mkvSegmentID          = 0x18538067
+	mkvInfoID             = 0x1549A966
+	mkvTimecodeScaleID    = 0x2AD7B1
+	mkvDurationID         = 0x4489
+	mkvTracksID           = 0x1654AE6B
+	mkvTrackEntryID       = 0xAE
+	mkvTrackTypeID        = 0x83
+	mkvCodecID            = 0x86
+	mkvLanguageID         = 0x22B59C
+	mkvLanguageIETFID     = 0x22B59D
+	mkvNameID             = 0x536E
+	mkvDefaultDurationID  = 0x23E383
+	mkvVideoID            = 0xE0
+	mkvPixelWidthID       = 0xB0
+	mkvPixelHeightID      = 0xBA
+	mkvAudioID            = 0xE1
+	mkvSamplingFrequency  = 0xB5
+	mkvChannelsID         = 0x9F
+	mkvBitDepthID         = 0x6264
+	mkvClusterID          = 0x1F43B675
+	mkvTrackTypeVideo     = 1
+	mkvTrackTypeAudio     = 2
+	mkvTrackTypeSubtitle  = 0x11
+	maxMatroskaHeaderSize = 16 << 20
+)
+
+// Readable names of Matroska codec IDs, prefixes are matched for the ones ending in /
+var matroskaCodecs = map[string]string{
+	"V_MPEG4/ISO/AVC": "AVC", "V_MPEGH/ISO/HEVC": "HEVC", "V_AV1": "AV1", "V_VP9": "VP9", "V_VP8": "VP8",
+	"V_MPEG2": "MPEG-2", "V_MPEG4/ISO/ASP": "MPEG-4 Visual", "V_MS/VFW/FOURCC": "VfW", "V_THEORA": "Theora",
+	"A_AC3": "AC-3", "A_EAC3": "E-AC-3", "A_DTS": "DTS", "A_TRUEHD": "TrueHD", "A_FLAC": "FLAC", "A_OPUS": "Opus",
+	"A_VORBIS": "Vorbis", "A_MPEG/L3": "MP3", "A_MPEG/L2": "MP2", "A_AAC": "AAC", "A_AAC/": "AAC", "A_PCM/": "PCM",
+	"S_TEXT/UTF8": "SRT", "S_TEXT/ASS": "ASS", "S_TEXT/SSA": "SSA", "S_ASS": "ASS", "S_SSA": "SSA",
+	"S_HDMV/PGS": "PGS", "S_VOBSUB": "VobSub", "S_TEXT/WEBVTT": "WebVTT", "S_DVBSUB": "DVB",
+}
+
+// Marker for elements with an unknown size, e.g. segments written by live encoders
+const ebmlUnknownSize = -1
+
+// Decode an EBML variable length integer
+//  keepMarker: Keep the length marker bit, as in element IDs
+// It returns the value and its length, or a length of 0 for invalid data.
+func ebmlVint(data []byte, keepMarker bool) (int64, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+	length := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if len(data) < length {
+		return 0, 0
+	}
+
+	value := int64(data[0])
+	if !keepMarker {
+		value &= int64(0xFF >> uint(length))
+	}
+	allOnes := value == int64(0xFF>>uint(length))
+	for _, b := range data[1:length] {
+		value = value<<8 | int64(b)
+		allOnes = allOnes && b == 0xFF
+	}
+	if !keepMarker && allOnes {
+		return ebmlUnknownSize, length
+	}
+
+	return value, length
+}
+
+// Call fn for every element in data
+func ebmlElements(data []byte, fn func(id int64, payload []byte)) {
+	for len(data) > 0 {
+		id, idLength := ebmlVint(data, true)
+		if idLength == 0 {
+			return
+		}
+		size, sizeLength := ebmlVint(data[idLength:], false)
+		if sizeLength == 0 {
+			return
+		}
+		start := idLength + sizeLength
+		if size == ebmlUnknownSize || int64(len(data)-start) < size {
+			size = int64(len(data) - start)
+		}
+		fn(id, data[start:start+int(size)])
+		data = data[start+int(size):]
+	}
+}
+
+func ebmlUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+
+	return value
+}
+
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+
+	return 0
+}
+
+// Read the header of the element at the current position
+// It returns the ID, the size of the payload and any error encountered.
+func ebmlReadHeader(r io.Reader) (int64, int64, error) {
+	var buffer [16]byte
+	if _, err := io.ReadFull(r, buffer[:1]); err != nil {
+		return 0, 0, err
+	}
+	idLength := 1
+	for mask := byte(0x80); buffer[0]&mask == 0 && idLength <= 4; mask >>= 1 {
+		idLength++
+	}
+	if idLength > 4 {
+		return 0, 0, errors.New("matroska: invalid element ID")
+	}
+	if _, err := io.ReadFull(r, buffer[1:idLength+1]); err != nil {
+		return 0, 0, err
+	}
+	sizeLength := 1
+	for mask := byte(0x80); buffer[idLength]&mask == 0 && sizeLength <= 8; mask >>= 1 {
+		sizeLength++
+	}
+	if sizeLength > 8 {
+		return 0, 0, errors.New("matroska: invalid element size")
+	}
+	if _, err := io.ReadFull(r, buffer[idLength+1:idLength+sizeLength]); err != nil {
+		return 0, 0, err
+	}
+
+	id, _ := ebmlVint(buffer[:idLength], true)
+	size, _ := ebmlVint(buffer[idLength:idLength+sizeLength], false)
+
+	return id, size, nil
+}
+
+// Read the segment info and tracks of a Matroska or WebM file
+func parseMatroska(file *os.File, info *mediaInfo) error {
+	id, size, err := ebmlReadHeader(file)
+	if err != nil || id != ebmlHeaderID || size == ebmlUnknownSize {
+		return errNotMedia
+	}
+	if _, err := file.Seek(size, io.SeekCurrent); err != nil {
+		return err
+	}
+	id, _, err = ebmlReadHeader(file)
+	if err != nil || id != mkvSegmentID {
+		return errors.New("matroska: missing segment")
+	}
+	info.Format = "Matroska"
+
+	timecodeScale := 1000000.0
+	var duration float64
+	haveInfo, haveTracks := false, false
+	// the info and the tracks are in front of the clusters in almost every file, the clusters are never read
+	for !(haveInfo && haveTracks) {
+		id, size, err := ebmlReadHeader(file)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if size == ebmlUnknownSize {
+			if id == mkvClusterID {
+				break
+			}
+			continue
+		}
+
+		switch id {
+		case mkvInfoID, mkvTracksID:
+			if size > maxMatroskaHeaderSize {
+				return errors.New("matroska: header element too large")
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(file, data); err != nil {
+				return err
+			}
+			if id == mkvInfoID {
+				haveInfo = true
+				ebmlElements(data, func(id int64, payload []byte) {
+					switch id {
+					case mkvTimecodeScaleID:
+						timecodeScale = float64(ebmlUint(payload))
+					case mkvDurationID:
+						duration = ebmlFloat(payload)
+					}
+				})
+			} else {
+				haveTracks = true
+				ebmlElements(data, func(id int64, payload []byte) {
+					if id == mkvTrackEntryID {
+						if track, ok := parseMatroskaTrack(payload); ok {
+							info.Tracks = append(info.Tracks, track)
+						}
+					}
+				})
+			}
+		default:
+			if _, err := file.Seek(size, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+	}
+	if !haveTracks {
+		return errors.New("matroska: no tracks found")
+	}
+
+	info.Duration = secondsToDuration(duration * timecodeScale / 1e9)
+
+	return nil
+}
+
+func parseMatroskaTrack(data []byte) (mediaTrack, bool) {
+	track := mediaTrack{Language: "eng"}
+	var trackType uint64
+	ebmlElements(data, func(id int64, payload []byte) {
+		switch id {
+		case mkvTrackTypeID:
+			trackType = ebmlUint(payload)
+		case mkvCodecID:
+			track.Codec = matroskaCodecName(string(payload))
+		case mkvLanguageID:
+			track.Language = string(payload)
+		case mkvLanguageIETFID:
+			track.Language = string(payload)
+		case mkvNameID:
+			track.Title = string(payload)
+		case mkvDefaultDurationID:
+			if ns := ebmlUint(payload); ns > 0 {
+				track.FrameRate = 1e9 / float64(ns)
+			}
+		case mkvVideoID:
+			ebmlElements(payload, func(id int64, payload []byte) {
+				switch id {
+				case mkvPixelWidthID:
+					track.Width = int(ebmlUint(payload))
+				case mkvPixelHeightID:
+					track.Height = int(ebmlUint(payload))
+				}
+			})
+		case mkvAudioID:
+			track.SampleRate = 8000
+			track.Channels = 1
+			ebmlElements(payload, func(id int64, payload []byte) {
+				switch id {
+				case mkvSamplingFrequency:
+					track.SampleRate = int(ebmlFloat(payload))
+				case mkvChannelsID:
+					track.Channels = int(ebmlUint(payload))
+				case mkvBitDepthID:
+					track.BitDepth = int(ebmlUint(payload))
+				}
+			})
+		}
+	})
+
+	switch trackType {
+	case mkvTrackTypeVideo:
+		track.Type = TrackVideo
+	case mkvTrackTypeAudio:
+		track.Type = TrackAudio
+		// the frame rate of audio tracks is the packet rate, which nobody wants to see
+		track.FrameRate = 0
+	case mkvTrackTypeSubtitle:
+		track.Type = TrackSubtitle
+	default:
+		return track, false
+	}
+	if track.Language == "und" {
+		track.Language = ""
+	}
+
+	return track, true
+}
+
+func matroskaCodecName(codecID string) string {
+	if name, ok := matroskaCodecs[codecID]; ok {
+		return name
+	}
+	for prefix, name := range matroskaCodecs {
+		if prefix[len(prefix)-1] == '/' && len(codecID) > len(prefix) && codecID[:len(prefix)] == prefix {
+			return name
+		}
+	}
+
+	return codecID
+}
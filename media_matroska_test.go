@@ -0,0 +1,150 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Encode an EBML element with an 8 byte size
+func ebml(id uint32, payload ...[]byte) []byte {
+	var data []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> uint(shift)); b != 0 || len(data) > 0 {
+			data = append(data, b)
+		}
+	}
+	size := 0
+	for _, p := range payload {
+		size += len(p)
+	}
+	sizeBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(sizeBytes, uint64(size))
+	sizeBytes[0] = 0x01
+	data = append(data, sizeBytes...)
+	for _, p := range payload {
+		data = append(data, p...)
+	}
+
+	return data
+}
+
+func ebmlUintBytes(value uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, value)
+
+	return data
+}
+
+func ebmlFloatBytes(value float64) []byte {
+	return ebmlUintBytes(math.Float64bits(value))
+}
+
+// Build a Matroska file with a video and an audio track
+func testMatroska() []byte {
+	data := ebml(ebmlHeaderID, ebml(0x4282, []byte("matroska")))
+
+	return append(data, ebml(mkvSegmentID,
+		ebml(mkvInfoID,
+			ebml(mkvTimecodeScaleID, ebmlUintBytes(1000000)),
+			ebml(mkvDurationID, ebmlFloatBytes(90000)),
+		),
+		ebml(mkvTracksID,
+			ebml(mkvTrackEntryID,
+				ebml(mkvTrackTypeID, ebmlUintBytes(mkvTrackTypeVideo)),
+				ebml(mkvCodecID, []byte("V_MPEG4/ISO/AVC")),
+				ebml(mkvDefaultDurationID, ebmlUintBytes(40000000)),
+				ebml(mkvVideoID, ebml(mkvPixelWidthID, ebmlUintBytes(1920)), ebml(mkvPixelHeightID, ebmlUintBytes(1080))),
+			),
+			ebml(mkvTrackEntryID,
+				ebml(mkvTrackTypeID, ebmlUintBytes(mkvTrackTypeAudio)),
+				ebml(mkvCodecID, []byte("A_AC3")),
+				ebml(mkvLanguageID, []byte("ger")),
+				ebml(mkvNameID, []byte("Surround")),
+				ebml(mkvAudioID, ebml(mkvSamplingFrequency, ebmlFloatBytes(48000)), ebml(mkvChannelsID, ebmlUintBytes(6))),
+			),
+			ebml(mkvTrackEntryID,
+				ebml(mkvTrackTypeID, ebmlUintBytes(mkvTrackTypeSubtitle)),
+				ebml(mkvCodecID, []byte("S_TEXT/UTF8")),
+				ebml(mkvLanguageID, []byte("und")),
+			),
+		),
+		ebml(mkvClusterID, make([]byte, 64)),
+	)...)
+}
+
+func TestParseMatroska(t *testing.T) {
+	info, err := testMediaInfo(t, "movie.mkv", testMatroska())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Format != "Matroska" || info.Duration != 90*time.Second {
+		t.Errorf("format %s, duration %s, want Matroska, 1m30s", info.Format, info.Duration)
+	}
+	want := []mediaTrack{
+		{Type: TrackVideo, Codec: "AVC", Language: "eng", Width: 1920, Height: 1080, FrameRate: 25},
+		{Type: TrackAudio, Codec: "AC-3", Language: "ger", Title: "Surround", Channels: 6, SampleRate: 48000},
+		{Type: TrackSubtitle, Codec: "SRT"},
+	}
+	if !reflect.DeepEqual(info.Tracks, want) {
+		t.Errorf("tracks = %+v, want %+v", info.Tracks, want)
+	}
+}
+
+func TestParseMatroskaInvalid(t *testing.T) {
+	header := ebml(ebmlHeaderID, ebml(0x4282, []byte("matroska")))
+	segment := []byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not matroska", []byte("RIFF....AVI LIST")},
+		{"invalid element ID", []byte{0x00, 0x00, 0x00, 0x00, 0x00}},
+		{"invalid element size", []byte{0x1A, 0x45, 0xDF, 0xA3, 0x00}},
+		{"missing segment", append(header, ebml(mkvInfoID)...)},
+		{"no tracks", append(append(header, segment...), ebml(mkvInfoID, ebml(mkvDurationID, ebmlFloatBytes(1)))...)},
+		{"tracks too large", append(append(header, segment...), 0x16, 0x54, 0xAE, 0x6B, 0x01, 0x00, 0x00, 0x00, 0x7F, 0xFF, 0xFF, 0xFF)},
+		{"tracks exceed file", append(append(header, segment...), 0x16, 0x54, 0xAE, 0x6B, 0x84, 0xAE, 0x82)},
+	}
+
+	for _, test := range tests {
+		if info, err := testMediaInfo(t, "movie.mkv", test.data); err == nil {
+			t.Errorf("%s: parsed as %+v, want an error", test.name, info)
+		}
+	}
+}
+
+func TestParseMatroskaTruncated(t *testing.T) {
+	data := testMatroska()
+	// everything in front of the clusters is needed
+	end := len(data) - len(ebml(mkvClusterID, make([]byte, 64)))
+
+	for i := 0; i < end; i++ {
+		if info, err := testMediaInfo(t, "movie.mkv", data[:i]); err == nil {
+			t.Errorf("truncated to %d bytes: parsed as %+v, want an error", i, info)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Largest moov box read into memory
+const maxMP4MovieSize = 64 << 20
+
+// Readable names of MP4 sample entry types
+var mp4Codecs = map[string]string{
+	"avc1": "AVC", "avc3": "AVC", "hev1": "HEVC", "hvc1": "HEVC", "av01": "AV1", "vp09": "VP9",
+	"mp4v": "MPEG-4 Visual", "mp4a": "AAC", "ac-3": "AC-3", "ec-3": "E-AC-3", "alac": "ALAC",
+	"fLaC": "FLAC", "Opus": "Opus", ".mp3": "MP3", "dtsc": "DTS", "dtsh": "DTS-HD",
+	"tx3g": "Timed Text", "wvtt": "WebVTT", "stpp": "TTML", "c608": "CEA-608",
+}
+
+// Top level boxes which may come before the moov box
+var mp4TopLevelBoxes = map[string]bool{
+	"ftyp": true, "moov": true, "mdat": true, "free": true, "skip": true, "wide": true, "pdin": true,
+	"uuid": true, "meta": true, "styp": true, "sidx": true, "moof": true, "mfra": true,
+}
+
+// Call fn for every box in data
+func mp4Boxes(data []byte, fn func(kind string, payload []byte)) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		kind := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return
+		}
+		fn(kind, data[header:size])
+		data = data[size:]
+	}
+}
+
+// Find the moov box and read the movie header and the tracks
+func parseMP4(file *os.File, fileSize int64, info *mediaInfo) error {
+	var position int64
+	header := make([]byte, 16)
+	for position+8 <= fileSize {
+		if _, err := file.ReadAt(header[:8], position); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		kind := string(header[4:8])
+		headerSize := int64(8)
+		if !mp4TopLevelBoxes[kind] {
+			if position == 0 {
+				return errNotMedia
+			}
+			return errors.New("mp4: invalid box " + kind)
+		}
+		switch size {
+		case 0:
+			size = fileSize - position
+		case 1:
+			if _, err := file.ReadAt(header[8:16], position+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:]))
+			headerSize = 16
+		}
+		if size < headerSize {
+			return errors.New("mp4: invalid box size")
+		}
+
+		if kind == "moov" {
+			if size > maxMP4MovieSize {
+				return errors.New("mp4: moov box too large")
+			}
+			movie := make([]byte, size-headerSize)
+			n, err := file.ReadAt(movie, position+headerSize)
+			if n < len(movie) {
+				return errors.New("mp4: truncated moov box")
+			}
+			if err != nil && err != io.EOF {
+				return err
+			}
+			info.Format = "MPEG-4"
+			parseMP4Movie(movie, info)
+			return nil
+		}
+		position += size
+	}
+
+	return errors.New("mp4: no moov box found")
+}
+
+func parseMP4Movie(data []byte, info *mediaInfo) {
+	mp4Boxes(data, func(kind string, payload []byte) {
+		switch kind {
+		case "mvhd":
+			if timescale, duration, ok := mp4Timing(payload, 12, 20); ok {
+				info.Duration = secondsToDuration(float64(duration) / float64(timescale))
+			}
+		case "trak":
+			if track, ok := parseMP4Track(payload); ok {
+				info.Tracks = append(info.Tracks, track)
+			}
+		}
+	})
+}
+
+// Read the timescale and duration of a mvhd or mdhd box
+//  offset0: Offset of the timescale in version 0 boxes
+//  offset1: Offset of the timescale in version 1 boxes, which have 64 bit times
+func mp4Timing(payload []byte, offset0 int, offset1 int) (uint32, uint64, bool) {
+	if len(payload) < 4 {
+		return 0, 0, false
+	}
+	if payload[0] == 1 {
+		if len(payload) < offset1+12 {
+			return 0, 0, false
+		}
+		return binary.BigEndian.Uint32(payload[offset1:]), binary.BigEndian.Uint64(payload[offset1+4:]), binary.BigEndian.Uint32(payload[offset1:]) > 0
+	}
+	if len(payload) < offset0+8 {
+		return 0, 0, false
+	}
+	timescale := binary.BigEndian.Uint32(payload[offset0:])
+
+	return timescale, uint64(binary.BigEndian.Uint32(payload[offset0+4:])), timescale > 0
+}
+
+func parseMP4Track(data []byte) (mediaTrack, bool) {
+	var track mediaTrack
+	var handler string
+	var seconds float64
+	var samples uint32
+	var sampleBytes uint64
+
+	var walk func(data []byte)
+	walk = func(data []byte) {
+		mp4Boxes(data, func(kind string, payload []byte) {
+			switch kind {
+			case "mdia", "minf", "stbl":
+				walk(payload)
+			case "tkhd":
+				// width and height are 16.16 fixed point numbers at the end
+				if len(payload) >= 84 {
+					track.Width = int(binary.BigEndian.Uint32(payload[len(payload)-8:]) >> 16)
+					track.Height = int(binary.BigEndian.Uint32(payload[len(payload)-4:]) >> 16)
+				}
+			case "mdhd":
+				timescale, duration, ok := mp4Timing(payload, 12, 20)
+				if ok {
+					seconds = float64(duration) / float64(timescale)
+				}
+				languageOffset := 20
+				if len(payload) > 0 && payload[0] == 1 {
+					languageOffset = 32
+				}
+				if len(payload) >= languageOffset+2 {
+					track.Language = mp4Language(binary.BigEndian.Uint16(payload[languageOffset:]))
+				}
+			case "hdlr":
+				if len(payload) >= 12 {
+					handler = string(payload[8:12])
+				}
+			case "stsd":
+				parseMP4SampleEntry(payload, &track)
+			case "stsz":
+				if len(payload) < 12 {
+					return
+				}
+				size := binary.BigEndian.Uint32(payload[4:])
+				samples = binary.BigEndian.Uint32(payload[8:])
+				if size != 0 {
+					sampleBytes = uint64(size) * uint64(samples)
+					return
+				}
+				for i := 12; i+4 <= len(payload); i += 4 {
+					sampleBytes += uint64(binary.BigEndian.Uint32(payload[i:]))
+				}
+			}
+		})
+	}
+	walk(data)
+
+	switch handler {
+	case "vide":
+		track.Type = TrackVideo
+		track.Channels, track.BitDepth, track.SampleRate = 0, 0, 0
+		if seconds > 0 {
+			track.FrameRate = float64(samples) / seconds
+		}
+	case "soun":
+		track.Type = TrackAudio
+		track.Width, track.Height = 0, 0
+	case "sbtl", "subt", "text", "clcp":
+		track.Type = TrackSubtitle
+		track.Width, track.Height = 0, 0
+		track.Channels, track.BitDepth, track.SampleRate = 0, 0, 0
+	default:
+		return track, false
+	}
+	if seconds > 0 {
+		track.Bitrate = int64(float64(sampleBytes*8) / seconds)
+	}
+
+	return track, true
+}
+
+// Read the codec, and the details of audio tracks, from the first sample entry
+func parseMP4SampleEntry(payload []byte, track *mediaTrack) {
+	// version, flags and the entry count come first
+	if len(payload) < 16 {
+		return
+	}
+	entry := payload[8:]
+	size := binary.BigEndian.Uint32(entry)
+	kind := string(entry[4:8])
+	if name, ok := mp4Codecs[kind]; ok {
+		track.Codec = name
+	} else {
+		track.Codec = strings.TrimSpace(kind)
+	}
+
+	// audio sample entries have the channel count at 24, the sample size at 26 and a 16.16 sample rate at 32
+	if int(size) <= len(entry) && len(entry) >= 36 {
+		track.Channels = int(binary.BigEndian.Uint16(entry[24:]))
+		track.BitDepth = int(binary.BigEndian.Uint16(entry[26:]))
+		track.SampleRate = int(binary.BigEndian.Uint32(entry[32:]) >> 16)
+	}
+}
+
+// Decode the packed ISO 639-2 language of a mdhd box
+func mp4Language(packed uint16) string {
+	if packed == 0 || packed == 0x7FFF {
+		return ""
+	}
+	language := string([]byte{
+		byte(packed>>10&0x1F) + 0x60,
+		byte(packed>>5&0x1F) + 0x60,
+		byte(packed&0x1F) + 0x60,
+	})
+	if language == "und" {
+		return ""
+	}
+
+	return language
+}
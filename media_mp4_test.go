@@ -0,0 +1,144 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Encode an MP4 box
+func mp4Box(kind string, payload ...[]byte) []byte {
+	data := make([]byte, 8)
+	copy(data[4:], kind)
+	for _, p := range payload {
+		data = append(data, p...)
+	}
+	binary.BigEndian.PutUint32(data, uint32(len(data)))
+
+	return data
+}
+
+// Encode big endian fields, uint16 and uint32 values are written with their size
+func mp4Fields(values ...interface{}) []byte {
+	var buffer bytes.Buffer
+	for _, value := range values {
+		switch v := value.(type) {
+		case uint16, uint32:
+			binary.Write(&buffer, binary.BigEndian, v)
+		case string:
+			buffer.WriteString(v)
+		case []byte:
+			buffer.Write(v)
+		}
+	}
+
+	return buffer.Bytes()
+}
+
+// Build a track with the timing of a mdhd box and the first sample entry
+func testMP4Track(handler string, entry []byte, width uint32, height uint32, samples uint32) []byte {
+	tkhd := append(make([]byte, 76), mp4Fields(width<<16, height<<16)...)
+	mdhd := mp4Fields(uint32(0), uint32(0), uint32(0), uint32(1000), uint32(60000), uint16(5<<10|14<<5|7), uint16(0))
+	hdlr := mp4Fields(uint32(0), uint32(0), handler, make([]byte, 12))
+	stsd := mp4Fields(uint32(0), uint32(1), entry)
+	stsz := mp4Fields(uint32(0), uint32(1000), samples)
+
+	return mp4Box("trak",
+		mp4Box("tkhd", tkhd),
+		mp4Box("mdia",
+			mp4Box("mdhd", mdhd),
+			mp4Box("hdlr", hdlr),
+			mp4Box("minf", mp4Box("stbl", mp4Box("stsd", stsd), mp4Box("stsz", stsz))),
+		),
+	)
+}
+
+// Build an MP4 file with a video and an audio track
+func testMP4() []byte {
+	video := mp4Fields(uint32(86), "avc1", make([]byte, 78))
+	audio := mp4Fields(uint32(36), "mp4a", make([]byte, 16), uint16(2), uint16(16), uint32(0), uint32(44100<<16))
+	mvhd := mp4Fields(uint32(0), uint32(0), uint32(0), uint32(600), uint32(36000), make([]byte, 80))
+
+	data := mp4Box("ftyp", mp4Fields("isom", uint32(512), "isomavc1"))
+	data = append(data, mp4Box("moov",
+		mp4Box("mvhd", mvhd),
+		testMP4Track("vide", video, 1280, 720, 1500),
+		testMP4Track("soun", audio, 0, 0, 2584),
+	)...)
+
+	return append(data, mp4Box("mdat", make([]byte, 64))...)
+}
+
+func TestParseMP4(t *testing.T) {
+	info, err := testMediaInfo(t, "movie.mp4", testMP4())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Format != "MPEG-4" || info.Duration != time.Minute {
+		t.Errorf("format %s, duration %s, want MPEG-4, 1m0s", info.Format, info.Duration)
+	}
+	want := []mediaTrack{
+		{Type: TrackVideo, Codec: "AVC", Language: "eng", Width: 1280, Height: 720, FrameRate: 25, Bitrate: 200000},
+		{Type: TrackAudio, Codec: "AAC", Language: "eng", Channels: 2, BitDepth: 16, SampleRate: 44100, Bitrate: 344533},
+	}
+	if !reflect.DeepEqual(info.Tracks, want) {
+		t.Errorf("tracks = %+v, want %+v", info.Tracks, want)
+	}
+}
+
+func TestParseMP4Invalid(t *testing.T) {
+	ftyp := mp4Box("ftyp", mp4Fields("isom", uint32(512)))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not mp4", []byte("RIFF....AVI LIST")},
+		{"no moov", append(ftyp, mp4Box("mdat", make([]byte, 16))...)},
+		{"unknown top level box", append(ftyp, mp4Box("junk")...)},
+		{"box smaller than its header", append(ftyp, 0, 0, 0, 4, 'm', 'o', 'o', 'v')},
+		{"64 bit size smaller than its header", append(ftyp, mp4Fields(uint32(1), "moov", uint32(0), uint32(8))...)},
+		{"moov too large", append(ftyp, mp4Fields(uint32(1), "moov", uint32(1), uint32(0))...)},
+		{"moov exceeds file", append(ftyp, mp4Fields(uint32(4096), "moov", make([]byte, 32))...)},
+	}
+
+	for _, test := range tests {
+		if info, err := testMediaInfo(t, "movie.mp4", test.data); err == nil {
+			t.Errorf("%s: parsed as %+v, want an error", test.name, info)
+		}
+	}
+}
+
+func TestParseMP4Truncated(t *testing.T) {
+	data := testMP4()
+	// the file is usable up to the end of the moov box
+	end := len(data) - len(mp4Box("mdat", make([]byte, 64)))
+
+	for i := 0; i < end; i++ {
+		if info, err := testMediaInfo(t, "movie.mp4", data[:i]); err == nil {
+			t.Errorf("truncated to %d bytes: parsed as %+v, want an error", i, info)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// Track types
+const (
+	TrackVideo    = "video"
+	TrackAudio    = "audio"
+	TrackSubtitle = "subtitle"
+)
+
+// Returned by the parsers for files which are not in their format
+var errNotMedia = errors.New("not a supported media file")
+
+// Parsers by file extension
+var mediaParsers = map[string]func(file *os.File, size int64, info *mediaInfo) error{
+	".mkv":  func(f *os.File, _ int64, info *mediaInfo) error { return parseMatroska(f, info) },
+	".mka":  func(f *os.File, _ int64, info *mediaInfo) error { return parseMatroska(f, info) },
+	".mks":  func(f *os.File, _ int64, info *mediaInfo) error { return parseMatroska(f, info) },
+	".webm": func(f *os.File, _ int64, info *mediaInfo) error { return parseMatroska(f, info) },
+	".mp4":  parseMP4,
+	".m4v":  parseMP4,
+	".m4a":  parseMP4,
+	".mov":  parseMP4,
+	".flac": parseFLAC,
+	".mp3":  parseMP3,
+}
+
+// A video, audio or subtitle track
+type mediaTrack struct {
+	Type     string `json:"type"`
+	Codec    string `json:"codec"`
+	Language string `json:"language,omitempty"`
+	Title    string `json:"title,omitempty"`
+	// bit/s, 0 if unknown
+	Bitrate    int64   `json:"bitrate,omitempty"`
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	FrameRate  float64 `json:"frame_rate,omitempty"`
+	Channels   int     `json:"channels,omitempty"`
+	SampleRate int     `json:"sample_rate,omitempty"`
+	BitDepth   int     `json:"bit_depth,omitempty"`
+}
+
+// Container metadata of a media file
+type mediaInfo struct {
+	File     string        `json:"file"`
+	Format   string        `json:"format"`
+	Size     int64         `json:"size"`
+	Duration time.Duration `json:"duration"`
+	// overall bit/s
+	Bitrate int64        `json:"bitrate"`
+	Tracks  []mediaTrack `json:"tracks"`
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Check if a file has the extension of a supported media format
+func isMediaFile(path string) bool {
+	_, ok := mediaParsers[strings.ToLower(filepath.Ext(path))]
+
+	return ok
+}
+
+// Read the metadata of a media file
+// It returns the metadata and any error encountered.
+func readMediaInfo(path string) (*mediaInfo, error) {
+	parse, ok := mediaParsers[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		return nil, fmt.Errorf("%s: %s", path, errNotMedia.Error())
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &mediaInfo{File: filepath.Base(path), Size: stat.Size()}
+	if err := parse(file, stat.Size(), info); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if info.Duration > 0 {
+		info.Bitrate = int64(float64(info.Size*8) / info.Duration.Seconds())
+	}
+
+	return info, nil
+}
+
+// Read the metadata of a media file or of all media files in a directory
+// It returns the metadata, ordered by path, and any error encountered.
+func collectMediaInfo(path string) ([]*mediaInfo, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !stat.IsDir() {
+		info, err := readMediaInfo(path)
+		if err != nil {
+			return nil, err
+		}
+		return []*mediaInfo{info}, nil
+	}
+
+	paths := make([]string, 0)
+	err = filepath.Walk(path, func(file string, stat os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if stat.Mode().IsRegular() && isMediaFile(file) {
+			paths = append(paths, file)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	infos := make([]*mediaInfo, 0, len(paths))
+	for _, file := range paths {
+		info, err := readMediaInfo(file)
+		if err != nil {
+			// one broken sample should not hide the main file
+			PrintVerbose("Skipping", err.Error())
+			continue
+		}
+		infos = append(infos, info)
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("no media files in %s", path)
+	}
+
+	return infos, nil
+}
+
+// Format a duration as h:mm:ss
+func formatMediaDuration(d time.Duration) string {
+	seconds := int64(d.Seconds() + 0.5)
+
+	return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+func formatBitrate(bitrate int64) string {
+	if bitrate >= 10000000 {
+		return fmt.Sprintf("%.1f Mb/s", float64(bitrate)/1e6)
+	}
+
+	return fmt.Sprintf("%d kb/s", (bitrate+500)/1000)
+}
+
+// Describe a track in one line, e.g. "AC-3, 6 channels, 48 kHz, 640 kb/s, ger"
+func describeTrack(track mediaTrack) string {
+	parts := []string{track.Codec}
+	if track.Width > 0 && track.Height > 0 {
+		parts = append(parts, fmt.Sprintf("%dx%d", track.Width, track.Height))
+	}
+	if track.FrameRate > 0 {
+		parts = append(parts, strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.3f", track.FrameRate), "0"), ".")+" fps")
+	}
+	if track.Channels > 0 {
+		parts = append(parts, fmt.Sprintf("%d channels", track.Channels))
+	}
+	if track.SampleRate > 0 {
+		parts = append(parts, strings.TrimSuffix(fmt.Sprintf("%.1f", float64(track.SampleRate)/1000), ".0")+" kHz")
+	}
+	if track.BitDepth > 0 && track.Type == TrackAudio {
+		parts = append(parts, fmt.Sprintf("%d bit", track.BitDepth))
+	}
+	if track.Bitrate > 0 {
+		parts = append(parts, formatBitrate(track.Bitrate))
+	}
+	if track.Language != "" {
+		parts = append(parts, track.Language)
+	}
+	if track.Title != "" {
+		parts = append(parts, `"`+track.Title+`"`)
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// Get the label/value rows of a media file, subtitles share one row
+func mediaRows(info *mediaInfo) [][]string {
+	rows := [][]string{
+		{"Format", info.Format},
+		{"Size", datasize.ByteSize(info.Size).HumanReadable()},
+	}
+	if info.Duration > 0 {
+		rows = append(rows, []string{"Duration", formatMediaDuration(info.Duration)})
+		rows = append(rows, []string{"Bitrate", formatBitrate(info.Bitrate)})
+	}
+
+	counts := make(map[string]int)
+	for _, track := range info.Tracks {
+		counts[track.Type]++
+	}
+	numbers := make(map[string]int)
+	subtitles := make([]string, 0)
+	for _, track := range info.Tracks {
+		if track.Type == TrackSubtitle {
+			subtitle := track.Codec
+			if track.Language != "" {
+				subtitle = track.Language + " (" + track.Codec + ")"
+			}
+			subtitles = append(subtitles, subtitle)
+			continue
+		}
+		label := strings.Title(track.Type)
+		if counts[track.Type] > 1 {
+			numbers[track.Type]++
+			label += fmt.Sprintf(" #%d", numbers[track.Type])
+		}
+		rows = append(rows, []string{label, describeTrack(track)})
+	}
+	if len(subtitles) > 0 {
+		rows = append(rows, []string{"Subtitles", strings.Join(subtitles, ", ")})
+	}
+
+	return rows
+}
+
+// Render the metadata as BBCode tables for upload descriptions
+func mediaInfoBBCode(infos []*mediaInfo) string {
+	var builder strings.Builder
+	for i, info := range infos {
+		if i > 0 {
+			builder.WriteString("\n")
+		}
+		builder.WriteString("[b]" + info.File + "[/b]\n[table]\n")
+		for _, row := range mediaRows(info) {
+			fmt.Fprintf(&builder, "[tr][td][b]%s[/b][/td][td]%s[/td][/tr]\n", row[0], row[1])
+		}
+		builder.WriteString("[/table]\n")
+	}
+
+	return builder.String()
+}
+
+// Show the metadata of media files
+//  path:   Media file or directory
+//  bbcode: Print the BBCode for the description instead
+// It returns any error encountered.
+func mediainfo(path string, bbcode bool) error {
+	infos, err := collectMediaInfo(path)
+	if err != nil {
+		return err
+	}
+	if bbcode {
+		fmt.Print(mediaInfoBBCode(infos))
+		return nil
+	}
+
+	sections := make([]Section, 0, len(infos))
+	for _, info := range infos {
+		sections = append(sections, Section{
+			Title:   info.File,
+			Rows:    mediaRows(info),
+			Records: []*mediaInfo{info},
+		})
+	}
+
+	return Render(Output{Data: infos, Sections: sections})
+}
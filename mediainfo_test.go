@@ -0,0 +1,55 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Write a media fixture to a temporary file and read its metadata
+func testMediaInfo(t *testing.T, name string, data []byte) (*mediaInfo, error) {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return readMediaInfo(path)
+}
+
+// Corrupt every byte of the headers of the fixtures, the parsers may fail but must not panic
+func TestMediaCorruption(t *testing.T) {
+	fixtures := map[string][]byte{
+		"a.mkv":  testMatroska(),
+		"a.mp4":  testMP4(),
+		"a.flac": testFLAC(),
+		"a.mp3":  testMP3(),
+	}
+
+	for name, fixture := range fixtures {
+		for i := 0; i < len(fixture) && i < 1024; i++ {
+			for _, value := range []byte{0x00, 0x01, 0x7F, 0xFF} {
+				data := append([]byte(nil), fixture...)
+				data[i] = value
+				testMediaInfo(t, name, data)
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	api "github.com/fuchsi/irrenhaus-api"
+)
+
+func messageUsage() {
+	fmt.Println("message subcommand")
+
+	fmt.Println("\tlist")
+	fmt.Println("\t\tList the messages in the inbox")
+
+	fmt.Println("\tread <id>")
+	fmt.Println("\t\tShow the message <id>")
+
+	fmt.Println("\tsend <user> <subject>")
+	fmt.Println("\t\tSend a message to <user>. The body is read from stdin or $EDITOR")
+
+	fmt.Println("\treply <id>")
+	fmt.Println("\t\tReply to the message <id>. The body is read from stdin or $EDITOR")
+
+	fmt.Println("\tdelete <id>")
+	fmt.Println("\t\tDelete the message <id>")
+}
+
+func messageList() error {
+	c := getConnection()
+
+	var messages []api.Message
+	err := withSession(func() (err error) {
+		messages, err = api.MessageList(c)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Date.Unix() > messages[j].Date.Unix()
+	})
+
+	records := make([]messageRecord, 0, len(messages))
+	rows := make([][]string, 0, len(messages))
+	for _, message := range messages {
+		unreadStr := ""
+		if message.Unread {
+			unreadStr = "*"
+		}
+		records = append(records, newMessageRecord(message))
+		rows = append(rows, []string{
+			fmt.Sprintf("%d", message.Id),
+			message.Sender,
+			message.Subject,
+			message.Date.Format("02.01.2006 15:04:05"),
+			unreadStr,
+		})
+	}
+
+	return Render(Output{
+		Data: records,
+		Sections: []Section{{
+			Title:   fmt.Sprintf("Found %d Messages", len(messages)),
+			Header:  []string{"ID", "From", "Subject", "Date", "New"},
+			Rows:    rows,
+			Records: records,
+		}},
+	})
+}
+
+func messageRead(id int64) error {
+	c := getConnection()
+
+	var message api.Message
+	err := withSession(func() (err error) {
+		message, err = api.MessageRead(c, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	record := newMessageRecord(message)
+	return Render(Output{
+		Data: record,
+		Sections: []Section{{
+			Rows: [][]string{
+				{"From", message.Sender},
+				{"Date", message.Date.Format("02.01.2006 15:04:05")},
+				{"Subject", message.Subject},
+			},
+			Text:    "\n" + message.Body,
+			Records: record,
+		}},
+	})
+}
+
+func messageSend(receiver string, subject string) error {
+	c := getConnection()
+
+	body, err := ReadText("")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(body) == "" {
+		return errors.New("empty message, aborting")
+	}
+
+	var ok bool
+	err = withSessionWrite(func() (err error) {
+		ok, err = api.MessageWrite(c, receiver, subject, body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.New("failed to send message")
+	}
+
+	PrintQuiet("Message sent to", receiver)
+	return nil
+}
+
+func messageReply(id int64) error {
+	c := getConnection()
+
+	var original api.Message
+	err := withSession(func() (err error) {
+		original, err = api.MessageRead(c, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// quote the original message, so the editor shows what we are replying to
+	quoted := ""
+	for _, line := range strings.Split(strings.TrimRight(original.Body, "\n"), "\n") {
+		quoted += "> " + line + "\n"
+	}
+
+	body, err := ReadText("\n\n" + quoted)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(body) == "" || body == "\n\n"+quoted {
+		return errors.New("empty message, aborting")
+	}
+
+	subject := original.Subject
+	if !strings.HasPrefix(subject, "Re: ") {
+		subject = "Re: " + subject
+	}
+
+	var ok bool
+	err = withSessionWrite(func() (err error) {
+		ok, err = api.MessageWrite(c, original.Sender, subject, body)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.New("failed to send message")
+	}
+
+	PrintQuiet("Reply sent to", original.Sender)
+	return nil
+}
+
+func messageDelete(id int64) error {
+	c := getConnection()
+
+	var ok bool
+	err := withSession(func() (err error) {
+		ok, err = api.MessageDelete(c, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return errors.New("failed to delete message")
+	}
+
+	PrintQuiet("Message deleted")
+	return nil
+}
@@ -0,0 +1,196 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// A file in a torrent
+type metaFile struct {
+	// slash separated path, starting with the torrent name for multi file torrents
+	Path   string
+	Length int64
+}
+
+// Metainfo of a v1 torrent
+type metaInfo struct {
+	Announce    string
+	Name        string
+	PieceLength int64
+	Pieces      []byte
+	Private     bool
+	// true if the torrent has a files list, i.e. the name is a directory
+	MultiFile bool
+	Files     []metaFile
+	// hex encoded SHA-1 of the info dictionary
+	InfoHash string
+}
+
+// Largest accepted piece length, pieces are read into memory as a whole
+const maxTorrentPieceLength = 256 * 1024 * 1024
+
+var htmlTitlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// Check if a body looks like an HTML page instead of a torrent
+// It returns an error describing the page, or nil.
+func checkNotHTML(body []byte) error {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return errors.New("the server returned an empty file")
+	}
+	head := trimmed
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	if head[0] != '<' && !bytes.Contains(bytes.ToLower(head), []byte("<html")) {
+		return nil
+	}
+
+	if match := htmlTitlePattern.FindSubmatch(trimmed); match != nil {
+		return fmt.Errorf("the server returned an HTML page instead of a torrent: %s", strings.TrimSpace(string(match[1])))
+	}
+
+	return errors.New("the server returned an HTML page instead of a torrent")
+}
+
+// Read and parse a .torrent file
+// It returns the metainfo and any error encountered.
+func loadTorrent(filename string) (*metaInfo, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTorrent(content)
+}
+
+// Parse a bencoded torrent
+// It returns the metainfo and any error encountered.
+func parseTorrent(data []byte) (*metaInfo, error) {
+	if err := checkNotHTML(data); err != nil {
+		return nil, err
+	}
+
+	value, err := bdecode(data)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid torrent: not a dictionary")
+	}
+	info, ok := root["info"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("invalid torrent: missing info dictionary")
+	}
+	rawInfo, err := bdecodeRaw(data, "info")
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum(rawInfo)
+	meta := &metaInfo{InfoHash: hex.EncodeToString(hash[:])}
+	meta.Announce, _ = root["announce"].(string)
+	meta.Name, _ = info["name"].(string)
+	meta.PieceLength, _ = info["piece length"].(int64)
+	pieces, _ := info["pieces"].(string)
+	meta.Pieces = []byte(pieces)
+	private, _ := info["private"].(int64)
+	meta.Private = private == 1
+
+	if meta.Name == "" {
+		return nil, errors.New("invalid torrent: missing name")
+	}
+	if meta.PieceLength <= 0 || len(meta.Pieces)%sha1.Size != 0 {
+		return nil, errors.New("invalid torrent: invalid pieces")
+	}
+	if meta.PieceLength > maxTorrentPieceLength {
+		return nil, fmt.Errorf("invalid torrent: piece length %d exceeds %d", meta.PieceLength, maxTorrentPieceLength)
+	}
+
+	if length, ok := info["length"].(int64); ok {
+		if length < 0 {
+			return nil, errors.New("invalid torrent: negative length")
+		}
+		meta.Files = []metaFile{{meta.Name, length}}
+	} else {
+		files, ok := info["files"].([]interface{})
+		if !ok {
+			return nil, errors.New("invalid torrent: neither length nor files")
+		}
+		meta.MultiFile = true
+		for _, f := range files {
+			file, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("invalid torrent: invalid file entry")
+			}
+			length, _ := file["length"].(int64)
+			if length < 0 {
+				return nil, errors.New("invalid torrent: negative length")
+			}
+			parts, _ := file["path"].([]interface{})
+			elements := []string{meta.Name}
+			for _, part := range parts {
+				element, _ := part.(string)
+				if element == "" || element == "." || element == ".." || strings.Contains(element, "/") {
+					return nil, fmt.Errorf("invalid torrent: unsafe path element '%s'", element)
+				}
+				elements = append(elements, element)
+			}
+			if len(elements) < 2 {
+				return nil, errors.New("invalid torrent: file without path")
+			}
+			meta.Files = append(meta.Files, metaFile{path.Join(elements...), length})
+		}
+	}
+
+	// the sum of the lengths must not overflow the piece count calculation
+	var total int64
+	for _, file := range meta.Files {
+		if file.Length > math.MaxInt64-meta.PieceLength-total {
+			return nil, errors.New("invalid torrent: total size too large")
+		}
+		total += file.Length
+	}
+	if int64(len(meta.Pieces)/sha1.Size) != (total+meta.PieceLength-1)/meta.PieceLength {
+		return nil, errors.New("invalid torrent: piece count does not match the total size")
+	}
+
+	return meta, nil
+}
+
+// Get the sum of all file sizes
+func (meta *metaInfo) TotalLength() int64 {
+	var total int64
+	for _, file := range meta.Files {
+		total += file.Length
+	}
+
+	return total
+}
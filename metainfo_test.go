@@ -0,0 +1,72 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Build a bencoded single file torrent
+func testTorrent(t *testing.T, pieceLength int64, length int64, pieces int) []byte {
+	data, err := bencode(map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "release.mkv",
+			"piece length": pieceLength,
+			"pieces":       strings.Repeat("x", pieces*20),
+			"length":       length,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestParseTorrent(t *testing.T) {
+	meta, err := parseTorrent(testTorrent(t, 16384, 40000, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Name != "release.mkv" || meta.TotalLength() != 40000 || meta.MultiFile {
+		t.Errorf("parseTorrent = %+v", meta)
+	}
+}
+
+func TestParseTorrentInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"overflowing string length", []byte("d4:infod4:name9223372036854775807:xee")},
+		{"truncated", testTorrent(t, 16384, 40000, 3)[:40]},
+		{"piece length too large", testTorrent(t, 1<<40, 1<<40, 1)},
+		{"zero piece length", testTorrent(t, 0, 0, 0)},
+		{"negative length", testTorrent(t, 16384, -1, 0)},
+		{"piece count mismatch", testTorrent(t, 16384, 40000, 2)},
+		{"overflowing total size", testTorrent(t, 16384, 9223372036854775807, 1)},
+	}
+
+	for _, test := range tests {
+		if meta, err := parseTorrent(test.data); err == nil {
+			t.Errorf("%s: parseTorrent = %+v, want an error", test.name, meta)
+		}
+	}
+}
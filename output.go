@@ -0,0 +1,302 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"time"
+
+	api "github.com/fuchsi/irrenhaus-api"
+	"github.com/fuchsi/irrenhaus-api/Category"
+	"github.com/olekukonko/tablewriter"
+)
+
+const (
+	OutputTable    = "table"
+	OutputJSON     = "json"
+	OutputNDJSON   = "ndjson"
+	OutputTemplate = "template"
+)
+
+// Output of a command
+// Data is serialized in the json and ndjson formats, Sections are rendered in the table format.
+// The template format is executed for the Records of every section, or for Data if no section has any.
+// Sections with a Template name are rendered with the template of that name, e.g. {{define "files"}},
+// and are skipped if it is not defined, unless they are the only sections with Records.
+type Output struct {
+	Data     interface{}
+	Sections []Section
+}
+
+// A block of table output
+// Rows are rendered as a table if Header is set, and as "Key: Value" lines otherwise.
+type Section struct {
+	Title    string
+	Header   []string
+	Rows     [][]string
+	Text     string
+	Records  interface{}
+	Template string
+}
+
+type torrentRecord struct {
+	Id           int64          `json:"id"`
+	Name         string         `json:"name"`
+	InfoHash     string         `json:"info_hash,omitempty"`
+	Category     int            `json:"category"`
+	CategoryName string         `json:"category_name"`
+	Size         uint64         `json:"size"`
+	Added        time.Time      `json:"added"`
+	Description  string         `json:"description,omitempty"`
+	FileCount    int            `json:"file_count"`
+	SeederCount  int            `json:"seeder_count"`
+	LeecherCount int            `json:"leecher_count"`
+	SnatchCount  int            `json:"snatch_count"`
+	Files        []fileRecord   `json:"files,omitempty"`
+	Peers        []peerRecord   `json:"peers,omitempty"`
+	Snatches     []snatchRecord `json:"snatches,omitempty"`
+}
+
+type fileRecord struct {
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+}
+
+type peerRecord struct {
+	Name        string  `json:"name"`
+	Seeder      bool    `json:"seeder"`
+	Connectable bool    `json:"connectable"`
+	Uploaded    uint64  `json:"uploaded"`
+	Ulrate      uint64  `json:"upload_rate"`
+	Downloaded  uint64  `json:"downloaded"`
+	Dlrate      uint64  `json:"download_rate"`
+	Ratio       float64 `json:"ratio"`
+	Completed   float64 `json:"completed"`
+	Client      string  `json:"client"`
+}
+
+type snatchRecord struct {
+	Name       string     `json:"name"`
+	Uploaded   uint64     `json:"uploaded"`
+	Downloaded uint64     `json:"downloaded"`
+	Ratio      float64    `json:"ratio"`
+	Seeding    bool       `json:"seeding"`
+	Stopped    *time.Time `json:"stopped,omitempty"`
+}
+
+type shoutRecord struct {
+	Id      int64     `json:"id"`
+	Box     string    `json:"box"`
+	Date    time.Time `json:"date"`
+	User    string    `json:"user"`
+	Message string    `json:"message"`
+}
+
+type messageRecord struct {
+	Id       int64     `json:"id"`
+	Sender   string    `json:"sender"`
+	Receiver string    `json:"receiver,omitempty"`
+	Subject  string    `json:"subject"`
+	Body     string    `json:"body,omitempty"`
+	Date     time.Time `json:"date"`
+	Unread   bool      `json:"unread"`
+}
+
+// Check if the output option is a known format and load the output template
+// It returns any error encountered.
+func checkOutput() error {
+	if *formatOpt != "" {
+		*outputOpt = OutputTemplate
+	}
+
+	switch *outputOpt {
+	case OutputTable, OutputJSON, OutputNDJSON:
+		return nil
+	case OutputTemplate:
+		if *formatOpt == "" {
+			return fmt.Errorf("output format '%s' requires --format", OutputTemplate)
+		}
+		return loadOutputTemplate(*formatOpt)
+	}
+
+	return fmt.Errorf("unknown output format '%s'", *outputOpt)
+}
+
+// Check if the output is meant to be read by a machine
+func machineOutput() bool {
+	return *outputOpt == OutputJSON || *outputOpt == OutputNDJSON
+}
+
+// Render the output of a command to stdout in the selected format
+// It returns any error encountered.
+func Render(output Output) error {
+	return renderTo(os.Stdout, output)
+}
+
+func renderTo(w io.Writer, output Output) error {
+	switch *outputOpt {
+	case OutputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output.Data)
+	case OutputNDJSON:
+		encoder := json.NewEncoder(w)
+		value := reflect.ValueOf(output.Data)
+		if value.Kind() != reflect.Slice {
+			return encoder.Encode(output.Data)
+		}
+		for i := 0; i < value.Len(); i++ {
+			if err := encoder.Encode(value.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	case OutputTemplate:
+		// named sections fall back to the main template if no other section uses it
+		fallback := true
+		for _, section := range output.Sections {
+			if section.Records != nil && section.Template == "" {
+				fallback = false
+			}
+		}
+
+		executed := false
+		for _, section := range output.Sections {
+			if section.Records == nil {
+				continue
+			}
+			tmpl := outputTemplate
+			if section.Template != "" {
+				tmpl = outputTemplate.Lookup(section.Template)
+				if tmpl == nil && fallback {
+					tmpl = outputTemplate
+				}
+			}
+			if tmpl == nil {
+				continue
+			}
+			if err := executeTemplate(w, tmpl, section.Records); err != nil {
+				return err
+			}
+			executed = true
+		}
+		// commands whose sections have no records print their data
+		if !executed {
+			return executeOutputTemplate(w, output.Data)
+		}
+		return nil
+	}
+
+	for _, section := range output.Sections {
+		if section.Title != "" {
+			fmt.Fprintln(w, section.Title)
+		}
+		if section.Header != nil {
+			table := tablewriter.NewWriter(w)
+			table.SetHeader(section.Header)
+			table.AppendBulk(section.Rows)
+			table.Render()
+		} else {
+			for _, row := range section.Rows {
+				fmt.Fprintf(w, "%-11s%s\n", row[0]+":", row[1])
+			}
+		}
+		if section.Text != "" {
+			fmt.Fprintln(w, section.Text)
+		}
+	}
+
+	return nil
+}
+
+func newTorrentRecord(entry api.Entry) torrentRecord {
+	categoryName, err := Category.ToString(entry.Category)
+	if err != nil {
+		categoryName = "-"
+	}
+
+	record := torrentRecord{
+		Id:           entry.Id,
+		Name:         entry.Name,
+		InfoHash:     entry.InfoHash,
+		Category:     entry.Category,
+		CategoryName: categoryName,
+		Size:         entry.Size,
+		Added:        entry.Added,
+		Description:  entry.Description,
+		FileCount:    entry.FileCount,
+		SeederCount:  entry.SeederCount,
+		LeecherCount: entry.LeecherCount,
+		SnatchCount:  entry.SnatchCount,
+	}
+
+	for _, file := range entry.Files {
+		record.Files = append(record.Files, fileRecord{file.Name, file.Size})
+	}
+	for _, peer := range entry.Peers {
+		record.Peers = append(record.Peers, peerRecord{
+			Name:        peer.Name,
+			Seeder:      peer.Seeder,
+			Connectable: peer.Connectable,
+			Uploaded:    peer.Uploaded,
+			Ulrate:      peer.Ulrate,
+			Downloaded:  peer.Downloaded,
+			Dlrate:      peer.Dlrate,
+			Ratio:       peer.Ratio,
+			Completed:   peer.Completed,
+			Client:      peer.Client,
+		})
+	}
+	for _, snatch := range entry.Snatches {
+		s := snatchRecord{
+			Name:       snatch.Name,
+			Uploaded:   snatch.Uploaded,
+			Downloaded: snatch.Downloaded,
+			Ratio:      snatch.Ratio,
+			Seeding:    snatch.Seeding,
+		}
+		if !snatch.Seeding {
+			stopped := snatch.Stopped
+			s.Stopped = &stopped
+		}
+		record.Snatches = append(record.Snatches, s)
+	}
+
+	return record
+}
+
+func newShoutRecord(box string, message api.ShoutboxMessage) shoutRecord {
+	return shoutRecord{message.Id, box, message.Date, message.User, message.Message}
+}
+
+func newMessageRecord(message api.Message) messageRecord {
+	return messageRecord{
+		Id:       message.Id,
+		Sender:   message.Sender,
+		Receiver: message.Receiver,
+		Subject:  message.Subject,
+		Body:     message.Body,
+		Date:     message.Date,
+		Unread:   message.Unread,
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Switch to the template output for a test
+func useOutputTemplate(t *testing.T, format string) {
+	configPath, output := CONFIGPATH, *outputOpt
+	t.Cleanup(func() {
+		CONFIGPATH, *outputOpt = configPath, output
+	})
+	*outputOpt = OutputTemplate
+	if err := loadOutputTemplate(format); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadOutputTemplateFile(t *testing.T) {
+	configPath := CONFIGPATH
+	defer func() { CONFIGPATH = configPath }()
+	CONFIGPATH = t.TempDir() + "/"
+
+	if err := os.Mkdir(filepath.Join(CONFIGPATH, "templates"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(CONFIGPATH, "templates", "short.tmpl"), []byte("{{.Id}}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadOutputTemplate("short"); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if err := executeOutputTemplate(&buffer, torrentRecord{Id: 42}); err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != "42\n" {
+		t.Errorf("output = %q, want %q", buffer.String(), "42\n")
+	}
+
+	// a missing file must not be used as the template text
+	if err := loadOutputTemplate("missing"); err == nil {
+		t.Error("loadOutputTemplate(missing) returned no error")
+	}
+}
+
+func TestRenderTemplateFallsBackToData(t *testing.T) {
+	useOutputTemplate(t, "{{.Subject}}")
+
+	var buffer bytes.Buffer
+	err := renderTo(&buffer, Output{
+		Data:     messageRecord{Subject: "Hello"},
+		Sections: []Section{{Rows: [][]string{{"Subject", "Hello"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buffer.String() != "Hello\n" {
+		t.Errorf("output = %q, want %q", buffer.String(), "Hello\n")
+	}
+}
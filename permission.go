@@ -0,0 +1,55 @@
+//go:build !windows
+
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Check that a file or directory is only accessible by the current user
+// Missing files are fine, they are created with safe permissions.
+// It returns an error describing the problem and how to fix it.
+func checkPermissions(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	wanted := os.FileMode(0600)
+	if info.IsDir() {
+		wanted = 0700
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("refusing to use %s: it is accessible by other users (mode %04o). Run 'chmod %o %s'",
+			path, info.Mode().Perm(), wanted, path)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("refusing to use %s: it is not owned by the current user", path)
+	}
+
+	return nil
+}
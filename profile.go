@@ -0,0 +1,215 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+)
+
+const defaultUrl = "https://irrenhaus.dyndns.dk"
+
+// Profile names are part of file names in the config path
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// Name and settings of the active profile
+var profileName string
+var profile Profile
+
+type profileRecord struct {
+	Name     string `json:"name"`
+	Username string `json:"username"`
+	Url      string `json:"url"`
+	Default  bool   `json:"default"`
+}
+
+func profileUsage() {
+	fmt.Println("profile subcommand")
+
+	fmt.Println("\tlist")
+	fmt.Println("\t\tList the profiles")
+
+	fmt.Println("\tadd <name> [username] [password] [pin] [url]")
+	fmt.Println("\t\tAdd or update the profile <name>")
+
+	fmt.Println("\tremove <name>")
+	fmt.Println("\t\tRemove the profile <name>")
+
+	fmt.Println("\tdefault <name>")
+	fmt.Println("\t\tUse <name> if no profile is selected with --profile or $IRRENHAUS_PROFILE")
+}
+
+// Check that a profile name is safe to use in file names, e.g. no "../x" or "a/b"
+// It returns an error if it is not.
+func checkProfileName(name string) error {
+	if name == "" {
+		return fmt.Errorf("profile name must not be empty")
+	}
+	if !profileNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid profile name '%s', use letters, digits, '.', '_' and '-' and do not start with '.'", name)
+	}
+
+	return nil
+}
+
+// Select the active profile
+// The profile is taken from the --profile flag, the IRRENHAUS_PROFILE environment variable or the
+// default profile of the config, in that order. A config with a single profile always uses it.
+// It returns an error if the name of the profile is invalid.
+func selectProfile() error {
+	profileName = *profileOpt
+	if profileName == "" {
+		profileName = os.Getenv("IRRENHAUS_PROFILE")
+	}
+	if profileName == "" {
+		profileName = config.DefaultProfile
+	}
+	if profileName == "" && len(config.Profiles) == 1 {
+		for name := range config.Profiles {
+			profileName = name
+		}
+	}
+	if profileName == "" {
+		profileName = legacyProfileName
+	}
+
+	profile = config.Profiles[profileName]
+
+	return checkProfileName(profileName)
+}
+
+// Ask the user for the profile settings which are not given in args
+//  args: username, password, pin and url
+// It returns the profile and any error encountered.
+func askProfile(args []string) (Profile, error) {
+	p := Profile{Url: defaultUrl}
+	fields := []*string{&p.Username, &p.Password, &p.Pin, &p.Url}
+	prompts := []string{"Username", "Password", "Pin"}
+
+	for i, arg := range args {
+		if i < len(fields) {
+			*fields[i] = arg
+		}
+	}
+	for i, prompt := range prompts {
+		if err := AskFor(prompt, fields[i]); err != nil {
+			return p, err
+		}
+	}
+
+	return p, nil
+}
+
+// Add or update a profile and write the config
+// The first profile becomes the default profile.
+// It returns any error encountered.
+func profileAdd(name string, p Profile) error {
+	if err := checkProfileName(name); err != nil {
+		return err
+	}
+
+	// once there is a vault, secrets never end up in the config file
+	if vaultExists() {
+		var err error
+		p, err = storeProfileSecrets(name, p)
+		if err != nil {
+			return err
+		}
+	}
+
+	config.Profiles[name] = p
+	if config.DefaultProfile == "" {
+		config.DefaultProfile = name
+	}
+
+	return dumpConfig(config, configFile)
+}
+
+func profileRemove(name string) error {
+	if _, ok := config.Profiles[name]; !ok {
+		return fmt.Errorf("unknown profile '%s'", name)
+	}
+
+	if vaultExists() {
+		secrets, passphrase, err := unlockVault()
+		if err != nil {
+			return err
+		}
+		if _, ok := secrets[name]; ok {
+			delete(secrets, name)
+			if err := dumpVault(secrets, passphrase); err != nil {
+				return err
+			}
+		}
+	}
+
+	delete(config.Profiles, name)
+	if config.DefaultProfile == name {
+		config.DefaultProfile = ""
+	}
+
+	if err := dumpConfig(config, configFile); err != nil {
+		return err
+	}
+
+	PrintQuiet("Profile", name, "removed")
+	return nil
+}
+
+func profileDefault(name string) error {
+	if _, ok := config.Profiles[name]; !ok {
+		return fmt.Errorf("unknown profile '%s'", name)
+	}
+
+	config.DefaultProfile = name
+
+	return dumpConfig(config, configFile)
+}
+
+func profileList() error {
+	names := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	records := make([]profileRecord, 0, len(names))
+	rows := make([][]string, 0, len(names))
+	for _, name := range names {
+		p := config.Profiles[name]
+		record := profileRecord{name, p.Username, p.Url, name == config.DefaultProfile}
+		defaultStr := ""
+		if record.Default {
+			defaultStr = "*"
+		}
+		records = append(records, record)
+		rows = append(rows, []string{name, p.Username, p.Url, defaultStr})
+	}
+
+	return Render(Output{
+		Data: records,
+		Sections: []Section{{
+			Header:  []string{"Name", "Username", "Url", "Default"},
+			Rows:    rows,
+			Records: records,
+		}},
+	})
+}
@@ -0,0 +1,43 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import "testing"
+
+func TestCheckProfileName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"default", true},
+		{"work-2.alt_b", true},
+		{"", false},
+		{"../x", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{".hidden", false},
+		{"..", false},
+	}
+
+	for _, test := range tests {
+		if err := checkProfileName(test.name); (err == nil) != test.valid {
+			t.Errorf("checkProfileName(%q) = %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
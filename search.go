@@ -0,0 +1,331 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	api "github.com/fuchsi/irrenhaus-api"
+)
+
+// Column of the search results
+type searchColumn struct {
+	Header string
+	Value  func(r torrentRecord) string
+}
+
+// Columns of the search results, selected with --columns
+var searchColumns = map[string]searchColumn{
+	"id":       {"ID", func(r torrentRecord) string { return fmt.Sprintf("%d", r.Id) }},
+	"name":     {"Name", func(r torrentRecord) string { return r.Name }},
+	"size":     {"Size", func(r torrentRecord) string { return datasize.ByteSize(r.Size).HumanReadable() }},
+	"added":    {"Date", func(r torrentRecord) string { return r.Added.Format("02.01.2006 15:04:05") }},
+	"seeders":  {"S", func(r torrentRecord) string { return fmt.Sprintf("%d", r.SeederCount) }},
+	"leechers": {"L", func(r torrentRecord) string { return fmt.Sprintf("%d", r.LeecherCount) }},
+	"snatches": {"Snatches", func(r torrentRecord) string { return fmt.Sprintf("%d", r.SnatchCount) }},
+	"files":    {"Files", func(r torrentRecord) string { return fmt.Sprintf("%d", r.FileCount) }},
+	"category": {"Category", func(r torrentRecord) string { return r.CategoryName }},
+	"hash":     {"Info Hash", func(r torrentRecord) string { return r.InfoHash }},
+}
+
+// Columns of the search results without --columns
+var defaultSearchColumns = []string{"id", "name", "size", "added", "seeders", "leechers"}
+
+// Orders of the search results, selected with --sort
+// Names sort ascending, everything else descending, --reverse turns it around.
+var searchSorts = map[string]func(a, b api.Entry) bool{
+	"name":     func(a, b api.Entry) bool { return strings.ToLower(a.Name) < strings.ToLower(b.Name) },
+	"size":     func(a, b api.Entry) bool { return a.Size > b.Size },
+	"added":    func(a, b api.Entry) bool { return a.Added.After(b.Added) },
+	"seeders":  func(a, b api.Entry) bool { return a.SeederCount > b.SeederCount },
+	"leechers": func(a, b api.Entry) bool { return a.LeecherCount > b.LeecherCount },
+}
+
+// Client-side filters of the search results
+type searchFilter struct {
+	MinSize    uint64
+	MaxSize    uint64
+	Since      time.Time
+	MinSeeders int
+	Regex      *regexp.Regexp
+}
+
+// Get the sorted names of the keys of a map of search columns or orders
+func searchKeys(names []string) string {
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Parse a size like 4GB or 700 MB
+func parseSize(size string) (uint64, error) {
+	var parsed datasize.ByteSize
+	if err := parsed.UnmarshalText([]byte(strings.TrimSpace(size))); err != nil {
+		return 0, fmt.Errorf("invalid size '%s'", size)
+	}
+
+	return parsed.Bytes(), nil
+}
+
+// Parse the start of a time range
+// Accepts an age like 7d, 2w or 12h, or a date like 2018-06-01.
+//  since: Age or date
+//  now:   Time the age is relative to
+// It returns the start time and any error encountered.
+func parseSince(since string, now time.Time) (time.Time, error) {
+	since = strings.TrimSpace(since)
+	if date, err := time.ParseInLocation("2006-01-02", since, time.Local); err == nil {
+		return date, nil
+	}
+
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for unit, length := range units {
+		if strings.HasSuffix(since, unit) {
+			n, err := strconv.ParseFloat(strings.TrimSuffix(since, unit), 64)
+			if err != nil || n < 0 {
+				return time.Time{}, fmt.Errorf("invalid age '%s'", since)
+			}
+			return now.Add(-time.Duration(n * float64(length))), nil
+		}
+	}
+
+	age, err := time.ParseDuration(since)
+	if err != nil || age < 0 {
+		return time.Time{}, fmt.Errorf("invalid age '%s', e.g. 7d, 2w, 12h or 2018-06-01", since)
+	}
+
+	return now.Add(-age), nil
+}
+
+// Build the filter from the command line options
+// It returns the filter and any error encountered.
+func newSearchFilter() (searchFilter, error) {
+	var f searchFilter
+	var err error
+
+	if *minSizeOpt != "" {
+		if f.MinSize, err = parseSize(*minSizeOpt); err != nil {
+			return f, err
+		}
+	}
+	if *maxSizeOpt != "" {
+		if f.MaxSize, err = parseSize(*maxSizeOpt); err != nil {
+			return f, err
+		}
+	}
+	if *sinceOpt != "" {
+		if f.Since, err = parseSince(*sinceOpt, time.Now()); err != nil {
+			return f, err
+		}
+	}
+	f.MinSeeders = *minSeedersOpt
+	if *regexOpt != "" {
+		if f.Regex, err = compileNameRegex(*regexOpt); err != nil {
+			return f, err
+		}
+	}
+
+	return f, nil
+}
+
+// Compile a regular expression for torrent names
+// Names on the site mix cases freely, so the match ignores the case.
+func compileNameRegex(expr string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("(?i)" + expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex: %s", err.Error())
+	}
+
+	return re, nil
+}
+
+// Check whether a search result passes the filter
+func (f searchFilter) match(entry api.Entry) bool {
+	switch {
+	case f.MinSize > 0 && entry.Size < f.MinSize:
+		return false
+	case f.MaxSize > 0 && entry.Size > f.MaxSize:
+		return false
+	case !f.Since.IsZero() && entry.Added.Before(f.Since):
+		return false
+	case entry.SeederCount < f.MinSeeders:
+		return false
+	case f.Regex != nil && !f.Regex.MatchString(entry.Name):
+		return false
+	}
+
+	return true
+}
+
+// Filter the search results
+// It returns the matching entries.
+func filterEntries(entries []api.Entry, f searchFilter) []api.Entry {
+	matches := make([]api.Entry, 0, len(entries))
+	for _, entry := range entries {
+		if f.match(entry) {
+			matches = append(matches, entry)
+		}
+	}
+
+	return matches
+}
+
+// Sort the search results
+//  order:   One of the searchSorts
+//  reverse: Reverse the order
+// It returns any error encountered.
+func sortEntries(entries []api.Entry, order string, reverse bool) error {
+	if err := checkSortOrder(order); err != nil {
+		return err
+	}
+	less := searchSorts[strings.ToLower(order)]
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if reverse {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+
+	return nil
+}
+
+// Check that a sort order exists
+// It returns an error listing the sort orders if it does not.
+func checkSortOrder(order string) error {
+	if _, ok := searchSorts[strings.ToLower(order)]; ok {
+		return nil
+	}
+	names := make([]string, 0, len(searchSorts))
+	for name := range searchSorts {
+		names = append(names, name)
+	}
+
+	return fmt.Errorf("unknown sort order '%s', one of %s", order, searchKeys(names))
+}
+
+// Resolve the columns of the search results
+//  names: Column names, the default columns if empty
+// It returns the columns and any error encountered.
+func resolveSearchColumns(names []string) ([]searchColumn, error) {
+	if len(names) == 0 {
+		names = defaultSearchColumns
+	}
+
+	columns := make([]searchColumn, 0, len(names))
+	for _, name := range names {
+		column, ok := searchColumns[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			known := make([]string, 0, len(searchColumns))
+			for name := range searchColumns {
+				known = append(known, name)
+			}
+			return nil, fmt.Errorf("unknown column '%s', one of %s", name, searchKeys(known))
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, nil
+}
+
+// Options of the search output, parsed before the search is sent
+type searchOptions struct {
+	filter  searchFilter
+	columns []searchColumn
+}
+
+// Parse the filter, sort, limit and column options
+// It returns the options and any error encountered.
+func newSearchOptions() (searchOptions, error) {
+	var options searchOptions
+	var err error
+
+	if options.filter, err = newSearchFilter(); err != nil {
+		return options, err
+	}
+	if options.columns, err = resolveSearchColumns(*searchColumnsOpt); err != nil {
+		return options, err
+	}
+	if err := checkSortOrder(*sortOpt); err != nil {
+		return options, err
+	}
+	if *limitOpt < 0 {
+		return options, errors.New("limit must not be negative")
+	}
+
+	return options, nil
+}
+
+// Filter, sort and limit search results, print them and download the selected ones with --download
+//  title: Title of the results, with a %d for the number of results
+// It returns any error encountered.
+func showSearchResults(entries []api.Entry, options searchOptions, title string) error {
+	entries = filterEntries(entries, options.filter)
+	if err := sortEntries(entries, *sortOpt, *reverseFlag); err != nil {
+		return err
+	}
+	if *limitOpt > 0 && len(entries) > *limitOpt {
+		entries = entries[:*limitOpt]
+	}
+
+	// row numbers are needed to pick the torrents to download
+	header := make([]string, 0, len(options.columns)+1)
+	if *downloadFlag {
+		header = append(header, "#")
+	}
+	for _, column := range options.columns {
+		header = append(header, column.Header)
+	}
+
+	records := make([]torrentRecord, 0, len(entries))
+	rows := make([][]string, 0, len(entries))
+	for i, entry := range entries {
+		record := newTorrentRecord(entry)
+		records = append(records, record)
+		row := make([]string, 0, len(header))
+		if *downloadFlag {
+			row = append(row, fmt.Sprintf("%d", i+1))
+		}
+		for _, column := range options.columns {
+			row = append(row, column.Value(record))
+		}
+		rows = append(rows, row)
+	}
+
+	err := Render(Output{
+		Data: records,
+		Sections: []Section{{
+			Title:   fmt.Sprintf(title, len(entries)),
+			Header:  header,
+			Rows:    rows,
+			Records: records,
+		}},
+	})
+	if err != nil || !*downloadFlag || len(entries) == 0 {
+		return err
+	}
+
+	return searchDownload(entries, *selectOpt, *destOpt)
+}
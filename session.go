@@ -0,0 +1,236 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sessions older than this are not reused, unless SessionMaxAge is set in the config
+const defaultSessionMaxAge = time.Hour * 24 * 7
+
+type sessionRecord struct {
+	Profile  string    `json:"profile"`
+	Username string    `json:"username"`
+	Uid      int64     `json:"uid"`
+	Created  time.Time `json:"created"`
+	Age      string    `json:"age"`
+	State    string    `json:"state"`
+}
+
+// Get the maximum age of a reusable session
+func sessionMaxAge() time.Duration {
+	if config.SessionMaxAge == "" {
+		return defaultSessionMaxAge
+	}
+
+	maxAge, err := time.ParseDuration(config.SessionMaxAge)
+	if err != nil {
+		PrintVerbose("invalid SessionMaxAge in config:", err.Error())
+		return defaultSessionMaxAge
+	}
+
+	return maxAge
+}
+
+// Check if the cookies in a jar are not worth sending to the site anymore
+func sessionStale(jar cookieJar) bool {
+	if jar.Cookies.Uid <= 0 {
+		return true
+	}
+
+	maxAge := sessionMaxAge()
+
+	return maxAge > 0 && time.Since(jar.Created) > maxAge
+}
+
+// Check if the site still accepts the session of the connection
+// The site redirects logged out users to the login page and drops the uid cookie.
+// It returns whether the session is valid and any error encountered.
+func sessionValid() (bool, error) {
+	resp, err := connection.Get(profile.Url)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return false, nil
+	}
+	if resp.Request != nil && strings.Contains(strings.ToLower(resp.Request.URL.Path), "login") {
+		return false, nil
+	}
+
+	return connection.GetCookies().Uid > 0, nil
+}
+
+// Operations hold a read lock, a new login replaces the connection under the write lock
+var sessionMutex sync.RWMutex
+
+// Incremented on every new login, so concurrent operations log in only once
+var sessionGeneration int
+
+// Run an operation against the site and log in again if it failed because the session has expired
+// It returns whether a new session has been started since the operation ran and the error of the operation.
+func runSession(operation func() error) (bool, error) {
+	sessionMutex.RLock()
+	generation := sessionGeneration
+	err := operation()
+	sessionMutex.RUnlock()
+	if err == nil {
+		return false, nil
+	}
+
+	sessionMutex.Lock()
+	defer sessionMutex.Unlock()
+	if generation != sessionGeneration {
+		return true, err
+	}
+
+	valid, validErr := sessionValid()
+	if validErr != nil || valid {
+		return false, err
+	}
+	PrintVerbose("Session rejected, logging in again:", err.Error())
+	relogin()
+	sessionGeneration++
+
+	return true, err
+}
+
+// Run a read-only operation against the site, running it again once if the session has expired
+// The operation must not have side effects before the request which failed.
+// It returns any error encountered.
+func withSession(operation func() error) error {
+	renewed, err := runSession(operation)
+	if !renewed {
+		return err
+	}
+
+	sessionMutex.RLock()
+	defer sessionMutex.RUnlock()
+
+	return operation()
+}
+
+// Run an operation which changes something on the site, e.g. an upload or a message
+// If the session has expired a new one is started, but the operation is not sent again,
+// because the site may have processed it anyway.
+// It returns any error encountered.
+func withSessionWrite(operation func() error) error {
+	renewed, err := runSession(operation)
+	if renewed {
+		return fmt.Errorf("%s (the session had expired and has been renewed, the request was not sent again)", err)
+	}
+
+	return err
+}
+
+// Persist the session if the site issued new cookies
+// It returns any error encountered.
+func saveSession() error {
+	if !sessionStarted {
+		return nil
+	}
+
+	cookies := connection.GetCookies()
+	if cookies.Uid <= 0 || reflect.DeepEqual(cookies, sessionJar.Cookies) {
+		return nil
+	}
+
+	sessionJar = cookieJar{cookies, time.Now()}
+
+	return dumpCookies(sessionJar)
+}
+
+func sessionStatus() error {
+	record := sessionRecord{Profile: profileName, Username: profile.Username, State: "logged out"}
+
+	jar, err := loadCookies()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		record.Uid = jar.Cookies.Uid
+		record.Created = jar.Created
+		record.Age = time.Since(jar.Created).Truncate(time.Second).String()
+		record.State = "logged in"
+		if sessionStale(jar) {
+			record.State = "expired"
+		}
+	}
+
+	// the cookies may still be rejected by the site, e.g. after a password change
+	if record.State == "logged in" && sessionStarted {
+		valid, err := sessionValid()
+		if err != nil {
+			return err
+		}
+		if !valid {
+			record.State = "rejected"
+		}
+	}
+
+	rows := [][]string{
+		{"Profile", record.Profile},
+		{"Username", record.Username},
+		{"State", record.State},
+	}
+	if record.Uid > 0 {
+		rows = append(rows,
+			[]string{"Uid", fmt.Sprintf("%d", record.Uid)},
+			[]string{"Created", record.Created.Format("02.01.2006 15:04:05")},
+			[]string{"Age", record.Age},
+		)
+	}
+
+	return Render(Output{
+		Data:     record,
+		Sections: []Section{{Rows: rows, Records: record}},
+	})
+}
+
+// Log out on the site and forget the session of the active profile
+// The local session is forgotten even if the site can not be reached.
+// It returns any error encountered.
+func logout() error {
+	if sessionStarted && connection.GetCookies().Uid > 0 {
+		resp, err := connection.Get(strings.TrimRight(profile.Url, "/") + "/logout.php")
+		if err != nil {
+			PrintVerbose("Failed to log out on the site:", err.Error())
+		} else {
+			resp.Body.Close()
+		}
+	}
+
+	err := os.Remove(cookieFile())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sessionStarted = false
+
+	PrintQuiet("Logged out", profileName)
+	return nil
+}
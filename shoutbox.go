@@ -19,8 +19,10 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"strings"
 	"time"
 
@@ -55,20 +57,50 @@ func shoutboxRead(box string) error {
 		return errors.New("invalid shoutbox name")
 	}
 
-	messages, err := api.ShoutboxRead(c, boxID, 0)
+	var messages []api.ShoutboxMessage
+	err := withSession(func() (err error) {
+		messages, err = api.ShoutboxRead(c, boxID, 0)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
+	records := make([]shoutRecord, 0, len(messages))
+	lines := ""
 	for _, message := range messages {
 		// skip control messages
 		if message.Event != nil {
 			continue
 		}
-		fmt.Printf("[%s] <%s> %s\n", message.Date.Format("01.02 15:04"), message.User, message.Message)
+		records = append(records, newShoutRecord(box, message))
+		lines += formatShout(message) + "\n"
 	}
 
-	return nil
+	return Render(Output{
+		Data:     records,
+		Sections: []Section{{Text: strings.TrimSuffix(lines, "\n"), Records: records}},
+	})
+}
+
+// Format a shoutbox message as a single line
+func formatShout(message api.ShoutboxMessage) string {
+	return fmt.Sprintf("[%s] <%s> %s", message.Date.Format("01.02 15:04"), message.User, message.Message)
+}
+
+// Print a single shoutbox message as it arrives
+// Machine readable formats get one JSON object per line.
+func printShout(box string, message api.ShoutboxMessage) {
+	switch *outputOpt {
+	case OutputJSON, OutputNDJSON:
+		json.NewEncoder(os.Stdout).Encode(newShoutRecord(box, message))
+		return
+	case OutputTemplate:
+		executeOutputTemplate(os.Stdout, newShoutRecord(box, message))
+		return
+	}
+
+	fmt.Println(formatShout(message))
 }
 
 func shoutboxWrite(box string, message string) error {
@@ -79,7 +111,10 @@ func shoutboxWrite(box string, message string) error {
 		return errors.New("invalid shoutbox name")
 	}
 
-	ok, err := api.ShoutboxWrite(c, boxID, message)
+	err := withSessionWrite(func() (err error) {
+		ok, err = api.ShoutboxWrite(c, boxID, message)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -100,7 +135,11 @@ func shoutboxPoll(box string, refresh int) error {
 		return errors.New("invalid shoutbox name")
 	}
 
-	messages, err := api.ShoutboxRead(c, boxID, 0)
+	var messages []api.ShoutboxMessage
+	err := withSession(func() (err error) {
+		messages, err = api.ShoutboxRead(c, boxID, 0)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -119,7 +158,7 @@ func shoutboxPoll(box string, refresh int) error {
 			}
 			continue
 		}
-		fmt.Printf("[%s] <%s> %s\n", message.Date.Format("01.02 15:04"), message.User, message.Message)
+		printShout(box, message)
 		if message.Id > maxID {
 			maxID = message.Id
 		}
@@ -132,19 +171,30 @@ func shoutboxPoll(box string, refresh int) error {
 		if repeat < 0 {
 			repeat *= -1
 		}
-		for i := 0; i < refresh; i++ {
-			fmt.Printf(statusbar, refresh-i, extraStatus, strings.Repeat(" ", repeat))
-			time.Sleep(time.Second * 1)
+		// the status bar would only clutter machine readable output
+		if machineOutput() {
+			time.Sleep(time.Second * time.Duration(refresh))
+		} else {
+			for i := 0; i < refresh; i++ {
+				fmt.Printf(statusbar, refresh-i, extraStatus, strings.Repeat(" ", repeat))
+				time.Sleep(time.Second * 1)
+			}
+			fmt.Print("[refreshing]" + strings.Repeat(" ", repeat+3) + "\r")
 		}
-		fmt.Print("[refreshing]" + strings.Repeat(" ", repeat+3) + "\r")
 
-		messages, err := api.ShoutboxRead(c, boxID, maxID)
+		var messages []api.ShoutboxMessage
+		err := withSession(func() (err error) {
+			messages, err = api.ShoutboxRead(c, boxID, maxID)
+			return err
+		})
 		if err != nil {
 			extraStatus = " - last error: " + strings.TrimRight(err.Error(), "\n")
 			continue
 		}
 
-		fmt.Print(strings.Repeat(" ", repeat+15) + "\r")
+		if !machineOutput() {
+			fmt.Print(strings.Repeat(" ", repeat+15) + "\r")
+		}
 		extraStatus = ""
 		for _, message := range messages {
 			// control messages
@@ -156,7 +206,7 @@ func shoutboxPoll(box string, refresh int) error {
 				}
 				continue
 			}
-			fmt.Printf("[%s] <%s> %s\n", message.Date.Format("01.02 15:04"), message.User, message.Message)
+			printShout(box, message)
 			if message.Id > maxID {
 				maxID = message.Id
 			}
@@ -0,0 +1,187 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/fuchsi/irrenhaus-api/Category"
+)
+
+// Functions available in output templates
+var TemplateFuncs = template.FuncMap{
+	"human":    templateHuman,
+	"date":     templateDate,
+	"category": templateCategory,
+	"truncate": templateTruncate,
+	"pad":      templatePad,
+	"json":     templateJSON,
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"join":     strings.Join,
+}
+
+var outputTemplate *template.Template
+
+// Load the output template
+// format is either a template string or the name of a template file in the
+// templates directory of the config path.
+// It returns any error encountered.
+func loadOutputTemplate(format string) error {
+	text := format
+	if !strings.Contains(format, "{{") {
+		file := CONFIGPATH + "templates/" + format + ".tmpl"
+		content, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("unknown template '%s', %s does not exist", format, file)
+		}
+		if err != nil {
+			return err
+		}
+		text = strings.TrimRight(string(content), "\n")
+	}
+
+	// allow escape sequences on the command line, e.g. '{{.Id}}\t{{.Name}}'
+	text = strings.NewReplacer(`\t`, "\t", `\n`, "\n").Replace(text)
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+
+	tmpl, err := template.New("output").Funcs(TemplateFuncs).Parse(text)
+	if err != nil {
+		return err
+	}
+	outputTemplate = tmpl
+
+	return nil
+}
+
+// Execute the output template once for every record
+// records can be a single record or a slice of records.
+// It returns any error encountered.
+func executeOutputTemplate(w io.Writer, records interface{}) error {
+	return executeTemplate(w, outputTemplate, records)
+}
+
+// Execute a template once for every record
+//  tmpl: The output template or one of its named templates
+//  records: A single record or a slice of records
+// It returns any error encountered.
+func executeTemplate(w io.Writer, tmpl *template.Template, records interface{}) error {
+	value := reflect.ValueOf(records)
+	if value.Kind() != reflect.Slice {
+		return tmpl.Execute(w, records)
+	}
+
+	for i := 0; i < value.Len(); i++ {
+		if err := tmpl.Execute(w, value.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Format a size in bytes in a human readable way
+func templateHuman(size interface{}) string {
+	value := reflect.ValueOf(size)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value.Int() < 0 {
+			return "-" + datasize.ByteSize(-value.Int()).HumanReadable()
+		}
+		return datasize.ByteSize(value.Int()).HumanReadable()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return datasize.ByteSize(value.Uint()).HumanReadable()
+	case reflect.Float32, reflect.Float64:
+		return datasize.ByteSize(value.Float()).HumanReadable()
+	}
+
+	return fmt.Sprint(size)
+}
+
+// Format a date with a Go time layout, e.g. {{date .Added "2006-01-02"}}
+// The layout defaults to the format used in tables.
+func templateDate(t interface{}, layout ...string) string {
+	format := "02.01.2006 15:04:05"
+	if len(layout) > 0 {
+		format = layout[0]
+	}
+
+	switch date := t.(type) {
+	case time.Time:
+		return date.Format(format)
+	case *time.Time:
+		if date == nil {
+			return ""
+		}
+		return date.Format(format)
+	}
+
+	return fmt.Sprint(t)
+}
+
+// Get the name of a category ID
+func templateCategory(id int) string {
+	name, err := Category.ToString(id)
+	if err != nil {
+		return "-"
+	}
+
+	return name
+}
+
+// Truncate a string to n runes, marking the cut with an ellipsis, e.g. {{.Name | truncate 40}}
+func templateTruncate(n int, s string) string {
+	runes := []rune(s)
+	if n <= 0 || len(runes) <= n {
+		return s
+	}
+	if n == 1 {
+		return "…"
+	}
+
+	return string(runes[:n-1]) + "…"
+}
+
+// Pad a string with spaces to n runes, e.g. {{.Name | pad 40}}
+func templatePad(n int, s string) string {
+	length := len([]rune(s))
+	if length >= n {
+		return s
+	}
+
+	return s + strings.Repeat(" ", n-length)
+}
+
+// Serialize a value as JSON
+func templateJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+
+	return string(b), err
+}
@@ -19,127 +19,262 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
-	"sort"
+	"path/filepath"
 	"strings"
 
 	"github.com/c2h5oh/datasize"
 	api "github.com/fuchsi/irrenhaus-api"
-	"github.com/fuchsi/irrenhaus-api/Category"
-	"github.com/olekukonko/tablewriter"
 )
 
+// Error returned if the destination of a download already exists
+var ErrExists = errors.New("file already exists")
+
 func download(tid int64, destination string) error {
+	path, err := fetchTorrent(tid, destination, *forceFlag, func() {})
+	if err == ErrExists {
+		PrintQuiet("Skipping", path+", it already exists. Use --force to overwrite it")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	PrintQuiet("Download to", path, "complete")
+
+	if *clientOpt != "" {
+		client, err := newTorrentClient(*clientOpt)
+		if err != nil {
+			return err
+		}
+		return sendToClient(client, *clientOpt, path)
+	}
+
+	return nil
+}
+
+// Download the content of a torrent file
+//  tid:  Torrent-ID
+//  wait: Called before every request to the site, see newRequestLimiter
+// It returns the content, the filename from the server and any error encountered.
+func fetchTorrentData(tid int64, wait func()) ([]byte, string, error) {
 	PrintVerbose("Downloading torrent", tid)
 	c := getConnection()
 
-	body, filename, err := api.DownloadTorrent(c, tid)
+	var body []byte
+	var filename string
+	err := withSession(func() (err error) {
+		wait()
+		body, filename, err = api.DownloadTorrent(c, tid)
+		if err != nil {
+			return err
+		}
+		// a login page instead of the torrent means the session has expired
+		return checkNotHTML(body)
+	})
+
+	return body, filename, err
+}
+
+// Download a torrent file
+//  tid:         Torrent-ID
+//  destination: File or directory, defaults to the filename from the server
+//  force:       Overwrite existing files
+//  wait:        Called before every request to the site, see newRequestLimiter
+// It returns the path of the torrent file and any error encountered.
+func fetchTorrent(tid int64, destination string, force bool, wait func()) (string, error) {
+	c := getConnection()
+
+	body, filename, err := fetchTorrentData(tid, wait)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	PrintVerbose("Filename from Server:", filename)
-	if destination == "" {
-		destination = filename
-	} else if !strings.HasSuffix(destination, ".torrent") {
-		destination = destination + "/" + filename
-	}
 
-	file, err := os.Create(destination)
+	meta, err := parseTorrent(body)
 	if err != nil {
-		log.Fatal(err)
+		return "", fmt.Errorf("torrent %d: %s", tid, err.Error())
 	}
-	defer file.Close()
 
-	writer := bufio.NewWriter(file)
-	writer.Write(body)
+	nameTemplate := downloadNameTemplate()
+	explicit := strings.HasSuffix(destination, ".torrent")
 
-	PrintQuiet("Download to", destination, "complete")
+	// the details feed both the info hash check and the name template
+	var entry api.Entry
+	if !*noVerifyFlag || (nameTemplate != "" && !explicit) {
+		err = withSession(func() (err error) {
+			wait()
+			entry, err = api.Details(c, tid, false, false, false)
+			return err
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	if !*noVerifyFlag {
+		if err := verifyInfoHash(tid, meta, entry); err != nil {
+			return "", err
+		}
+	}
+
+	if !explicit {
+		name := sanitizeFilename(filename)
+		if nameTemplate != "" {
+			name, err = renderNameTemplate(nameTemplate, entry, filename)
+			if err != nil {
+				return "", err
+			}
+		}
+		destination = filepath.Join(destination, name)
+	}
+
+	downloadPathMutex.Lock()
+	defer downloadPathMutex.Unlock()
+
+	if _, err := os.Stat(destination); err == nil && !force {
+		// the same torrent is skipped, a different one gets a new name
+		existing, err := loadTorrent(destination)
+		if explicit || (err == nil && existing.InfoHash == meta.InfoHash) {
+			return destination, ErrExists
+		}
+		destination = uniquePath(destination)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+		return destination, err
+	}
+	if err := writeFileAtomic(destination, body, 0644); err != nil {
+		return destination, err
+	}
+
+	return destination, nil
+}
+
+// Get the name template for downloads from the command line or the config
+func downloadNameTemplate() string {
+	if *nameTemplateOpt != "" {
+		return *nameTemplateOpt
+	}
+
+	return config.NameTemplate
+}
+
+// Compare the info hash of a downloaded torrent with the one shown on the site
+// It returns an error if they differ.
+func verifyInfoHash(tid int64, meta *metaInfo, entry api.Entry) error {
+	if entry.InfoHash == "" {
+		PrintVerbose("No info hash for torrent", tid, "on the site, skipping the check")
+		return nil
+	}
+	if !strings.EqualFold(strings.TrimSpace(entry.InfoHash), meta.InfoHash) {
+		return fmt.Errorf("torrent %d: info hash %s does not match %s from the site", tid, meta.InfoHash, entry.InfoHash)
+	}
+	PrintVerbose("Info hash", meta.InfoHash, "verified")
 
 	return nil
 }
 
-func upload(meta string, nfo string, image1 string, image2 string, name string, description string, category int) error {
-	metard, err := os.Open(meta)
-	if err != nil {
-		return err
+// Validate and upload a torrent, or only print the validation report with --dry-run
+// It returns any error encountered.
+func upload(m *uploadManifest) error {
+	checks := validateUpload(m)
+	failed := failedChecks(checks)
+	if *dryRunFlag {
+		if err := printValidation([]string{m.Name}, [][]validationCheck{checks}); err != nil {
+			return err
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d checks failed", failed)
+		}
+		PrintQuiet("All checks passed. Dry run, nothing was uploaded")
+		return nil
+	}
+	if failed > 0 {
+		for _, check := range checks {
+			if !check.Ok {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", check.Check, check.Detail)
+			}
+		}
+		return fmt.Errorf("%d checks failed, nothing was uploaded. Use --dry-run for the full report", failed)
 	}
-	defer metard.Close()
 
-	nford, err := os.Open(nfo)
+	id, err := uploadRelease(m)
 	if err != nil {
 		return err
 	}
-	defer nford.Close()
 
-	imagerd, err := os.Open(image1)
+	fmt.Println("Upload successful:", detailsURL(id))
+	return nil
+}
+
+// Get the URL of the details page of a torrent
+func detailsURL(tid int64) string {
+	return fmt.Sprintf("%s/details.php?id=%d", profile.Url, tid)
+}
+
+// Upload a torrent
+//  images:      One or two images
+//  description: BBCode of the description
+// It returns the Torrent-ID and any error encountered.
+func uploadTorrent(meta string, nfo string, images []*preparedImage, name string, description string, category int) (int64, error) {
+	metard, err := os.Open(meta)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	defer imagerd.Close()
+	defer metard.Close()
 
-	temp, err := ioutil.ReadFile(description)
+	nford, err := os.Open(nfo)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	defer nford.Close()
+
+	if len(images) < 1 || len(images) > 2 {
+		return 0, errors.New("one or two images are required")
 	}
-	descriptionString := string(temp)
+	imagerd := bytes.NewReader(images[0].Data)
 
-	t, err := api.NewUpload(getConnection(), metard, nford, imagerd, name, category, descriptionString)
+	t, err := api.NewUpload(getConnection(), metard, nford, imagerd, name, category, description)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if image2 != "" {
-		image2rd, err := os.Open(image2)
-		if err != nil {
-			return err
-		}
-		defer image2rd.Close()
-		t.Image2 = image2rd
+	if len(images) > 1 {
+		t.Image2 = bytes.NewReader(images[1].Data)
 	}
 
-	if err := t.Upload(); err != nil {
-		return err
+	err = withSessionWrite(t.Upload)
+	if err != nil {
+		return 0, err
 	}
 
-	fmt.Printf("Upload successful: %s/details.php?id=%d\n", config.Url, t.Id)
-	return nil
+	return t.Id, nil
 }
 
+// Search for torrents and print the results
+// The results are filtered, sorted and limited on the client side.
+// It returns any error encountered.
 func search(needle string, categories []int, dead bool) error {
-	c := getConnection()
-
-	entries, err := api.Search(c, needle, categories, dead)
+	options, err := newSearchOptions()
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Found %d Torrents\n", len(entries))
-	table := tablewriter.NewWriter(os.Stdout)
-	table.SetHeader([]string{"ID", "Name", "Size", "Date", "S", "L"})
+	c := getConnection()
 
-	sort.SliceStable(entries, func(i, j int) bool {
-		return entries[i].Added.Unix() > entries[j].Added.Unix()
+	var entries []api.Entry
+	err = withSession(func() (err error) {
+		entries, err = api.Search(c, needle, categories, dead)
+		return err
 	})
-
-	for _, entry := range entries {
-		table.Append([]string{
-			fmt.Sprintf("%d", entry.Id),
-			entry.Name,
-			datasize.ByteSize(entry.Size).HumanReadable(),
-			entry.Added.Format("02.01.2006 15:04:05"),
-			fmt.Sprintf("%d", entry.SeederCount),
-			fmt.Sprintf("%d", entry.LeecherCount),
-		})
+	if err != nil {
+		return err
 	}
 
-	table.Render()
-
-	return nil
+	return showSearchResults(entries, options, "Found %d Torrents")
 }
 
 func details(tid int64, subcommand string) error {
@@ -166,58 +301,72 @@ func details(tid int64, subcommand string) error {
 		snatches = true
 	}
 
-	entry, err := api.Details(c, tid, files, peers, snatches)
+	var entry api.Entry
+	err := withSession(func() (err error) {
+		entry, err = api.Details(c, tid, files, peers, snatches)
+		return err
+	})
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(entry.Name)
+	record := newTorrentRecord(entry)
+	sections := []Section{{Title: entry.Name}}
 
 	if info {
-		category, err := Category.ToString(entry.Category)
-		if err != nil {
-			category = "-"
-		}
-		fmt.Printf("ID:        %d\n", entry.Id)
-		fmt.Printf("Info Hash: %s\n", entry.InfoHash)
-		fmt.Printf("Category:  %s\n", category)
-		fmt.Printf("Size:      %s\n", datasize.ByteSize(entry.Size).HumanReadable())
-		fmt.Printf("Added:     %s\n", entry.Added.Format("02.01.2006 15:04:05"))
-		fmt.Printf("#Files:    %d\n", entry.FileCount)
-		fmt.Printf("#Seeders:  %d\n", entry.SeederCount)
-		fmt.Printf("#Leechers: %d\n", entry.LeecherCount)
-		fmt.Printf("#Snatched: %d\n", entry.SnatchCount)
-
-		fmt.Println("Description:")
-		fmt.Println(entry.Description)
+		sections = append(sections, Section{
+			Rows: [][]string{
+				{"ID", fmt.Sprintf("%d", entry.Id)},
+				{"Info Hash", entry.InfoHash},
+				{"Category", record.CategoryName},
+				{"Size", datasize.ByteSize(entry.Size).HumanReadable()},
+				{"Added", entry.Added.Format("02.01.2006 15:04:05")},
+				{"#Files", fmt.Sprintf("%d", entry.FileCount)},
+				{"#Seeders", fmt.Sprintf("%d", entry.SeederCount)},
+				{"#Leechers", fmt.Sprintf("%d", entry.LeecherCount)},
+				{"#Snatched", fmt.Sprintf("%d", entry.SnatchCount)},
+			},
+			Records: record,
+		}, Section{
+			Title: "Description:",
+			Text:  entry.Description,
+		})
+	} else {
+		record.Description = ""
 	}
 
 	if files {
-		fmt.Println("Files:")
-		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Name", "Size"})
+		rows := make([][]string, 0, len(entry.Files))
 		for _, file := range entry.Files {
-			table.Append([]string{file.Name, datasize.ByteSize(file.Size).HumanReadable()})
+			rows = append(rows, []string{file.Name, datasize.ByteSize(file.Size).HumanReadable()})
 		}
-		table.Render()
+		sections = append(sections, Section{
+			Title:    "Files:",
+			Header:   []string{"Name", "Size"},
+			Rows:     rows,
+			Records:  record.Files,
+			Template: "files",
+		})
 	}
 
 	if peers {
-		fmt.Println("Seeders:")
-		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Name", "Con", "ULed", "Up Rate", "DLed", "Down Rate", "Ratio", "Client"})
-
-		for _, peer := range entry.Peers {
+		seeders := make([][]string, 0)
+		leechers := make([][]string, 0)
+		seederRecords := make([]peerRecord, 0)
+		leecherRecords := make([]peerRecord, 0)
+
+		for i, peer := range entry.Peers {
+			conStr := "No"
+			if peer.Connectable {
+				conStr = "Yes"
+			}
 			if peer.Seeder {
-				conStr := "No"
 				ratioStr := "Inf."
-				if peer.Connectable {
-					conStr = "Yes"
-				}
 				if peer.Ratio > 0 {
 					ratioStr = fmt.Sprintf("%0.3f", peer.Ratio)
 				}
-				table.Append([]string{
+				seederRecords = append(seederRecords, record.Peers[i])
+				seeders = append(seeders, []string{
 					peer.Name,
 					conStr,
 					datasize.ByteSize(peer.Uploaded).HumanReadable(),
@@ -227,22 +376,9 @@ func details(tid int64, subcommand string) error {
 					ratioStr,
 					peer.Client,
 				})
-			}
-		}
-
-		table.Render()
-
-		fmt.Println("Leechers:")
-		table2 := tablewriter.NewWriter(os.Stdout)
-		table2.SetHeader([]string{"Name", "Con", "ULed", "Up Rate", "DLed", "Down Rate", "Ratio", "Complete", "Client"})
-
-		for _, peer := range entry.Peers {
-			if !peer.Seeder {
-				conStr := "No"
-				if peer.Connectable {
-					conStr = "Yes"
-				}
-				table2.Append([]string{
+			} else {
+				leecherRecords = append(leecherRecords, record.Peers[i])
+				leechers = append(leechers, []string{
 					peer.Name,
 					conStr,
 					datasize.ByteSize(peer.Uploaded).HumanReadable(),
@@ -256,20 +392,29 @@ func details(tid int64, subcommand string) error {
 			}
 		}
 
-		table2.Render()
+		sections = append(sections, Section{
+			Title:    "Seeders:",
+			Header:   []string{"Name", "Con", "ULed", "Up Rate", "DLed", "Down Rate", "Ratio", "Client"},
+			Rows:     seeders,
+			Records:  seederRecords,
+			Template: "peers",
+		}, Section{
+			Title:    "Leechers:",
+			Header:   []string{"Name", "Con", "ULed", "Up Rate", "DLed", "Down Rate", "Ratio", "Complete", "Client"},
+			Rows:     leechers,
+			Records:  leecherRecords,
+			Template: "peers",
+		})
 	}
 
 	if snatches {
-		fmt.Println("Snatches:")
-		table := tablewriter.NewWriter(os.Stdout)
-		table.SetHeader([]string{"Name", "ULed", "DLed", "Ratio", "Stopped"})
-
+		rows := make([][]string, 0, len(entry.Snatches))
 		for _, snatch := range entry.Snatches {
 			stoppedStr := "No"
 			if !snatch.Seeding {
 				stoppedStr = snatch.Stopped.Format("02.01.2006 15:04:05")
 			}
-			table.Append([]string{
+			rows = append(rows, []string{
 				snatch.Name,
 				datasize.ByteSize(snatch.Uploaded).HumanReadable(),
 				datasize.ByteSize(snatch.Downloaded).HumanReadable(),
@@ -277,17 +422,26 @@ func details(tid int64, subcommand string) error {
 				stoppedStr,
 			})
 		}
-
-		table.Render()
+		sections = append(sections, Section{
+			Title:    "Snatches:",
+			Header:   []string{"Name", "ULed", "DLed", "Ratio", "Stopped"},
+			Rows:     rows,
+			Records:  record.Snatches,
+			Template: "snatches",
+		})
 	}
 
-	return nil
+	return Render(Output{Data: record, Sections: sections})
 }
 
 func thank(tid int64) error {
 	c := getConnection()
 
-	ok, err := api.Thank(c, tid)
+	var ok bool
+	err := withSessionWrite(func() (err error) {
+		ok, err = api.Thank(c, tid)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,329 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/fuchsi/irrenhaus-api/Category"
+)
+
+// Limits for uploads
+const (
+	maxNameLength = 255
+	maxNfoSize    = 1 << 20
+)
+
+// Characters not allowed in torrent names
+const forbiddenNameChars = `\/:*?"<>|`
+
+// Result of a single validation check
+type validationCheck struct {
+	Check  string `json:"check"`
+	Ok     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// CP437 characters 0x80 to 0xFF, the encoding of most NFO files
+var cp437 = []rune("ÇüéâäàåçêëèïîìÄÅÉæÆôöòûùÿÖÜ¢£¥₧ƒáíóúñÑªº¿⌐¬½¼¡«»" +
+	"░▒▓│┤╡╢╖╕╣║╗╝╜╛┐└┴┬├─┼╞╟╚╔╩╦╠═╬╧╨╤╥╙╘╒╓╫╪┘┌█▄▌▐▀" +
+	"αßΓπΣσµτΦΘΩδ∞φε∩≡±≥≤⌠⌡÷≈°∙·√ⁿ²■ ")
+
+// Decode the content of an NFO file
+// It returns the text and the encoding, UTF-8 or CP437.
+func decodeNfo(content []byte) (string, string) {
+	content = bytes.TrimPrefix(content, []byte("\xef\xbb\xbf"))
+	if utf8.Valid(content) {
+		return string(content), "UTF-8"
+	}
+
+	var builder strings.Builder
+	for _, b := range content {
+		if b < 0x80 {
+			builder.WriteByte(b)
+		} else {
+			builder.WriteRune(cp437[b-0x80])
+		}
+	}
+
+	return builder.String(), "CP437"
+}
+
+// Check if a text contains control characters which do not belong into a text file
+func isBinaryText(text string) bool {
+	for _, r := range text {
+		// tab, line breaks, escape sequences and the DOS end of file mark are common in NFOs
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' && r != 0x1a && r != 0x1b {
+			return true
+		}
+	}
+
+	return false
+}
+
+func checkTorrentFile(path string) validationCheck {
+	check := validationCheck{Check: "torrent"}
+	meta, err := loadTorrent(path)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	if !meta.Private {
+		check.Detail = "the torrent is not private, create it with the private flag"
+		return check
+	}
+
+	check.Ok = true
+	check.Detail = fmt.Sprintf("private, %d files, %s, %d pieces", len(meta.Files),
+		datasize.ByteSize(meta.TotalLength()).HumanReadable(), len(meta.Pieces)/sha1.Size)
+	return check
+}
+
+func checkTorrentSource(path string) validationCheck {
+	check := validationCheck{Check: "from"}
+	files, err := collectFiles(path)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	var total int64
+	for _, file := range files {
+		total += file.Length
+	}
+	if total == 0 {
+		check.Detail = "all files are empty"
+		return check
+	}
+
+	check.Ok = true
+	check.Detail = fmt.Sprintf("%d files, %s, the private torrent is created on upload", len(files),
+		datasize.ByteSize(total).HumanReadable())
+	return check
+}
+
+func checkNfo(path string) validationCheck {
+	check := validationCheck{Check: "nfo"}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	if len(bytes.TrimSpace(content)) == 0 {
+		check.Detail = "the NFO is empty"
+		return check
+	}
+	if len(content) > maxNfoSize {
+		check.Detail = fmt.Sprintf("the NFO is larger than %s", datasize.ByteSize(maxNfoSize).HumanReadable())
+		return check
+	}
+	text, encoding := decodeNfo(content)
+	if isBinaryText(text) {
+		check.Detail = "the NFO is not a text file"
+		return check
+	}
+
+	check.Ok = true
+	check.Detail = fmt.Sprintf("%s, %d lines", encoding, strings.Count(strings.TrimRight(text, "\r\n"), "\n")+1)
+	return check
+}
+
+func checkDescription(m *uploadManifest) validationCheck {
+	check := validationCheck{Check: "description"}
+	text, err := renderDescription(m.Description, m)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	if strings.TrimSpace(text) == "" {
+		check.Detail = "the description is empty"
+		return check
+	}
+	if !utf8.ValidString(text) {
+		check.Detail = "the description is not valid UTF-8"
+		return check
+	}
+
+	check.Ok = true
+	check.Detail = fmt.Sprintf("%d characters", utf8.RuneCountInString(text))
+	return check
+}
+
+func checkImage(name string, path string) validationCheck {
+	check := validationCheck{Check: name}
+	prepared, err := prepareImage(path)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+
+	check.Ok = true
+	check.Detail = prepared.String()
+	return check
+}
+
+func checkContactSheet(paths []string) validationCheck {
+	check := validationCheck{Check: "contact sheet"}
+	sheet, err := prepareContactSheet(paths)
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+
+	check.Ok = true
+	check.Detail = sheet.String()
+	return check
+}
+
+func checkName(name string) validationCheck {
+	check := validationCheck{Check: "name"}
+	switch {
+	case strings.TrimSpace(name) == "":
+		check.Detail = "the name is empty"
+	case strings.TrimSpace(name) != name:
+		check.Detail = "the name starts or ends with spaces"
+	case utf8.RuneCountInString(name) > maxNameLength:
+		check.Detail = fmt.Sprintf("the name is longer than %d characters", maxNameLength)
+	case strings.ContainsAny(name, forbiddenNameChars):
+		check.Detail = fmt.Sprintf("the name contains one of the characters %s", forbiddenNameChars)
+	case strings.IndexFunc(name, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0:
+		check.Detail = "the name contains control characters"
+	default:
+		check.Ok = true
+		check.Detail = name
+	}
+
+	return check
+}
+
+func checkCategory(m *uploadManifest) validationCheck {
+	check := validationCheck{Check: "category"}
+	if m.Category == "" {
+		check.Detail = "missing category"
+		return check
+	}
+	category, err := resolveSingleCategory(strings.Split(m.Category, ","))
+	if err != nil {
+		check.Detail = err.Error()
+		return check
+	}
+	m.categoryId = category
+
+	check.Ok = true
+	check.Detail = fmt.Sprintf("%d", category)
+	if name, err := Category.ToString(category); err == nil {
+		check.Detail += " " + name
+	}
+	return check
+}
+
+// Validate an upload without touching the network, and fill in the category ID
+// It returns the results of all checks.
+func validateUpload(m *uploadManifest) []validationCheck {
+	checks := make([]validationCheck, 0)
+	missing := func(name string) {
+		checks = append(checks, validationCheck{Check: name, Detail: "missing " + name})
+	}
+
+	switch {
+	case m.Torrent != "" && m.From != "":
+		checks = append(checks, validationCheck{Check: "torrent", Detail: "torrent and from are mutually exclusive"})
+	case m.Torrent != "":
+		checks = append(checks, checkTorrentFile(m.Torrent))
+	case m.From != "":
+		checks = append(checks, checkTorrentSource(m.From))
+	default:
+		missing("torrent")
+	}
+
+	if m.Nfo == "" {
+		missing("nfo")
+	} else {
+		checks = append(checks, checkNfo(m.Nfo))
+	}
+	// the category is resolved first, description templates may use it
+	category := checkCategory(m)
+	if m.Description == "" {
+		missing("description")
+	} else {
+		checks = append(checks, checkDescription(m))
+	}
+
+	images := len(m.Images)
+	if len(m.ContactSheet) > 0 {
+		images++
+	}
+	if images < 1 || images > 2 {
+		checks = append(checks, validationCheck{Check: "images", Detail: "one or two images are required, a contact sheet counts as one"})
+	}
+	for i, path := range m.Images {
+		checks = append(checks, checkImage(fmt.Sprintf("image%d", i+1), path))
+	}
+	if len(m.ContactSheet) > 0 {
+		checks = append(checks, checkContactSheet(m.ContactSheet))
+	}
+
+	checks = append(checks, checkName(m.Name))
+	checks = append(checks, category)
+
+	return checks
+}
+
+// Count the failed checks
+func failedChecks(checks []validationCheck) int {
+	failed := 0
+	for _, check := range checks {
+		if !check.Ok {
+			failed++
+		}
+	}
+
+	return failed
+}
+
+// Print the report of validated uploads
+//  titles: Title of every upload, e.g. the manifest file
+//  checks: Checks of every upload
+// It returns any error encountered.
+func printValidation(titles []string, checks [][]validationCheck) error {
+	sections := make([]Section, 0, len(checks))
+	for i := range checks {
+		rows := make([][]string, 0, len(checks[i]))
+		for _, check := range checks[i] {
+			result := "ok"
+			if !check.Ok {
+				result = "FAILED"
+			}
+			rows = append(rows, []string{check.Check, result, check.Detail})
+		}
+		sections = append(sections, Section{
+			Title:   titles[i],
+			Header:  []string{"Check", "Result", "Detail"},
+			Rows:    rows,
+			Records: checks[i],
+		})
+	}
+
+	return Render(Output{Data: checks, Sections: sections})
+}
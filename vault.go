@@ -0,0 +1,324 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+const vaultVersion = 1
+
+// Default scrypt parameters for new vaults
+const (
+	vaultScryptN = 1 << 15
+	vaultScryptR = 8
+	vaultScryptP = 1
+)
+
+// Encrypted vault file as stored on disk
+type vaultFile struct {
+	Version int
+	Salt    []byte
+	N       int
+	R       int
+	P       int
+	Nonce   []byte
+	Box     []byte
+}
+
+// Secrets of a profile
+type vaultSecret struct {
+	Password string
+	Pin      string
+}
+
+// Decrypted content of the vault, by profile name
+type vaultSecrets map[string]vaultSecret
+
+var ErrVaultPassphrase = errors.New("wrong vault passphrase")
+
+// Get the path of the vault file
+func vaultPath() string {
+	return CONFIGPATH + "vault.json"
+}
+
+// Check if a vault file exists
+func vaultExists() bool {
+	_, err := os.Stat(vaultPath())
+
+	return err == nil
+}
+
+// Derive the secretbox key from the passphrase
+func vaultKey(passphrase string, vault vaultFile) (*[32]byte, error) {
+	derived, err := scrypt.Key([]byte(passphrase), vault.Salt, vault.N, vault.R, vault.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	key := new([32]byte)
+	copy(key[:], derived)
+
+	return key, nil
+}
+
+// Load and decrypt the vault
+// It returns the secrets and any error encountered.
+func loadVault(passphrase string) (vaultSecrets, error) {
+	if err := checkPermissions(vaultPath()); err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(vaultPath())
+	if err != nil {
+		return nil, err
+	}
+	vault := vaultFile{}
+	if err := json.Unmarshal(content, &vault); err != nil {
+		return nil, err
+	}
+	if vault.Version != vaultVersion {
+		return nil, fmt.Errorf("unsupported vault version %d", vault.Version)
+	}
+	if len(vault.Nonce) != 24 {
+		return nil, errors.New("corrupt vault: invalid nonce")
+	}
+
+	key, err := vaultKey(passphrase, vault)
+	if err != nil {
+		return nil, err
+	}
+	nonce := new([24]byte)
+	copy(nonce[:], vault.Nonce)
+
+	plain, ok := secretbox.Open(nil, vault.Box, nonce, key)
+	if !ok {
+		return nil, ErrVaultPassphrase
+	}
+
+	secrets := make(vaultSecrets)
+	if err := json.Unmarshal(plain, &secrets); err != nil {
+		return nil, err
+	}
+
+	return secrets, nil
+}
+
+// Encrypt and write the vault
+// Every write uses a fresh salt and nonce.
+// It returns any error encountered.
+func dumpVault(secrets vaultSecrets, passphrase string) error {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+
+	vault := vaultFile{
+		Version: vaultVersion,
+		Salt:    make([]byte, 32),
+		N:       vaultScryptN,
+		R:       vaultScryptR,
+		P:       vaultScryptP,
+		Nonce:   make([]byte, 24),
+	}
+	if _, err := io.ReadFull(rand.Reader, vault.Salt); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rand.Reader, vault.Nonce); err != nil {
+		return err
+	}
+
+	key, err := vaultKey(passphrase, vault)
+	if err != nil {
+		return err
+	}
+	nonce := new([24]byte)
+	copy(nonce[:], vault.Nonce)
+	vault.Box = secretbox.Seal(nil, plain, nonce, key)
+
+	content, err := json.Marshal(vault)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(vaultPath(), content, 0600)
+}
+
+// Get the vault passphrase
+// The passphrase is taken from the agent, the IRRENHAUS_PASSPHRASE environment variable or
+// asked on the terminal, in that order.
+// It returns the passphrase and any error encountered.
+func vaultPassphrase() (string, error) {
+	if passphrase, err := agentGet(); err == nil && passphrase != "" {
+		return passphrase, nil
+	}
+	if passphrase := os.Getenv("IRRENHAUS_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+
+	return AskSecret("Vault passphrase")
+}
+
+// Ask for a new vault passphrase, twice
+// It returns the passphrase and any error encountered.
+func vaultNewPassphrase() (string, error) {
+	if passphrase := os.Getenv("IRRENHAUS_PASSPHRASE"); passphrase != "" {
+		return passphrase, nil
+	}
+
+	passphrase, err := AskSecret("New vault passphrase")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("the passphrase must not be empty")
+	}
+	repeat, err := AskSecret("Repeat the passphrase")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != repeat {
+		return "", errors.New("the passphrases do not match")
+	}
+
+	return passphrase, nil
+}
+
+// Open the vault, asking for the passphrase
+// If the vault does not exist yet, a new passphrase is asked for.
+// The passphrase is handed to a running agent after a successful unlock.
+// It returns the secrets, the passphrase and any error encountered.
+func unlockVault() (vaultSecrets, string, error) {
+	if !vaultExists() {
+		passphrase, err := vaultNewPassphrase()
+		return make(vaultSecrets), passphrase, err
+	}
+
+	passphrase, err := vaultPassphrase()
+	if err != nil {
+		return nil, "", err
+	}
+	secrets, err := loadVault(passphrase)
+	if err != nil {
+		return nil, "", err
+	}
+	agentSet(passphrase)
+
+	return secrets, passphrase, nil
+}
+
+// Fill in the secrets of the active profile from the vault
+// It returns any error encountered.
+func loadProfileSecrets() error {
+	if profile.Password != "" || !vaultExists() {
+		return nil
+	}
+
+	secrets, _, err := unlockVault()
+	if err != nil {
+		return err
+	}
+
+	secret, ok := secrets[profileName]
+	if !ok {
+		return fmt.Errorf("no secrets for profile '%s' in the vault", profileName)
+	}
+	profile.Password = secret.Password
+	profile.Pin = secret.Pin
+
+	return nil
+}
+
+// Store the secrets of a profile in the vault and remove them from the profile
+// It returns the profile without secrets and any error encountered.
+func storeProfileSecrets(name string, p Profile) (Profile, error) {
+	secrets, passphrase, err := unlockVault()
+	if err != nil {
+		return p, err
+	}
+
+	secrets[name] = vaultSecret{p.Password, p.Pin}
+	if err := dumpVault(secrets, passphrase); err != nil {
+		return p, err
+	}
+
+	p.Password = ""
+	p.Pin = ""
+
+	return p, nil
+}
+
+// Move the plaintext secrets of every profile into the vault
+// It returns any error encountered.
+func migrateSecrets() error {
+	secrets, passphrase, err := unlockVault()
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for name, p := range config.Profiles {
+		if p.Password == "" && p.Pin == "" {
+			continue
+		}
+		secrets[name] = vaultSecret{p.Password, p.Pin}
+		p.Password = ""
+		p.Pin = ""
+		config.Profiles[name] = p
+		migrated++
+	}
+
+	// write the vault first, a failure must not lose the secrets
+	if err := dumpVault(secrets, passphrase); err != nil {
+		return err
+	}
+	if err := dumpConfig(config, configFile); err != nil {
+		return err
+	}
+
+	PrintQuiet("Moved the secrets of", migrated, "profiles into", vaultPath())
+	return nil
+}
+
+// Ask the user for a secret without echoing it
+//  prompt: Prompt/Question for the user
+// It returns the secret and any error encountered.
+func AskSecret(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		var result string
+		err := Ask(prompt, &result)
+		return result, err
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: ", prompt)
+	secret, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+
+	return string(secret), err
+}
@@ -0,0 +1,387 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/c2h5oh/datasize"
+)
+
+// States of the files of a verified torrent
+const (
+	VerifyOk        = "ok"
+	VerifyMissing   = "missing"
+	VerifySize      = "wrong size"
+	VerifyCorrupted = "corrupt"
+)
+
+// Memory for the piece buffers of all workers, parseTorrent limits a single piece to 256 MiB
+const maxVerifyMemory = 256 * 1024 * 1024
+
+// A file of the torrent and where it is on disk
+type verifyFile struct {
+	Path   string `json:"path"`
+	Source string `json:"source"`
+	Length int64  `json:"length"`
+	// offset of the file in the stream of pieces
+	Offset int64  `json:"-"`
+	Status string `json:"status"`
+	// size on disk, if it differs
+	Size      int64 `json:"size,omitempty"`
+	BadPieces []int `json:"bad_pieces,omitempty"`
+
+	file *os.File
+}
+
+type verifyRecord struct {
+	Name        string       `json:"name"`
+	InfoHash    string       `json:"info_hash"`
+	Root        string       `json:"root"`
+	Pieces      int          `json:"pieces"`
+	GoodPieces  int          `json:"good_pieces"`
+	Complete    float64      `json:"complete"`
+	Files       []verifyFile `json:"files"`
+	BadPieceIds []int        `json:"bad_pieces,omitempty"`
+}
+
+// Read a .torrent file, or download the torrent with a Torrent-ID
+// It returns the metainfo and any error encountered.
+func loadVerifyTorrent(arg string) (*metaInfo, error) {
+	tid, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return loadTorrent(arg)
+	}
+
+	body, _, err := fetchTorrentData(tid, func() {})
+	if err != nil {
+		return nil, err
+	}
+	meta, err := parseTorrent(body)
+	if err != nil {
+		return nil, fmt.Errorf("torrent %d: %s", tid, err.Error())
+	}
+
+	return meta, nil
+}
+
+// Check whether verify needs the site for its torrent argument
+func verifyNeedsConnection(arg string) bool {
+	_, err := strconv.ParseInt(arg, 10, 64)
+	return err == nil
+}
+
+// Find the data of a torrent
+// The path may be the data itself or the directory containing it, like the download directory of a client.
+//  meta: Torrent
+//  path: File or directory
+// It returns the path of the file or root directory of the torrent and any error encountered.
+func verifyRoot(meta *metaInfo, path string) (string, error) {
+	if meta.Name == "." || meta.Name == ".." || strings.ContainsAny(meta.Name, `/\`) {
+		return "", fmt.Errorf("invalid torrent: unsafe name '%s'", meta.Name)
+	}
+
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	inside := filepath.Join(path, meta.Name)
+
+	if !meta.MultiFile {
+		if info.IsDir() {
+			return inside, nil
+		}
+		return path, nil
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory, the torrent contains a directory", path)
+	}
+	if filepath.Base(path) != meta.Name {
+		if stat, err := os.Stat(inside); err == nil && stat.IsDir() {
+			return inside, nil
+		}
+	}
+
+	return path, nil
+}
+
+// Map the files of a torrent to the disk and check their sizes
+// Files which exist are opened, the caller has to close them.
+// It returns the files.
+func openVerifyFiles(meta *metaInfo, root string) []verifyFile {
+	files := make([]verifyFile, 0, len(meta.Files))
+	var offset int64
+	for _, f := range meta.Files {
+		source := root
+		if meta.MultiFile {
+			// the first element of the path is the name of the torrent
+			elements := strings.Split(f.Path, "/")[1:]
+			source = filepath.Join(append([]string{root}, elements...)...)
+		}
+		file := verifyFile{Path: f.Path, Source: source, Length: f.Length, Offset: offset, Status: VerifyOk}
+		offset += f.Length
+
+		info, err := os.Stat(source)
+		switch {
+		case err != nil || !info.Mode().IsRegular():
+			file.Status = VerifyMissing
+		case info.Size() != f.Length:
+			file.Status = VerifySize
+			file.Size = info.Size()
+		}
+		if file.Status != VerifyMissing && f.Length > 0 {
+			fd, err := os.Open(source)
+			if err != nil {
+				file.Status = VerifyMissing
+			} else {
+				file.file = fd
+			}
+		}
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// Read a piece from the files
+// It returns false if a part of the piece is not on disk.
+func readVerifyPiece(files []verifyFile, start int64, buffer []byte) bool {
+	end := start + int64(len(buffer))
+	// the files are ordered by offset, torrents with thousands of files must not scan all of them
+	first := sort.Search(len(files), func(i int) bool { return files[i].Offset+files[i].Length > start })
+	for i := first; i < len(files) && files[i].Offset < end; i++ {
+		file := &files[i]
+		fileEnd := file.Offset + file.Length
+		if file.Length == 0 {
+			continue
+		}
+		if file.file == nil {
+			return false
+		}
+		from := start
+		if file.Offset > from {
+			from = file.Offset
+		}
+		to := end
+		if fileEnd < to {
+			to = fileEnd
+		}
+		n, err := file.file.ReadAt(buffer[from-start:to-start], from-file.Offset)
+		if int64(n) != to-from || (err != nil && err != io.EOF) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Get the number of workers hashing pieces
+// Every worker holds one piece in memory, so large pieces get fewer workers than there are CPUs.
+func verifyWorkers(pieceLength int64) int {
+	workers := runtime.NumCPU()
+	if byMemory := maxVerifyMemory / pieceLength; byMemory < int64(workers) {
+		workers = int(byMemory)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	return workers
+}
+
+// Hash all pieces in parallel and compare them with the torrent
+// It returns the indexes of the bad pieces in ascending order.
+func verifyPieces(meta *metaInfo, files []verifyFile) []int {
+	total := meta.TotalLength()
+	count := len(meta.Pieces) / sha1.Size
+	bad := make([]bool, count)
+
+	workers := verifyWorkers(meta.PieceLength)
+	jobs := make(chan int, workers*2)
+	var done sync.WaitGroup
+	var progress sync.Mutex
+	verified := 0
+	lastReport := time.Now()
+	for i := 0; i < workers; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			buffer := make([]byte, meta.PieceLength)
+			for index := range jobs {
+				start := int64(index) * meta.PieceLength
+				length := meta.PieceLength
+				if start+length > total {
+					length = total - start
+				}
+				piece := buffer[:length]
+				if !readVerifyPiece(files, start, piece) {
+					bad[index] = true
+				} else {
+					hash := sha1.Sum(piece)
+					bad[index] = !bytes.Equal(hash[:], meta.Pieces[index*sha1.Size:(index+1)*sha1.Size])
+				}
+
+				progress.Lock()
+				verified++
+				if *verboseFlag && time.Since(lastReport) > time.Second {
+					PrintVerbose(fmt.Sprintf("Verified %d%%", verified*100/count))
+					lastReport = time.Now()
+				}
+				progress.Unlock()
+			}
+		}()
+	}
+	for index := 0; index < count; index++ {
+		jobs <- index
+	}
+	close(jobs)
+	done.Wait()
+
+	indexes := make([]int, 0)
+	for index, isBad := range bad {
+		if isBad {
+			indexes = append(indexes, index)
+		}
+	}
+
+	return indexes
+}
+
+// Format piece indexes as ranges, e.g. 1-4, 7
+func formatPieceRanges(indexes []int) string {
+	parts := make([]string, 0)
+	for i := 0; i < len(indexes); {
+		j := i
+		for j+1 < len(indexes) && indexes[j+1] == indexes[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprintf("%d", indexes[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", indexes[i], indexes[j]))
+		}
+		i = j + 1
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// Check local data against a torrent
+//  torrent: Torrent-ID or .torrent file
+//  path:    Data of the torrent, or the directory containing it
+// It returns an error if data is missing or corrupt, and any other error encountered.
+func verify(torrent string, path string) error {
+	meta, err := loadVerifyTorrent(torrent)
+	if err != nil {
+		return err
+	}
+	root, err := verifyRoot(meta, path)
+	if err != nil {
+		return err
+	}
+
+	files := openVerifyFiles(meta, root)
+	defer func() {
+		for _, file := range files {
+			if file.file != nil {
+				file.file.Close()
+			}
+		}
+	}()
+	PrintVerbose("Verifying", meta.Name, "in", root)
+	badPieces := verifyPieces(meta, files)
+
+	// a corrupt piece points at every file it touches, empty files have no data in any piece
+	for _, index := range badPieces {
+		start := int64(index) * meta.PieceLength
+		end := start + meta.PieceLength
+		for i := range files {
+			file := &files[i]
+			if file.Length > 0 && file.Offset < end && file.Offset+file.Length > start {
+				file.BadPieces = append(file.BadPieces, index)
+				if file.Status == VerifyOk {
+					file.Status = VerifyCorrupted
+				}
+			}
+		}
+	}
+
+	count := len(meta.Pieces) / sha1.Size
+	record := verifyRecord{
+		Name:        meta.Name,
+		InfoHash:    meta.InfoHash,
+		Root:        root,
+		Pieces:      count,
+		GoodPieces:  count - len(badPieces),
+		Files:       files,
+		BadPieceIds: badPieces,
+	}
+	if count > 0 {
+		record.Complete = float64(record.GoodPieces) * 100 / float64(count)
+	}
+
+	rows := make([][]string, 0)
+	for _, file := range files {
+		if file.Status == VerifyOk {
+			continue
+		}
+		status := file.Status
+		switch file.Status {
+		case VerifySize:
+			status = fmt.Sprintf("%s, %s instead of %s", file.Status,
+				datasize.ByteSize(file.Size).HumanReadable(), datasize.ByteSize(file.Length).HumanReadable())
+		case VerifyCorrupted:
+			status = fmt.Sprintf("%s, pieces %s", file.Status, formatPieceRanges(file.BadPieces))
+		}
+		rows = append(rows, []string{file.Source, datasize.ByteSize(file.Length).HumanReadable(), status})
+	}
+
+	section := Section{
+		Title:   fmt.Sprintf("%s: %.1f%% complete, %d of %d pieces ok", meta.Name, record.Complete, record.GoodPieces, count),
+		Records: record,
+	}
+	if len(rows) > 0 {
+		section.Header = []string{"File", "Size", "Status"}
+		section.Rows = rows
+	} else {
+		section.Text = fmt.Sprintf("All %d files are intact", len(files))
+	}
+	if err := Render(Output{Data: record, Sections: []Section{section}}); err != nil {
+		return err
+	}
+
+	// a file which is too large still breaks seeding, even if all pieces match
+	if len(badPieces) > 0 || len(rows) > 0 {
+		return fmt.Errorf("%d of %d files are missing, corrupt or have the wrong size", len(rows), len(files))
+	}
+
+	return nil
+}
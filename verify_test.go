@@ -0,0 +1,199 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// Files of the test release in torrent order, with pieces of 16 bytes:
+// a.bin 0-20, b.bin is empty at 20, c.bin 20-50, d.bin 50-60, so piece 1 spans a and c and piece 3 spans c and d
+var verifyTestFiles = []struct {
+	name   string
+	length int
+}{
+	{"a.bin", 20},
+	{"b.bin", 0},
+	{"c.bin", 30},
+	{"d.bin", 10},
+}
+
+// Create the test release and its torrent
+// It returns the directory containing the release and the torrent file.
+func testVerifyRelease(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "Release")
+	if err := os.Mkdir(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for i, file := range verifyTestFiles {
+		data := []byte(strings.Repeat(string(rune('a'+i)), file.length))
+		if err := ioutil.WriteFile(filepath.Join(root, file.name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	announce := *announceOpt
+	defer func() { *announceOpt = announce }()
+	*announceOpt = "http://tracker.example.com/announce"
+	torrent, _, err := makeTorrent(root, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	torrentFile := filepath.Join(dir, "release.torrent")
+	if err := ioutil.WriteFile(torrentFile, torrent, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir, torrentFile
+}
+
+// Run verify with JSON output
+// It returns the record written to stdout and the error of verify.
+func testVerify(t *testing.T, torrentFile string, path string) (verifyRecord, error) {
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout, output := os.Stdout, *outputOpt
+	os.Stdout, *outputOpt = out, OutputJSON
+	verifyErr := verify(torrentFile, path)
+	os.Stdout, *outputOpt = stdout, output
+
+	var record verifyRecord
+	content, err := ioutil.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(content, &record); err != nil {
+		t.Fatalf("%s: %s", err.Error(), content)
+	}
+
+	return record, verifyErr
+}
+
+func TestVerify(t *testing.T) {
+	type fileState struct {
+		status    string
+		badPieces []int
+	}
+	ok := fileState{VerifyOk, nil}
+
+	tests := []struct {
+		name   string
+		modify func(root string) error
+		// states of a, b, c and d
+		files     []fileState
+		badPieces []int
+	}{
+		{"intact", func(string) error { return nil }, []fileState{ok, ok, ok, ok}, nil},
+		{"corrupt byte", func(root string) error {
+			file, err := os.OpenFile(filepath.Join(root, "c.bin"), os.O_WRONLY, 0)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			_, err = file.WriteAt([]byte("x"), 5)
+			return err
+		}, []fileState{{VerifyCorrupted, []int{1}}, ok, {VerifyCorrupted, []int{1}}, ok}, []int{1}},
+		{"truncated file", func(root string) error {
+			return os.Truncate(filepath.Join(root, "d.bin"), 5)
+		}, []fileState{ok, ok, {VerifyCorrupted, []int{3}}, {VerifySize, []int{3}}}, []int{3}},
+		{"missing file", func(root string) error {
+			return os.Remove(filepath.Join(root, "a.bin"))
+		}, []fileState{{VerifyMissing, []int{0, 1}}, ok, {VerifyCorrupted, []int{1}}, ok}, []int{0, 1}},
+		// an empty file has nothing to corrupt, but it must exist
+		{"missing empty file", func(root string) error {
+			return os.Remove(filepath.Join(root, "b.bin"))
+		}, []fileState{ok, {VerifyMissing, nil}, ok, ok}, nil},
+	}
+
+	for _, test := range tests {
+		dir, torrentFile := testVerifyRelease(t)
+		if err := test.modify(filepath.Join(dir, "Release")); err != nil {
+			t.Fatal(err)
+		}
+
+		// the directory containing the release is found as well
+		record, err := testVerify(t, torrentFile, dir)
+		intact := test.name == "intact"
+		if (err == nil) != intact {
+			t.Errorf("%s: verify returned %v", test.name, err)
+		}
+		if !reflect.DeepEqual(record.BadPieceIds, test.badPieces) {
+			t.Errorf("%s: bad pieces = %v, want %v", test.name, record.BadPieceIds, test.badPieces)
+		}
+		if len(record.Files) != len(test.files) {
+			t.Fatalf("%s: %d files, want %d", test.name, len(record.Files), len(test.files))
+		}
+		for i, file := range record.Files {
+			want := test.files[i]
+			if file.Status != want.status || !reflect.DeepEqual(file.BadPieces, want.badPieces) {
+				t.Errorf("%s: %s = %s %v, want %s %v", test.name, file.Path, file.Status, file.BadPieces, want.status, want.badPieces)
+			}
+		}
+	}
+}
+
+func TestFormatPieceRanges(t *testing.T) {
+	tests := []struct {
+		indexes []int
+		ranges  string
+	}{
+		{nil, ""},
+		{[]int{4}, "4"},
+		{[]int{1, 2, 3, 5}, "1-3, 5"},
+		{[]int{0, 2, 3, 7, 8, 9}, "0, 2-3, 7-9"},
+	}
+
+	for _, test := range tests {
+		if ranges := formatPieceRanges(test.indexes); ranges != test.ranges {
+			t.Errorf("formatPieceRanges(%v) = %q, want %q", test.indexes, ranges, test.ranges)
+		}
+	}
+}
+
+func TestVerifyWorkers(t *testing.T) {
+	tests := []struct {
+		pieceLength int64
+		workers     int
+	}{
+		{16 * 1024, runtime.NumCPU()},
+		{maxVerifyMemory / 2, 2},
+		{maxVerifyMemory, 1},
+	}
+
+	for _, test := range tests {
+		want := test.workers
+		if want > runtime.NumCPU() {
+			want = runtime.NumCPU()
+		}
+		if workers := verifyWorkers(test.pieceLength); workers != want {
+			t.Errorf("verifyWorkers(%d) = %d, want %d", test.pieceLength, workers, want)
+		}
+	}
+}
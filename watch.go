@@ -0,0 +1,487 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	api "github.com/fuchsi/irrenhaus-api"
+)
+
+// Number of seen torrent IDs kept per watch, the state file would grow forever otherwise
+const maxWatchSeen = 2000
+
+// Saved search, configured in the Watches section of the config file
+type WatchConfig struct {
+	Query    string
+	Category []string `json:",omitempty"`
+	Dead     bool     `json:",omitempty"`
+	// download new matches into Dest
+	Download   bool   `json:",omitempty"`
+	Dest       string `json:",omitempty"`
+	MinSize    string `json:",omitempty"`
+	MaxSize    string `json:",omitempty"`
+	MinSeeders int    `json:",omitempty"`
+	Regex      string `json:",omitempty"`
+}
+
+// Torrents a watch has seen, stored in the state file
+type watchState struct {
+	Seen    []int64
+	LastRun time.Time
+}
+
+type watchRecord struct {
+	Name     string    `json:"name"`
+	Query    string    `json:"query"`
+	Category []string  `json:"category,omitempty"`
+	Dead     bool      `json:"dead"`
+	Download bool      `json:"download"`
+	Dest     string    `json:"dest,omitempty"`
+	LastRun  time.Time `json:"last_run"`
+	Seen     int       `json:"seen"`
+}
+
+// New matches of a watch
+type watchResult struct {
+	Watch    string          `json:"watch"`
+	Torrents []torrentRecord `json:"torrents"`
+}
+
+func watchUsage() {
+	fmt.Println("watch subcommand")
+
+	fmt.Println("\tadd [-c category] [-d] [--download [--dest dir]] [--min-size size] [--max-size size] [--min-seeders n] [--regex re] <name> <query>")
+	fmt.Println("\t\tSave a search")
+
+	fmt.Println("\tremove <name>")
+	fmt.Println("\t\tRemove a saved search")
+
+	fmt.Println("\tlist")
+	fmt.Println("\t\tList the saved searches")
+
+	fmt.Println("\trun [--client name] [name]...")
+	fmt.Println("\t\tRun the saved searches once and show the new matches")
+
+	fmt.Println("\tdaemon [--interval 15m] [--client name] [name]...")
+	fmt.Println("\t\tRun the saved searches forever")
+
+	fmt.Println("\tThe first run of a search only remembers the current results, later runs report new torrents")
+}
+
+// Get the path of the state file of the watches
+func watchStatePath() string {
+	return CONFIGPATH + "watch-state.json"
+}
+
+// Read the seen torrents of all watches
+// A missing state file is not an error, every watch starts fresh.
+// It returns the states by watch name and any error encountered.
+func loadWatchState() (map[string]watchState, error) {
+	states := make(map[string]watchState)
+	content, err := ioutil.ReadFile(watchStatePath())
+	if os.IsNotExist(err) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &states); err != nil {
+		return nil, fmt.Errorf("%s: %s", watchStatePath(), err.Error())
+	}
+
+	return states, nil
+}
+
+func dumpWatchState(states map[string]watchState) error {
+	content, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(watchStatePath(), append(content, '\n'), 0600)
+}
+
+// Build the search filter of a watch
+// It returns the filter and any error encountered.
+func (w WatchConfig) filter() (searchFilter, error) {
+	var f searchFilter
+	var err error
+
+	if w.MinSize != "" {
+		if f.MinSize, err = parseSize(w.MinSize); err != nil {
+			return f, err
+		}
+	}
+	if w.MaxSize != "" {
+		if f.MaxSize, err = parseSize(w.MaxSize); err != nil {
+			return f, err
+		}
+	}
+	f.MinSeeders = w.MinSeeders
+	if w.Regex != "" {
+		if f.Regex, err = compileNameRegex(w.Regex); err != nil {
+			return f, err
+		}
+	}
+
+	return f, nil
+}
+
+// Save a search, replacing a saved search with the same name
+// Its state is reset, so the next run only remembers the current results.
+// It returns any error encountered.
+func watchAdd(name string, w WatchConfig) error {
+	if name == "" || strings.TrimSpace(w.Query) == "" {
+		return errors.New("name and query must not be empty")
+	}
+	if _, err := resolveCategories(w.Category); err != nil {
+		return err
+	}
+	if _, err := w.filter(); err != nil {
+		return err
+	}
+
+	states, err := loadWatchState()
+	if err != nil {
+		return err
+	}
+	if _, ok := states[name]; ok {
+		delete(states, name)
+		if err := dumpWatchState(states); err != nil {
+			return err
+		}
+	}
+
+	if config.Watches == nil {
+		config.Watches = make(map[string]WatchConfig)
+	}
+	config.Watches[name] = w
+	if err := dumpConfig(config, configFile); err != nil {
+		return err
+	}
+
+	PrintQuiet("Saved the search", name)
+	return nil
+}
+
+func watchRemove(name string) error {
+	if _, ok := config.Watches[name]; !ok {
+		return fmt.Errorf("unknown watch '%s'. See 'watch list'", name)
+	}
+	delete(config.Watches, name)
+	if err := dumpConfig(config, configFile); err != nil {
+		return err
+	}
+
+	states, err := loadWatchState()
+	if err != nil {
+		return err
+	}
+	if _, ok := states[name]; ok {
+		delete(states, name)
+		return dumpWatchState(states)
+	}
+
+	return nil
+}
+
+// Get the names of the watches, all of them if names is empty
+// It returns the sorted names and any error encountered.
+func watchNames(names []string) ([]string, error) {
+	if len(names) == 0 {
+		for name := range config.Watches {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		if _, ok := config.Watches[name]; !ok {
+			return nil, fmt.Errorf("unknown watch '%s'. See 'watch list'", name)
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func watchList() error {
+	names, err := watchNames(nil)
+	if err != nil {
+		return err
+	}
+	states, err := loadWatchState()
+	if err != nil {
+		return err
+	}
+
+	records := make([]watchRecord, 0, len(names))
+	rows := make([][]string, 0, len(names))
+	for _, name := range names {
+		w := config.Watches[name]
+		state := states[name]
+		records = append(records, watchRecord{name, w.Query, w.Category, w.Dead, w.Download, w.Dest, state.LastRun, len(state.Seen)})
+
+		download := "No"
+		if w.Download {
+			download = "Yes"
+			if w.Dest != "" {
+				download += ", " + w.Dest
+			}
+		}
+		lastRun := "never"
+		if !state.LastRun.IsZero() {
+			lastRun = state.LastRun.Format("02.01.2006 15:04:05")
+		}
+		rows = append(rows, []string{name, w.Query, strings.Join(w.Category, ","), download, lastRun, fmt.Sprintf("%d", len(state.Seen))})
+	}
+
+	return Render(Output{
+		Data: records,
+		Sections: []Section{{
+			Header:  []string{"Name", "Query", "Category", "Download", "Last Run", "Seen"},
+			Rows:    rows,
+			Records: records,
+		}},
+	})
+}
+
+// Run a saved search and find the torrents it has not seen before
+//  name:  Name of the watch
+//  state: Seen torrents, updated with the results
+// It returns the new matches and any error encountered.
+func runWatch(name string, state *watchState) ([]api.Entry, error) {
+	w := config.Watches[name]
+	categories, err := resolveCategories(w.Category)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := w.filter()
+	if err != nil {
+		return nil, err
+	}
+
+	c := getConnection()
+	var entries []api.Entry
+	err = withSession(func() (err error) {
+		entries, err = api.Search(c, w.Query, categories, w.Dead)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return newWatchMatches(name, filterEntries(entries, filter), state), nil
+}
+
+// Find the search results a watch has not seen before and remember them
+// The first run only remembers the results and finds nothing.
+//  name:    Name of the watch
+//  entries: Search results
+//  state:   Seen torrents, updated with the results
+// It returns the new matches, the newest first.
+func newWatchMatches(name string, entries []api.Entry, state *watchState) []api.Entry {
+	seen := make(map[int64]bool, len(state.Seen))
+	for _, id := range state.Seen {
+		seen[id] = true
+	}
+	first := state.LastRun.IsZero()
+	found := make([]api.Entry, 0)
+	for _, entry := range entries {
+		if seen[entry.Id] {
+			continue
+		}
+		seen[entry.Id] = true
+		state.Seen = append(state.Seen, entry.Id)
+		found = append(found, entry)
+	}
+	state.LastRun = time.Now()
+
+	// the newest IDs are the ones which can show up in the next search again
+	if len(state.Seen) > maxWatchSeen {
+		sort.Slice(state.Seen, func(i, j int) bool { return state.Seen[i] < state.Seen[j] })
+		state.Seen = state.Seen[len(state.Seen)-maxWatchSeen:]
+	}
+
+	if first {
+		PrintQuiet(fmt.Sprintf("First run of %s, remembering %d results", name, len(found)))
+		return []api.Entry{}
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Added.After(found[j].Added) })
+
+	return found
+}
+
+// Download a new match of a watch and send it to the client
+// A torrent file which exists already is sent to the client again, because the
+// client may have failed when it was downloaded.
+//  client: Client from --client, or nil
+//  wait:   Called before every request to the site, see newRequestLimiter
+// It returns any error encountered.
+func watchDownload(entry api.Entry, dest string, client torrentClient, wait func()) error {
+	path, err := fetchTorrent(entry.Id, dest, *forceFlag, wait)
+	if err == ErrExists {
+		PrintVerbose(path, "exists already")
+	} else if err != nil {
+		return err
+	} else {
+		PrintQuiet("Download to", path, "complete")
+	}
+
+	if client != nil {
+		return sendToClient(client, *clientOpt, path)
+	}
+
+	return nil
+}
+
+// Run saved searches once, print the new matches and download them if configured
+//  names: Watches to run, all of them if empty
+// It returns any error encountered.
+func watchRun(names []string) error {
+	names, err := watchNames(names)
+	if err != nil {
+		return err
+	}
+	columns, err := resolveSearchColumns(*searchColumnsOpt)
+	if err != nil {
+		return err
+	}
+	header := make([]string, 0, len(columns))
+	for _, column := range columns {
+		header = append(header, column.Header)
+	}
+
+	states, err := loadWatchState()
+	if err != nil {
+		return err
+	}
+
+	var client torrentClient
+	if *clientOpt != "" {
+		client, err = newTorrentClient(*clientOpt)
+		if err != nil {
+			return err
+		}
+	}
+	wait, stop := newRequestLimiter()
+	defer stop()
+
+	results := make([]watchResult, 0)
+	sections := make([]Section, 0)
+	failed := make([]string, 0)
+	for _, name := range names {
+		state := states[name]
+		found, err := runWatch(name, &state)
+		if err != nil {
+			// one broken search must not stop the others
+			fmt.Fprintf(os.Stderr, "%s: %s\n", name, err.Error())
+			failed = append(failed, name)
+			continue
+		}
+
+		w := config.Watches[name]
+		downloaded := true
+		for _, entry := range found {
+			if !w.Download {
+				break
+			}
+			if err := watchDownload(entry, w.Dest, client, wait); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %d: %s\n", name, entry.Id, err.Error())
+				downloaded = false
+				break
+			}
+		}
+		if downloaded {
+			states[name] = state
+			if err := dumpWatchState(states); err != nil {
+				return err
+			}
+		} else {
+			// the next run reports the new torrents again, and downloads or sends them to the client
+			failed = append(failed, name)
+		}
+
+		if len(found) == 0 {
+			continue
+		}
+		result := watchResult{Watch: name}
+		rows := make([][]string, 0, len(found))
+		for _, entry := range found {
+			record := newTorrentRecord(entry)
+			result.Torrents = append(result.Torrents, record)
+			row := make([]string, 0, len(columns))
+			for _, column := range columns {
+				row = append(row, column.Value(record))
+			}
+			rows = append(rows, row)
+		}
+		results = append(results, result)
+		sections = append(sections, Section{
+			Title:   fmt.Sprintf("%s: %d new Torrents", name, len(found)),
+			Header:  header,
+			Rows:    rows,
+			Records: result.Torrents,
+		})
+	}
+
+	if len(sections) > 0 || machineOutput() {
+		if err := Render(Output{Data: results, Sections: sections}); err != nil {
+			return err
+		}
+	} else {
+		PrintVerbose("No new torrents")
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed watches: %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// Run saved searches forever
+//  interval: Time between two runs, e.g. 15m
+//  names:    Watches to run, all of them if empty
+// It returns any error encountered before the first run.
+func watchDaemon(interval string, names []string) error {
+	wait, err := time.ParseDuration(interval)
+	if err != nil {
+		return fmt.Errorf("invalid interval '%s'", interval)
+	}
+	if wait < time.Minute {
+		return errors.New("the interval must be at least 1m")
+	}
+	if _, err := watchNames(names); err != nil {
+		return err
+	}
+
+	for {
+		if err := watchRun(names); err != nil {
+			// the site or the network may be back at the next run
+			fmt.Fprintln(os.Stderr, time.Now().Format("02.01.2006 15:04:05"), err.Error())
+		}
+		time.Sleep(wait)
+	}
+}
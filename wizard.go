@@ -0,0 +1,404 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fuchsi/irrenhaus-api/Category"
+	"golang.org/x/term"
+)
+
+// Extensions of images which are offered by the upload wizard
+var wizardImageExts = []string{".jpg", ".jpeg", ".png", ".gif", ".bmp", ".tif", ".tiff", ".webp"}
+
+// Ask the user for some input, with a default for empty input
+//  prompt: Prompt/Question for the user
+//  def:    Default value, shown in brackets
+//  result: Input from the user
+// It returns any error encountered.
+func askDefault(prompt string, def string, result *string) error {
+	if def != "" {
+		prompt = fmt.Sprintf("%s [%s]", prompt, def)
+	}
+	if err := Ask(prompt, result); err != nil {
+		return err
+	}
+	*result = strings.TrimSpace(*result)
+	if *result == "" {
+		*result = def
+	}
+
+	return nil
+}
+
+// Ask the user for a file, offering a numbered list of candidates
+//  prompt:     Prompt/Question for the user
+//  candidates: Files which can be selected by their number
+//  def:        Default value, shown in brackets
+//  optional:   Whether empty input without default is allowed
+// It returns the path and any error encountered.
+func askFile(prompt string, candidates []string, def string, optional bool) (string, error) {
+	for i, candidate := range candidates {
+		fmt.Printf("%4d  %s\n", i+1, candidate)
+	}
+	if len(candidates) > 0 {
+		prompt += " (number or path)"
+	}
+
+	for {
+		var answer string
+		if err := askDefault(prompt, def, &answer); err != nil {
+			return "", err
+		}
+		if answer == "" {
+			if optional {
+				return "", nil
+			}
+			continue
+		}
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(candidates) {
+			answer = candidates[n-1]
+		}
+		if _, err := os.Stat(answer); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			continue
+		}
+
+		return answer, nil
+	}
+}
+
+// Ask the user a yes/no question, no is the default
+func askConfirm(prompt string) (bool, error) {
+	var answer string
+	if err := Ask(prompt+" [y/N]", &answer); err != nil {
+		return false, err
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes", nil
+}
+
+// Find the files in a directory with one of the extensions
+// It returns the paths sorted by name, or nil if the directory can't be read.
+func findFiles(dir string, exts []string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	files := make([]string, 0)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		for _, e := range exts {
+			if ext == e {
+				files = append(files, filepath.Join(dir, entry.Name()))
+				break
+			}
+		}
+	}
+	sort.Strings(files)
+
+	return files
+}
+
+// Get the directory of the release, where the NFO and images are searched
+// For a torrent file this is the directory of its content next to it, if it exists.
+func wizardReleaseDir(m *uploadManifest) string {
+	if m.From != "" {
+		if stat, err := os.Stat(m.From); err == nil && stat.IsDir() {
+			return m.From
+		}
+		return filepath.Dir(m.From)
+	}
+
+	dir := filepath.Dir(m.Torrent)
+	if meta, err := loadTorrent(m.Torrent); err == nil {
+		content := filepath.Join(dir, meta.Name)
+		if stat, err := os.Stat(content); err == nil && stat.IsDir() {
+			return content
+		}
+	}
+
+	return dir
+}
+
+// Ask for the torrent file, or the file or directory to create it from
+func wizardTorrent(m *uploadManifest) error {
+	def := m.Torrent
+	if m.From != "" {
+		def = m.From
+	}
+
+	for {
+		var path string
+		if err := askDefault("Torrent file, or release file/directory to create it from", def, &path); err != nil {
+			return err
+		}
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			continue
+		}
+
+		m.Torrent, m.From = "", ""
+		if strings.ToLower(filepath.Ext(path)) == ".torrent" {
+			m.Torrent = path
+		} else {
+			m.From = path
+		}
+		return nil
+	}
+}
+
+// Get the name the wizard offers for the release
+func wizardDefaultName(m *uploadManifest) string {
+	if m.Name != "" {
+		return m.Name
+	}
+	if m.From != "" {
+		return filepath.Base(filepath.Clean(m.From))
+	}
+	if meta, err := loadTorrent(m.Torrent); err == nil && meta.Name != "" {
+		return meta.Name
+	}
+
+	return strings.TrimSuffix(filepath.Base(m.Torrent), filepath.Ext(m.Torrent))
+}
+
+// Ask for the category, listing all categories with their IDs
+func wizardCategory(m *uploadManifest) error {
+	for _, c := range categoryList() {
+		fmt.Printf("%4d  %s\n", c.Id, c.Name)
+	}
+
+	for {
+		var answer string
+		if err := askDefault("Category (ID or name)", m.Category, &answer); err != nil {
+			return err
+		}
+		if answer == "" {
+			continue
+		}
+		id, err := resolveSingleCategory([]string{answer})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			continue
+		}
+
+		m.Category = strconv.Itoa(id)
+		return nil
+	}
+}
+
+// Ask for the description file, or write the description in $EDITOR
+// It returns the path of a temporary description file, which has to be removed, and any error encountered.
+func wizardDescription(m *uploadManifest) (string, error) {
+	var path string
+	if err := askDefault("Description file (.txt, .md or .tmpl, empty to open $EDITOR)", m.Description, &path); err != nil {
+		return "", err
+	}
+	if path != "" {
+		m.Description = path
+		return "", nil
+	}
+
+	for {
+		text, err := ReadText("[b]" + m.Name + "[/b]\n\n")
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimSpace(text) != "" {
+			file, err := ioutil.TempFile("", "irrenhaus-description-*.txt")
+			if err != nil {
+				return "", err
+			}
+			defer file.Close()
+			if _, err := file.WriteString(text); err != nil {
+				os.Remove(file.Name())
+				return "", err
+			}
+			m.Description = file.Name()
+			return file.Name(), nil
+		}
+
+		retry, err := askConfirm("The description is empty. Open the editor again?")
+		if err != nil {
+			return "", err
+		}
+		if !retry {
+			return "", errors.New("a description is required")
+		}
+	}
+}
+
+// Ask for the images and the optional contact sheet
+func wizardImages(m *uploadManifest, dir string) error {
+	candidates := findFiles(dir, wizardImageExts)
+	defaults := append(append([]string{}, m.Images...), "", "")
+
+	first, err := askFile("Image 1", candidates, defaults[0], false)
+	if err != nil {
+		return err
+	}
+	second, err := askFile("Image 2 (empty for none)", nil, defaults[1], true)
+	if err != nil {
+		return err
+	}
+	m.Images = []string{first}
+	if second != "" {
+		m.Images = append(m.Images, second)
+		m.ContactSheet = nil
+		return nil
+	}
+
+	var sheet string
+	if err := askDefault("Images for a contact sheet as second image, comma separated (empty for none)",
+		strings.Join(m.ContactSheet, ","), &sheet); err != nil {
+		return err
+	}
+	m.ContactSheet = nil
+	for _, path := range strings.Split(sheet, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			m.ContactSheet = append(m.ContactSheet, path)
+		}
+	}
+
+	return nil
+}
+
+// Print the fields of an upload
+func printUploadSummary(m *uploadManifest) error {
+	rows := make([][]string, 0)
+	if m.From != "" {
+		rows = append(rows, []string{"From", m.From})
+	} else {
+		rows = append(rows, []string{"Torrent", m.Torrent})
+	}
+	category := m.Category
+	if id, err := strconv.Atoi(m.Category); err == nil {
+		if name, err := Category.ToString(id); err == nil {
+			category += " " + name
+		}
+	}
+	rows = append(rows, []string{"Name", m.Name}, []string{"Category", category}, []string{"NFO", m.Nfo},
+		[]string{"Description", m.Description})
+	for i, image := range m.Images {
+		rows = append(rows, []string{fmt.Sprintf("Image %d", i+1), image})
+	}
+	if len(m.ContactSheet) > 0 {
+		rows = append(rows, []string{"Contact sheet", strings.Join(m.ContactSheet, ", ")})
+	}
+
+	return Render(Output{
+		Data: m,
+		Sections: []Section{{
+			Title:   "Summary:",
+			Header:  []string{"Field", "Value"},
+			Rows:    rows,
+			Records: rows,
+		}},
+	})
+}
+
+// Guide the user through an upload, asking for every field
+// Fields which are already set are offered as defaults.
+// It returns any error encountered.
+func uploadWizard(m *uploadManifest) error {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return errors.New("upload --interactive needs a terminal")
+	}
+
+	err := wizardTorrent(m)
+	if err != nil {
+		return err
+	}
+	if err = askDefault("Name", wizardDefaultName(m), &m.Name); err != nil {
+		return err
+	}
+	if err = wizardCategory(m); err != nil {
+		return err
+	}
+
+	dir := wizardReleaseDir(m)
+	nfos := findFiles(dir, []string{".nfo"})
+	if m.Nfo == "" && len(nfos) == 1 {
+		m.Nfo = nfos[0]
+	}
+	if m.Nfo, err = askFile("NFO", nfos, m.Nfo, false); err != nil {
+		return err
+	}
+
+	tempDescription, err := wizardDescription(m)
+	if err != nil {
+		return err
+	}
+	if tempDescription != "" {
+		defer os.Remove(tempDescription)
+	}
+
+	if err := wizardImages(m, dir); err != nil {
+		return err
+	}
+
+	if err := printUploadSummary(m); err != nil {
+		return err
+	}
+	checks := validateUpload(m)
+	if err := printValidation([]string{"Checks:"}, [][]validationCheck{checks}); err != nil {
+		return err
+	}
+	if failed := failedChecks(checks); failed > 0 {
+		return fmt.Errorf("%d checks failed, nothing was uploaded", failed)
+	}
+	if *dryRunFlag {
+		PrintQuiet("Dry run, nothing was uploaded")
+		return nil
+	}
+
+	ok, err := askConfirm("Upload " + m.Name + "?")
+	if err != nil {
+		return err
+	}
+	if !ok {
+		PrintQuiet("Nothing was uploaded")
+		return nil
+	}
+
+	id, err := uploadRelease(m)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Upload successful:", detailsURL(id))
+	return nil
+}
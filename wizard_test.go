@@ -0,0 +1,67 @@
+/*
+ * irrenhaus-cli, CLI client for irrenhaus.dyndns.dk
+ * Copyright (C) 2018  Daniel Müller
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Replace stdin with a file containing input for a test
+func testStdin(t *testing.T, input string) {
+	path := filepath.Join(t.TempDir(), "stdin")
+	if err := ioutil.WriteFile(path, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin := os.Stdin
+	os.Stdin = file
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		file.Close()
+	})
+}
+
+func TestWizardAbortsAtEOF(t *testing.T) {
+	// required prompts asked again on empty input must not wait forever for more
+	testStdin(t, "")
+	if _, err := askFile("NFO", nil, "", false); err == nil {
+		t.Error("askFile returned no error at the end of stdin")
+	}
+
+	testStdin(t, "")
+	m := &uploadManifest{}
+	if err := wizardTorrent(m); err == nil {
+		t.Error("wizardTorrent returned no error at the end of stdin")
+	}
+}
+
+func TestAskLastLine(t *testing.T) {
+	// the last line needs no newline
+	testStdin(t, "answer")
+	var result string
+	if err := Ask("Question", &result); err != nil || result != "answer" {
+		t.Errorf("Ask = %q, %v, want %q", result, err, "answer")
+	}
+}